@@ -0,0 +1,814 @@
+package markup
+
+import (
+	"bytes"
+	"html"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+ * ANSI terminal renderer, for help texts and previews in a terminal. It
+ * lays the text out like the plain text renderer, with the same markers
+ * and the same wrapping at the end, and styles it with SGR sequences:
+ * bold, italic and underline for emphasis and headers, colours for code
+ * (highlighted when there is a lexer for its language), box drawn
+ * tables, and links as OSC 8 hyperlinks.
+ *
+ * Styles are switched off with their own SGR code ("\x1b[22m" for bold)
+ * rather than a reset, so that they nest. A line wrapped in the middle
+ * of a style is closed with a reset and the styles still open are
+ * opened again after the prefix of the next line.
+ *
+ * Widths are counted in terminal columns: escape sequences take none,
+ * wide East Asian characters two, and the lines may also be broken
+ * between two wide characters.
+ *
+ * The control characters of the document are dropped, so that it can't
+ * send escape sequences of its own to the terminal.
+ */
+
+/* ANSI options */
+const (
+	ANSI_NO_COLOR      = 1 << 0 /* no escape sequences at all, for dumb terminals and pipes */
+	ANSI_NO_HYPERLINKS = 1 << 1 /* urls written after the link text rather than as OSC 8 links */
+)
+
+/* SGR codes, each with the code that switches it off */
+const (
+	ansi_bold      = "1"
+	ansi_italic    = "3"
+	ansi_underline = "4"
+	ansi_strike    = "9"
+	ansi_dim       = "2"
+	ansi_code      = "36"
+)
+
+var ansi_off = map[string]string{
+	ansi_bold:      "22",
+	ansi_dim:       "22",
+	ansi_italic:    "23",
+	ansi_underline: "24",
+	ansi_strike:    "29",
+}
+
+/* colours of the highlighted tokens, by Pygments class */
+var ansi_token_colors = map[string]string{
+	"k":  "32",
+	"kt": "31",
+	"kc": "32",
+	"nb": "32",
+	"nt": "32",
+	"nv": "34",
+	"s":  "31",
+	"m":  "35",
+	"c":  "90",
+	"cp": "33",
+	"o":  "90",
+	"gd": "31",
+	"gi": "32",
+	"gh": "34",
+	"gu": "35",
+}
+
+// AnsiOptions are the settings of MarkdownToAnsi.
+type AnsiOptions struct {
+	// Flags is a combination of the ANSI_* flags.
+	Flags uint
+
+	// Width is the column at which running text is wrapped,
+	// 0 leaves every paragraph on a single line.
+	Width int
+
+	// Extensions are the MKDEXT_* flags of the parser.
+	Extensions uint
+
+	// Config holds the additional parser settings, it may be nil.
+	Config *Config
+}
+
+type ansi_renderopt struct {
+	flags uint
+	width int
+}
+
+/* copies text without its control characters, joining the lines */
+func ansi_escape(ob *bytes.Buffer, text []byte) {
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\n' || c == '\t' || c == text_break:
+			ob.WriteByte(' ')
+		case c < ' ' || c == 0x7f:
+		case c >= utf8.RuneSelf:
+			r, size := utf8.DecodeRune(text[i:])
+			if r >= 0x80 && r < 0xa0 {
+				/* C1 controls, CSI among them */
+			} else {
+				ob.Write(text[i : i+size])
+			}
+			i += size
+			continue
+		default:
+			ob.WriteByte(c)
+		}
+		i++
+	}
+}
+
+/* length of the escape sequence at the start of text */
+func ansi_seq_len(text []byte) int {
+	if len(text) < 2 {
+		return len(text)
+	}
+	switch text[1] {
+	case '[':
+		for i := 2; i < len(text); i++ {
+			if text[i] >= 0x40 && text[i] <= 0x7e {
+				return i + 1
+			}
+		}
+	case ']':
+		for i := 2; i < len(text); i++ {
+			if text[i] == '\a' {
+				return i + 1
+			}
+			if text[i] == '\x1b' && i+1 < len(text) && text[i+1] == '\\' {
+				return i + 2
+			}
+		}
+	default:
+		return 2
+	}
+	return len(text)
+}
+
+/* display width of styled text, in columns */
+func ansi_width(text []byte) int {
+	w := 0
+	for i := 0; i < len(text); {
+		if text[i] == '\x1b' {
+			i += ansi_seq_len(text[i:])
+			continue
+		}
+		r, size := utf8.DecodeRune(text[i:])
+		w += rune_width(r)
+		i += size
+	}
+	return w
+}
+
+func ansi_sgr(ob *bytes.Buffer, code string) {
+	ob.WriteString("\x1b[")
+	ob.WriteString(code)
+	ob.WriteByte('m')
+}
+
+/* writes styled text; the same style switched off inside it is switched
+ * back on, so that **x** in a bold header leaves the rest of it bold */
+func ansi_style(ob *bytes.Buffer, options *ansi_renderopt, code string, text []byte) {
+	if options.flags&ANSI_NO_COLOR != 0 {
+		ob.Write(text)
+		return
+	}
+	off := ansi_off[code]
+	if off == "" {
+		off = "39"
+	}
+	var on, end bytes.Buffer
+	ansi_sgr(&on, code)
+	ansi_sgr(&end, off)
+	ob.Write(on.Bytes())
+	ob.Write(bytes.Replace(text, end.Bytes(), append(end.Bytes(), on.Bytes()...), -1))
+	ob.Write(end.Bytes())
+}
+
+/* writes text as an OSC 8 hyperlink to link */
+func ansi_hyperlink(ob *bytes.Buffer, link []byte, text []byte) {
+	ob.WriteString("\x1b]8;;")
+	for _, c := range link {
+		/* the url ends at a space or a control character */
+		if c <= ' ' || c == 0x7f {
+			ob.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+		} else {
+			ob.WriteByte(c)
+		}
+	}
+	ob.WriteString("\x1b\\")
+	ob.Write(text)
+	ob.WriteString("\x1b]8;;\x1b\\")
+}
+
+/* writes the text of a link, as a hyperlink or followed by its url */
+func ansi_link_text(ob *bytes.Buffer, options *ansi_renderopt, link []byte, text []byte) {
+	if len(link) == 0 {
+		ob.Write(text)
+		return
+	}
+	if options.flags&(ANSI_NO_COLOR|ANSI_NO_HYPERLINKS) != 0 {
+		ob.Write(text)
+		if !text_is_url(text, link) {
+			ob.WriteString(" (")
+			ansi_escape(ob, link)
+			ob.WriteByte(')')
+		}
+		return
+	}
+	var styled bytes.Buffer
+	ansi_style(&styled, options, ansi_underline, text)
+	ansi_hyperlink(ob, link, styled.Bytes())
+}
+
+func ansi_blockcode(ob *bytes.Buffer, text []byte, lang []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("ansi_blockcode"))
+	options, _ := opaque.(*ansi_renderopt)
+	text_block(ob)
+
+	tokens := []Token{{"", text}}
+	if lx := find_lexer(code_lang(lang, attrs)); lx != nil {
+		tokens = lx(text)
+	}
+	for _, line := range token_lines(tokens) {
+		var code bytes.Buffer
+		for _, t := range line {
+			var part bytes.Buffer
+			/* tabs would become single spaces */
+			code_text := bytes.Replace(bytes.TrimRight(t.Text, "\n"), []byte("\t"), []byte("    "), -1)
+			ansi_escape(&part, code_text)
+			color := ansi_code
+			if t.Class != "" {
+				if color = ansi_token_colors[t.Class]; color == "" {
+					color = ansi_token_colors[t.Class[:1]]
+				}
+			}
+			if color == "" || part.Len() == 0 {
+				code.Write(part.Bytes())
+			} else {
+				ansi_style(&code, options, color, part.Bytes())
+			}
+		}
+		if code.Len() > 0 {
+			ob.WriteString("    ")
+			ob.Write(code.Bytes())
+		}
+		ob.WriteByte('\n')
+	}
+}
+
+func ansi_blockquote(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("ansi_blockquote"))
+	options, _ := opaque.(*ansi_renderopt)
+	text_block(ob)
+	var bar bytes.Buffer
+	ansi_style(&bar, options, ansi_dim, []byte("│"))
+	bar.WriteByte(' ')
+	text_indent(ob, bytes.TrimLeft(text, "\n"), bar.String(), bar.String())
+}
+
+/* bold and underlined for the first level, bold for the second and
+ * underlined below; without colours the first two levels keep the setext
+ * underlines of the plain text */
+func ansi_header(ob *bytes.Buffer, text []byte, level int, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("ansi_header"))
+	options, _ := opaque.(*ansi_renderopt)
+	text_block(ob)
+	text = bytes.Trim(text, " ")
+
+	if options.flags&ANSI_NO_COLOR != 0 {
+		text_running(ob, text)
+		if level <= 2 {
+			c := "="
+			if level == 2 {
+				c = "-"
+			}
+			width := ansi_width(text)
+			if options.width > 0 && width > options.width {
+				width = options.width
+			}
+			ob.WriteString(strings.Repeat(c, width))
+			ob.WriteByte('\n')
+		}
+		return
+	}
+
+	var styled bytes.Buffer
+	switch level {
+	case 1:
+		var underlined bytes.Buffer
+		ansi_style(&underlined, options, ansi_underline, text)
+		ansi_style(&styled, options, ansi_bold, underlined.Bytes())
+	case 2:
+		ansi_style(&styled, options, ansi_bold, text)
+	default:
+		ansi_style(&styled, options, ansi_underline, text)
+	}
+	text_running(ob, styled.Bytes())
+}
+
+func ansi_hrule(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("ansi_hrule"))
+	options, _ := opaque.(*ansi_renderopt)
+	text_block(ob)
+	width := options.width
+	if width <= 0 {
+		width = text_hrule_width
+	}
+	ansi_style(ob, options, ansi_dim, []byte(strings.Repeat("─", width)))
+	ob.WriteByte('\n')
+}
+
+/* bullets or right aligned numbers, the content hanging under the text
+ * of the first line */
+func ansi_list(ob *bytes.Buffer, text []byte, flags, start int, opaque interface{}) {
+	defer un(trace("ansi_list"))
+	options, _ := opaque.(*ansi_renderopt)
+	text_block(ob)
+	items := bytes.Split(text, []byte{text_item})[1:]
+	width := 2
+	if flags&MKD_LIST_ORDERED != 0 {
+		width = len(strconv.Itoa(start+len(items)-1)) + 2
+	}
+	for i, item := range items {
+		var bullet bytes.Buffer
+		if flags&MKD_LIST_ORDERED != 0 {
+			n := strconv.Itoa(start+i) + "."
+			bullet.WriteString(strings.Repeat(" ", width-1-len(n)))
+			ansi_style(&bullet, options, ansi_bold, []byte(n))
+			bullet.WriteByte(' ')
+		} else {
+			bullet.WriteString("• ")
+		}
+		/* the items made of blocks start with a blank line */
+		if len(item) > 0 && item[0] == '\n' {
+			if i > 0 {
+				ob.WriteByte('\n')
+			}
+			item = item[1:]
+		}
+		text_indent(ob, item, bullet.String(), strings.Repeat(" ", width))
+	}
+}
+
+func ansi_paragraph(ob *bytes.Buffer, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("ansi_paragraph"))
+	text = bytes.Trim(text, " ")
+	if len(text) == 0 {
+		return
+	}
+	text_block(ob)
+	text_running(ob, text)
+}
+
+/* writes a box drawn rule of the columns: left, joints and right corner */
+func ansi_table_rule(ob *bytes.Buffer, widths []int, left, joint, right string) {
+	ob.WriteString(left)
+	for i, w := range widths {
+		if i > 0 {
+			ob.WriteString(joint)
+		}
+		ob.WriteString(strings.Repeat("─", w+2))
+	}
+	ob.WriteString(right)
+	ob.WriteByte('\n')
+}
+
+/* a box drawn table, the header row in bold and ruled off */
+func ansi_table(ob *bytes.Buffer, header []byte, body []byte, opaque interface{}) {
+	defer un(trace("ansi_table"))
+	options, _ := opaque.(*ansi_renderopt)
+	text_block(ob)
+
+	rows, aligns := text_table_rows(header, body)
+	widths := make([]int, len(aligns))
+	for _, row := range rows {
+		for i, cell := range row {
+			if w := ansi_width(cell); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+
+	ansi_table_rule(ob, widths, "┌", "┬", "┐")
+	for r, row := range rows {
+		ob.WriteString("│")
+		for i := range widths {
+			var cell []byte
+			if i < len(row) {
+				cell = row[i]
+			}
+			pad := widths[i] - ansi_width(cell)
+			left := 0
+			switch aligns[i] {
+			case MKD_TABLE_ALIGN_R:
+				left = pad
+			case MKD_TABLE_ALIGN_CENTER:
+				left = pad / 2
+			}
+			ob.WriteString(strings.Repeat(" ", left+1))
+			if r == 0 && len(cell) > 0 {
+				ansi_style(ob, options, ansi_bold, cell)
+			} else {
+				ob.Write(cell)
+			}
+			ob.WriteString(strings.Repeat(" ", pad-left+1))
+			ob.WriteString("│")
+		}
+		ob.WriteByte('\n')
+		if r == 0 && len(rows) > 1 {
+			ansi_table_rule(ob, widths, "├", "┼", "┤")
+		}
+	}
+	ansi_table_rule(ob, widths, "└", "┴", "┘")
+}
+
+/* a terminal can't fold: the summary in bold, then the body */
+func ansi_details(ob *bytes.Buffer, summary []byte, text []byte, open bool, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("ansi_details"))
+	options, _ := opaque.(*ansi_renderopt)
+	text_block(ob)
+	var bold bytes.Buffer
+	ansi_style(&bold, options, ansi_bold, bytes.Trim(summary, " "))
+	text_running(ob, bold.Bytes())
+	if text = bytes.Trim(text, "\n"); len(text) > 0 {
+		ob.WriteByte('\n')
+		ob.Write(text)
+		ob.WriteByte('\n')
+	}
+}
+
+func ansi_directive(ob *bytes.Buffer, name []byte, title []byte, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("ansi_directive"))
+	options, _ := opaque.(*ansi_renderopt)
+	text_block(ob)
+	if title = bytes.Trim(title, " "); len(title) > 0 {
+		var bold bytes.Buffer
+		ansi_style(&bold, options, ansi_bold, title)
+		text_running(ob, bold.Bytes())
+		ob.WriteByte('\n')
+	}
+	ob.Write(bytes.Trim(text, "\n"))
+	ob.WriteByte('\n')
+}
+
+func ansi_autolink(ob *bytes.Buffer, link []byte, typ int, opaque interface{}) bool {
+	defer un(trace("ansi_autolink"))
+	options, _ := opaque.(*ansi_renderopt)
+	if len(link) == 0 {
+		return false
+	}
+	var text bytes.Buffer
+	ansi_escape(&text, bytes.TrimPrefix(link, []byte("mailto:")))
+	if typ == MKDA_EMAIL && !bytes.HasPrefix(link, []byte("mailto:")) {
+		link = append([]byte("mailto:"), link...)
+	}
+	ansi_link_text(ob, options, link, text.Bytes())
+	return true
+}
+
+func ansi_codespan(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("ansi_codespan"))
+	options, _ := opaque.(*ansi_renderopt)
+	var code bytes.Buffer
+	ansi_escape(&code, text)
+	ansi_style(ob, options, ansi_code, code.Bytes())
+	return true
+}
+
+func ansi_double_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("ansi_double_emphasis"))
+	if len(text) == 0 {
+		return false
+	}
+	ansi_style(ob, opaque.(*ansi_renderopt), ansi_bold, text)
+	return true
+}
+
+func ansi_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("ansi_emphasis"))
+	if len(text) == 0 {
+		return false
+	}
+	ansi_style(ob, opaque.(*ansi_renderopt), ansi_italic, text)
+	return true
+}
+
+func ansi_triple_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("ansi_triple_emphasis"))
+	options, _ := opaque.(*ansi_renderopt)
+	if len(text) == 0 {
+		return false
+	}
+	var italic bytes.Buffer
+	ansi_style(&italic, options, ansi_italic, text)
+	ansi_style(ob, options, ansi_bold, italic.Bytes())
+	return true
+}
+
+func ansi_strikethrough(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("ansi_strikethrough"))
+	if len(text) == 0 {
+		return false
+	}
+	ansi_style(ob, opaque.(*ansi_renderopt), ansi_strike, text)
+	return true
+}
+
+/* the alt text, linking to the image */
+func ansi_image(ob *bytes.Buffer, link []byte, title []byte, alt []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("ansi_image"))
+	options, _ := opaque.(*ansi_renderopt)
+	if len(link) == 0 {
+		return false
+	}
+	var text bytes.Buffer
+	ansi_escape(&text, alt)
+	ansi_link_text(ob, options, link, text.Bytes())
+	return true
+}
+
+func ansi_link(ob *bytes.Buffer, link []byte, title []byte, content []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("ansi_link"))
+	ansi_link_text(ob, opaque.(*ansi_renderopt), link, content)
+	return true
+}
+
+func ansi_emoji(ob *bytes.Buffer, name []byte, glyph []byte, image []byte, opaque interface{}) bool {
+	defer un(trace("ansi_emoji"))
+	if len(glyph) > 0 {
+		ansi_escape(ob, glyph)
+	} else {
+		ob.WriteByte(':')
+		ansi_escape(ob, name)
+		ob.WriteByte(':')
+	}
+	return true
+}
+
+func ansi_entity(ob *bytes.Buffer, entity []byte, opaque interface{}) {
+	defer un(trace("ansi_entity"))
+	ansi_escape(ob, []byte(html.UnescapeString(string(entity))))
+}
+
+func ansi_normal_text(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("ansi_normal_text"))
+	ansi_escape(ob, text)
+}
+
+/* replaces the continuation of a prefix by spaces, keeping the quote bars
+ * and the sequences styling them */
+func ansi_continuation(prefix []byte) []byte {
+	var rest bytes.Buffer
+	var pending []byte
+	bar := false
+	for i := 0; i < len(prefix); {
+		if prefix[i] == '\x1b' {
+			n := ansi_seq_len(prefix[i:])
+			if bar {
+				rest.Write(prefix[i : i+n])
+			} else {
+				pending = append(pending, prefix[i:i+n]...)
+			}
+			i += n
+			continue
+		}
+		r, size := utf8.DecodeRune(prefix[i:])
+		if bar = r == '│'; bar {
+			rest.Write(pending)
+			rest.WriteRune(r)
+		} else {
+			rest.WriteString(strings.Repeat(" ", rune_width(r)))
+		}
+		pending = pending[:0]
+		i += size
+	}
+	return rest.Bytes()
+}
+
+/* the styles and hyperlink open at the end of text, given those open at
+ * its start */
+func ansi_open_styles(open []string, text []byte) []string {
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\x1b' {
+			continue
+		}
+		n := ansi_seq_len(text[i:])
+		seq := string(text[i : i+n])
+		i += n - 1
+
+		var code string
+		switch {
+		case strings.HasPrefix(seq, "\x1b]8;;"):
+			/* a hyperlink is closed by one without url */
+			for j := len(open) - 1; j >= 0; j-- {
+				if strings.HasPrefix(open[j], "\x1b]8;;") {
+					open = append(open[:j], open[j+1:]...)
+					break
+				}
+			}
+			if seq != "\x1b]8;;\x1b\\" {
+				open = append(open, seq)
+			}
+			continue
+		case strings.HasPrefix(seq, "\x1b[") && strings.HasSuffix(seq, "m"):
+			code = seq[2 : len(seq)-1]
+		default:
+			continue
+		}
+
+		closes := false
+		for j := len(open) - 1; j >= 0; j-- {
+			if !strings.HasPrefix(open[j], "\x1b[") {
+				continue
+			}
+			on := open[j][2 : len(open[j])-1]
+			if ansi_off[on] == code || (code == "39" && ansi_off[on] == "") {
+				open = append(open[:j], open[j+1:]...)
+				closes = true
+				break
+			}
+		}
+		if !closes && code != "0" {
+			open = append(open, seq)
+		}
+	}
+	return open
+}
+
+/* wide characters a line may be broken around, without a space: those
+ * of Chinese and Japanese, but not Korean, which is written with spaces
+ * between the words */
+func ansi_breaks_around(r rune) bool {
+	if r >= 0xac00 && r <= 0xd7a3 || r >= 0x1100 && r <= 0x115f {
+		return false
+	}
+	return rune_width(r) == 2
+}
+
+/* splits running text into the pieces a line may be broken between: the
+ * words, and the wide characters within them. sep tells whether a piece
+ * follows a space */
+func ansi_pieces(text []byte) (pieces [][]byte, sep []bool) {
+	for _, word := range bytes.Split(text, []byte(" ")) {
+		if len(word) == 0 {
+			continue
+		}
+		start, space := 0, true
+		for i := 0; i < len(word); {
+			if word[i] == '\x1b' {
+				i += ansi_seq_len(word[i:])
+				continue
+			}
+			r, size := utf8.DecodeRune(word[i:])
+			if ansi_breaks_around(r) {
+				/* a break before and after the wide character */
+				if i > start {
+					pieces, sep = append(pieces, word[start:i]), append(sep, space)
+					start, space = i, false
+				}
+				end := i + size
+				for end < len(word) && word[end] == '\x1b' {
+					end += ansi_seq_len(word[end:])
+				}
+				pieces, sep = append(pieces, word[start:end]), append(sep, space)
+				start, space = end, false
+				i = end
+				continue
+			}
+			i += size
+		}
+		if start < len(word) {
+			pieces, sep = append(pieces, word[start:]), append(sep, space)
+		}
+	}
+	return pieces, sep
+}
+
+/* writes a marked line of running text, wrapped at width, closing the
+ * styles at each break and opening them again on the next line */
+func ansi_wrap_line(ob *bytes.Buffer, prefix []byte, text []byte, width int) {
+	ob.Write(prefix)
+	col := ansi_width(prefix)
+	first := true
+	var open []string
+	pieces, sep := ansi_pieces(text)
+	for i, piece := range pieces {
+		w := ansi_width(piece)
+		space := 0
+		if sep[i] {
+			space = 1
+		}
+		if !first && width > 0 && col+space+w > width {
+			if len(open) > 0 {
+				for _, seq := range open {
+					if strings.HasPrefix(seq, "\x1b]8;;") {
+						ob.WriteString("\x1b]8;;\x1b\\")
+					}
+				}
+				ob.WriteString("\x1b[0m")
+			}
+			ob.WriteByte('\n')
+			rest := ansi_continuation(prefix)
+			ob.Write(rest)
+			col = ansi_width(rest)
+			for _, seq := range open {
+				ob.WriteString(seq)
+			}
+			first = true
+		}
+		if !first && sep[i] {
+			ob.WriteByte(' ')
+			col++
+		}
+		ob.Write(piece)
+		col += w
+		first = false
+		open = ansi_open_styles(open, piece)
+	}
+	if first {
+		/* nothing but the prefix */
+		ob.Truncate(ob.Len() - len(prefix))
+		ob.Write(bytes.TrimRight(prefix, " "))
+	}
+	ob.WriteByte('\n')
+}
+
+/* wraps the running text */
+func ansi_finalize(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("ansi_finalize"))
+	options, _ := opaque.(*ansi_renderopt)
+
+	var out bytes.Buffer
+	for _, line := range bytes.Split(ob.Bytes(), []byte("\n")) {
+		if i := bytes.IndexByte(line, text_wrap); i >= 0 {
+			ansi_wrap_line(&out, line[:i], line[i+1:], options.width)
+		} else {
+			out.Write(line)
+			out.WriteByte('\n')
+		}
+	}
+
+	text := bytes.TrimRight(out.Bytes(), "\n")
+	ob.Reset()
+	if len(text) > 0 {
+		ob.Write(text)
+		ob.WriteByte('\n')
+	}
+}
+
+func ansi_renderer(options *AnsiOptions) *mkd_renderer {
+	renderer := &mkd_renderer{
+		ansi_blockcode,
+		ansi_blockquote,
+		text_raw_block,
+		ansi_header,
+		ansi_hrule,
+		ansi_list,
+		text_listitem,
+		ansi_paragraph,
+		ansi_table,
+		text_tablerow,
+		text_tablecell,
+		nil,
+		ansi_details,
+		ansi_directive,
+
+		ansi_autolink,
+		ansi_codespan,
+		ansi_double_emphasis,
+		ansi_emphasis,
+		ansi_image,
+		text_linebreak,
+		ansi_link,
+		text_raw_html,
+		ansi_triple_emphasis,
+		ansi_strikethrough,
+		ansi_emoji,
+
+		ansi_entity,
+		ansi_normal_text,
+
+		nil,
+		ansi_finalize,
+		nil,
+		nil}
+
+	renderer.opaque = &ansi_renderopt{flags: options.Flags, width: options.Width}
+	return renderer
+}
+
+func (opts *AnsiOptions) renderer() (*mkd_renderer, *Config) {
+	return ansi_renderer(opts), opts.Config
+}
+
+// MarkdownToAnsi renders the markdown document as text styled with ANSI
+// escape sequences, for a terminal. Callers decide about ANSI_NO_COLOR,
+// from the NO_COLOR environment variable or whether the output is a
+// terminal. A nil opts wraps nothing and uses colours.
+func MarkdownToAnsi(ib []byte, opts *AnsiOptions) []byte {
+	defer un(trace("MarkdownToAnsi"))
+	if opts == nil {
+		opts = &AnsiOptions{}
+	}
+	return ups_markdown(ansi_renderer(opts), ib, opts.Extensions, opts.Config)
+}
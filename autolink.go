@@ -0,0 +1,199 @@
+package markup
+
+import (
+	"bytes"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+ * Extended autolinks (MKDEXT_AUTOLINK), following the GFM rules: scheme
+ * urls, www. links and e-mail addresses found in plain text. The scanners
+ * below return the length of the link at the start of data, or 0.
+ */
+
+/* schemes of the urls that are linked without angle brackets */
+var autolink_schemes = []string{"http://", "https://", "ftp://"}
+
+/* an autolink starts a line or follows whitespace, one of *, _, ~, ( or
+ * a non-ASCII punctuation mark such as a full width parenthesis */
+func autolink_boundary(data []byte, offset int) bool {
+	r := rune_before(data, offset)
+	if r >= utf8.RuneSelf {
+		return isspace_rune(r) || unicode.IsPunct(r)
+	}
+	return isspace(byte(r)) || r == '*' || r == '_' || r == '~' || r == '('
+}
+
+/* length of the domain name at the start of data: letters and digits of
+ * any script, '-', '_' and '.' */
+func autolink_domain_len(data []byte) int {
+	end := 0
+	for end < len(data) {
+		if n := alnum_len(data, end); n > 0 {
+			end += n
+		} else if c := data[end]; c == '-' || c == '_' || c == '.' {
+			end++
+		} else {
+			break
+		}
+	}
+	return end
+}
+
+/* a domain is made of segments of alphanumerics, '-' and '_' separated by
+ * periods; there must be one period and no '_' in the last two segments */
+func autolink_domain(data []byte) int {
+	end := autolink_domain_len(data)
+	/* a final period is punctuation, not part of the domain */
+	for end > 0 && data[end-1] == '.' {
+		end--
+	}
+
+	segs := bytes.Split(data[:end], []byte("."))
+	if len(segs) < 2 {
+		return 0
+	}
+	for _, s := range segs {
+		if len(s) == 0 {
+			return 0
+		}
+	}
+	for _, s := range segs[len(segs)-2:] {
+		if bytes.IndexByte(s, '_') >= 0 {
+			return 0
+		}
+	}
+	return end
+}
+
+/* removes the trailing characters that end the sentence rather than the
+ * link: punctuation, entity references and unbalanced closing parens */
+func autolink_delim(data []byte, end int) int {
+	for end > 0 {
+		switch c := data[end-1]; c {
+		case '?', '!', '.', ',', ':', '*', '_', '~', '\'', '"':
+			end--
+
+		case ';':
+			/* &hl; at the end looks like an entity reference */
+			i := end - 2
+			for i >= 0 && isalnum(data[i]) {
+				i--
+			}
+			if i < 0 || data[i] != '&' || i == end-2 {
+				return end
+			}
+			end = i
+
+		case ')':
+			/* Only the closing parens without an opening one in the
+			 * link are left out:
+			 *
+			 *	foo http://www.pokemon.com/Pikachu_(Electric) bar
+			 *		=> http://www.pokemon.com/Pikachu_(Electric)
+			 *
+			 *	foo (http://www.pokemon.com/Pikachu_(Electric)) bar
+			 *		=> http://www.pokemon.com/Pikachu_(Electric)
+			 */
+			opening := bytes.Count(data[:end], []byte("("))
+			closing := bytes.Count(data[:end], []byte(")"))
+			if closing <= opening {
+				return end
+			}
+			end--
+
+		default:
+			return end
+		}
+	}
+	return end
+}
+
+/* domain followed by an optional path, up to whitespace, '<' or the
+ * punctuation of other scripts, like a full width parenthesis or an
+ * ideographic full stop, which follows the link without a space */
+func autolink_path(data []byte) int {
+	end := autolink_domain(data)
+	if end == 0 {
+		return 0
+	}
+	for end < len(data) && data[end] != '<' {
+		if c := data[end]; c < utf8.RuneSelf {
+			if isspace(c) {
+				break
+			}
+			end++
+			continue
+		}
+		r, n := utf8.DecodeRune(data[end:])
+		if isspace_rune(r) || unicode.IsPunct(r) {
+			break
+		}
+		end += n
+	}
+	return autolink_delim(data, end)
+}
+
+/* "www." link */
+func autolink_www(data []byte) int {
+	if !bytes.HasPrefix(data, []byte("www.")) {
+		return 0
+	}
+	return autolink_path(data)
+}
+
+/* "http://example.com/path" */
+func autolink_url(data []byte) int {
+	for _, s := range autolink_schemes {
+		if bytes.HasPrefix(data, []byte(s)) {
+			if end := autolink_path(data[len(s):]); end > 0 {
+				return len(s) + end
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+/* length of the local part of an address ending at data[end] */
+func autolink_local(data []byte, end int) int {
+	i := end
+	for i > 0 {
+		c := data[i-1]
+		if !isalnum(c) && c != '.' && c != '-' && c != '_' && c != '+' {
+			break
+		}
+		i--
+	}
+	return end - i
+}
+
+/* "user@example.com"; with xmpp a "/resource" may follow */
+func autolink_email(data []byte, xmpp bool) int {
+	at := bytes.IndexByte(data, '@')
+	if at <= 0 || autolink_local(data, at) != at {
+		return 0
+	}
+	end := at + 1 + autolink_domain_len(data[at+1:])
+	for end > at+1 && data[end-1] == '.' {
+		end--
+	}
+	/* an address can't end with '-' or '_' */
+	if c := data[end-1]; c == '-' || c == '_' {
+		return 0
+	}
+	if bytes.IndexByte(data[at+1:end], '.') < 0 || bytes.Contains(data[at+1:end], []byte("..")) {
+		return 0
+	}
+	if xmpp && end+1 < len(data) && data[end] == '/' && isalnum(data[end+1]) {
+		end++
+		for end < len(data) && (isalnum(data[end]) || data[end] == '@' || data[end] == '.') {
+			end++
+		}
+		for data[end-1] == '.' {
+			end--
+		}
+	}
+	return end
+}
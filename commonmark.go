@@ -0,0 +1,1935 @@
+package markup
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+ * CommonMark mode (MKDEXT_COMMONMARK)
+ *
+ * The default parser follows upskirt. With MKDEXT_COMMONMARK the document
+ * is read line by line the way the CommonMark spec describes it: the
+ * lines build a tree of blocks, block quotes and list items holding the
+ * others, the reference definitions are taken out of the paragraphs, and
+ * the tree is rendered through the callbacks once the whole document is
+ * known. Inline content follows the spec too, links and images being
+ * matched with a stack of brackets and emphasis with the delimiter runs.
+ *
+ * The block extensions (tables, includes, collapsible blocks and
+ * directives) still work; they start a block of their own, which is
+ * handed to their upskirt parser.
+ *
+ * testfiles/commonmark.json is the spec.json of the spec, whose examples
+ * all pass.
+ */
+
+/* the blocks of the tree */
+const (
+	CM_DOCUMENT = iota
+	CM_QUOTE
+	CM_LIST
+	CM_ITEM
+	CM_PARAGRAPH
+	CM_HEADER
+	CM_HRULE
+	CM_CODE
+	CM_HTML
+	CM_FOREIGN /* block of an extension, parsed by its upskirt parser */
+)
+
+type cm_block struct {
+	typ        int
+	parent     *cm_block
+	children   []*cm_block
+	open       bool
+	content    []byte
+	start_line int
+	end_line   int
+
+	level int        /* of a header */
+	attrs *mkd_attrs /* of an ATX header */
+
+	/* lists and list items */
+	ordered       bool
+	marker        byte /* bullet, or '.' or ')' after the number */
+	start         int
+	tight         bool
+	marker_offset int
+	padding       int
+
+	/* code blocks */
+	fenced       bool
+	fence_char   byte
+	fence_len    int
+	fence_offset int
+	info         []byte
+
+	html_type int
+
+	/* blocks of an extension: the parser and the lines left to take */
+	parse func(*bytes.Buffer, *render, []byte) int
+	lines int
+}
+
+/* state of the line being read */
+type cm_parser struct {
+	rndr         *render
+	doc          *cm_block
+	tip          *cm_block /* innermost open block */
+	oldtip       *cm_block
+	last_matched *cm_block
+	all_closed   bool
+
+	lines       [][]byte
+	line_number int
+	line        []byte
+
+	offset               int
+	column               int
+	next_nonspace        int
+	next_nonspace_column int
+	indent               int
+	indented             bool
+	blank                bool
+	partial_tab          bool /* a tab was consumed only in part */
+}
+
+func is_space_tab(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+func is_hex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+/* whether a block of type t may hold a block of type child */
+func cm_can_contain(t, child int) bool {
+	switch t {
+	case CM_DOCUMENT, CM_QUOTE, CM_ITEM:
+		return child != CM_ITEM
+	case CM_LIST:
+		return child == CM_ITEM
+	}
+	return false
+}
+
+func cm_accepts_lines(t int) bool {
+	return t == CM_PARAGRAPH || t == CM_CODE || t == CM_HTML
+}
+
+func (p *cm_parser) find_next_nonspace() {
+	i, cols := p.offset, p.column
+	for i < len(p.line) {
+		if p.line[i] == ' ' {
+			cols++
+		} else if p.line[i] == '\t' {
+			cols += 4 - cols%4
+		} else {
+			break
+		}
+		i++
+	}
+	p.blank = i == len(p.line)
+	p.next_nonspace = i
+	p.next_nonspace_column = cols
+	p.indent = cols - p.column
+	p.indented = p.indent >= 4
+}
+
+/* moves count characters, or count columns, forward */
+func (p *cm_parser) advance_offset(count int, columns bool) {
+	for count > 0 && p.offset < len(p.line) {
+		if p.line[p.offset] == '\t' {
+			to_tab := 4 - p.column%4
+			if columns {
+				p.partial_tab = to_tab > count
+				n := to_tab
+				if n > count {
+					n = count
+				}
+				p.column += n
+				if !p.partial_tab {
+					p.offset++
+				}
+				count -= n
+			} else {
+				p.partial_tab = false
+				p.column += to_tab
+				p.offset++
+				count--
+			}
+		} else {
+			p.partial_tab = false
+			p.offset++
+			p.column++
+			count--
+		}
+	}
+}
+
+func (p *cm_parser) advance_next_nonspace() {
+	p.offset = p.next_nonspace
+	p.column = p.next_nonspace_column
+	p.partial_tab = false
+}
+
+/* adds the rest of the line to the content of the tip */
+func (p *cm_parser) add_line() {
+	if p.partial_tab {
+		p.offset++
+		p.tip.content = append(p.tip.content, "    "[:4-p.column%4]...)
+	}
+	p.tip.content = append(p.tip.content, p.line[p.offset:]...)
+	p.tip.content = append(p.tip.content, '\n')
+}
+
+/* adds a block to the tip, closing the blocks that can't hold it */
+func (p *cm_parser) add_child(typ int) *cm_block {
+	for !cm_can_contain(p.tip.typ, typ) {
+		p.finalize(p.tip, p.line_number-1)
+	}
+	b := &cm_block{typ: typ, parent: p.tip, open: true, start_line: p.line_number}
+	p.tip.children = append(p.tip.children, b)
+	p.tip = b
+	return b
+}
+
+func (p *cm_parser) close_unmatched() {
+	if !p.all_closed {
+		for p.oldtip != p.last_matched {
+			parent := p.oldtip.parent
+			p.finalize(p.oldtip, p.line_number-1)
+			p.oldtip = parent
+		}
+		p.all_closed = true
+	}
+}
+
+/* takes the reference definitions at the start of a paragraph */
+func (p *cm_parser) take_refs(b *cm_block) bool {
+	found := false
+	for len(b.content) > 0 && b.content[0] == '[' {
+		n := cm_parse_ref(p.rndr, b.content)
+		if n == 0 {
+			break
+		}
+		b.content = b.content[n:]
+		found = true
+	}
+	return found
+}
+
+/* closes a block on the given line */
+func (p *cm_parser) finalize(b *cm_block, line int) {
+	b.open = false
+	b.end_line = line
+	switch b.typ {
+	case CM_PARAGRAPH:
+		p.take_refs(b)
+		if len(bytes.Trim(b.content, " \t\n")) == 0 {
+			/* nothing but reference definitions */
+			siblings := b.parent.children
+			for i := range siblings {
+				if siblings[i] == b {
+					b.parent.children = append(siblings[:i], siblings[i+1:]...)
+					break
+				}
+			}
+		}
+
+	case CM_CODE:
+		if b.fenced {
+			/* the first line is the info string */
+			nl := bytes.IndexByte(b.content, '\n')
+			b.info = cm_unescape(bytes.Trim(b.content[:nl], " \t"))
+			b.content = b.content[nl+1:]
+		} else {
+			/* without the blank lines at the end */
+			lines := bytes.SplitAfter(b.content, []byte("\n"))
+			n := len(lines)
+			for n > 0 && len(bytes.Trim(lines[n-1], " \t\n")) == 0 {
+				n--
+			}
+			b.content = bytes.Join(lines[:n], nil)
+			b.end_line = b.start_line + n - 1
+		}
+
+	case CM_ITEM:
+		if n := len(b.children); n > 0 {
+			b.end_line = b.children[n-1].end_line
+		} else {
+			b.end_line = b.start_line
+		}
+
+	case CM_LIST:
+		/* a list is loose when blank lines separate its items, or the
+		 * blocks directly in an item */
+		for i, item := range b.children {
+			if i+1 < len(b.children) && item.end_line+1 < b.children[i+1].start_line {
+				b.tight = false
+			}
+			for k := 0; k+1 < len(item.children); k++ {
+				if item.children[k].end_line+1 < item.children[k+1].start_line {
+					b.tight = false
+				}
+			}
+		}
+		if n := len(b.children); n > 0 {
+			b.end_line = b.children[n-1].end_line
+		}
+	}
+	p.tip = b.parent
+}
+
+/* whether the block goes on on the current line: 0 if it does, 1 if it
+ * doesn't, 2 if the line has been taken entirely */
+func (p *cm_parser) cont(b *cm_block) int {
+	line := p.line
+	switch b.typ {
+	case CM_QUOTE:
+		if p.indented || p.next_nonspace >= len(line) || line[p.next_nonspace] != '>' {
+			return 1
+		}
+		p.advance_next_nonspace()
+		p.advance_offset(1, false)
+		if p.offset < len(line) && is_space_tab(line[p.offset]) {
+			p.advance_offset(1, true)
+		}
+
+	case CM_ITEM:
+		if p.blank {
+			if len(b.children) == 0 {
+				/* a blank line after an empty item ends it */
+				return 1
+			}
+			p.advance_next_nonspace()
+		} else if p.indent >= b.marker_offset+b.padding {
+			p.advance_offset(b.marker_offset+b.padding, true)
+		} else {
+			return 1
+		}
+
+	case CM_HEADER, CM_HRULE:
+		return 1
+
+	case CM_CODE:
+		if b.fenced {
+			if p.indent <= 3 && cm_closing_fence(line[p.next_nonspace:], b.fence_char) >= b.fence_len {
+				p.finalize(b, p.line_number)
+				return 2
+			}
+			for i := b.fence_offset; i > 0 && p.offset < len(line) && is_space_tab(line[p.offset]); i-- {
+				p.advance_offset(1, true)
+			}
+		} else if p.indent >= 4 {
+			p.advance_offset(4, true)
+		} else if p.blank {
+			p.advance_next_nonspace()
+		} else {
+			return 1
+		}
+
+	case CM_HTML:
+		if p.blank && (b.html_type == 6 || b.html_type == 7) {
+			return 1
+		}
+
+	case CM_PARAGRAPH:
+		if p.blank {
+			return 1
+		}
+
+	case CM_FOREIGN:
+		if b.lines == 0 {
+			return 1
+		}
+		b.lines--
+		return 2
+	}
+	return 0
+}
+
+/* returns the length of a closing code fence of c, 0 if there is none */
+func cm_closing_fence(data []byte, c byte) int {
+	n := 0
+	for n < len(data) && data[n] == c {
+		n++
+	}
+	if n < 3 || len(bytes.Trim(data[n:], " \t")) > 0 {
+		return 0
+	}
+	return n
+}
+
+/* whether the line (from its first non-space character) is a thematic break */
+func is_hrule_cm(data []byte) bool {
+	if len(data) == 0 || (data[0] != '*' && data[0] != '-' && data[0] != '_') {
+		return false
+	}
+	n := 0
+	for _, c := range data {
+		if c == data[0] {
+			n++
+		} else if !is_space_tab(c) {
+			return false
+		}
+	}
+	return n >= 3
+}
+
+/* whether the line is a setext header underline */
+func is_setext_line(data []byte) bool {
+	n := 0
+	for n < len(data) && data[n] == data[0] {
+		n++
+	}
+	return len(bytes.Trim(data[n:], " \t")) == 0
+}
+
+/* tags that start an html block of type 6 */
+var cm_block_tags = map[string]bool{
+	"address": true, "article": true, "aside": true, "base": true,
+	"basefont": true, "blockquote": true, "body": true, "caption": true,
+	"center": true, "col": true, "colgroup": true, "dd": true,
+	"details": true, "dialog": true, "dir": true, "div": true, "dl": true,
+	"dt": true, "fieldset": true, "figcaption": true, "figure": true,
+	"footer": true, "form": true, "frame": true, "frameset": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"head": true, "header": true, "hr": true, "html": true, "iframe": true,
+	"legend": true, "li": true, "link": true, "main": true, "menu": true,
+	"menuitem": true, "nav": true, "noframes": true, "ol": true,
+	"optgroup": true, "option": true, "p": true, "param": true,
+	"search": true, "section": true, "summary": true, "table": true,
+	"tbody": true, "td": true, "tfoot": true, "th": true, "thead": true,
+	"title": true, "tr": true, "track": true, "ul": true,
+}
+
+const (
+	cm_tagname   = `[A-Za-z][A-Za-z0-9-]*`
+	cm_attribute = `(?:\s+[a-zA-Z_:][a-zA-Z0-9_.:-]*(?:\s*=\s*(?:[^"'=<>` + "`" + `\x00-\x20]+|'[^']*'|"[^"]*"))?)`
+	cm_opentag   = `<` + cm_tagname + cm_attribute + `*\s*/?>`
+	cm_closetag  = `</` + cm_tagname + `\s*>`
+)
+
+var (
+	cm_html_tag = regexp.MustCompile(`^(?:` + cm_opentag + `|` + cm_closetag +
+		`|<!-->|<!--->|<!--(?s:.*?)-->|<\?(?s:.*?)\?>|<![A-Za-z][^>]*>|<!\[CDATA\[(?s:.*?)\]\]>)`)
+	cm_html_block1_start = regexp.MustCompile(`(?i)^<(?:script|pre|textarea|style)(?:\s|>|$)`)
+	cm_html_block1_end   = regexp.MustCompile(`(?i)</(?:script|pre|textarea|style)>`)
+	cm_html_block7       = regexp.MustCompile(`^(?:` + cm_opentag + `|` + cm_closetag + `)[ \t]*$`)
+	cm_uri_autolink      = regexp.MustCompile(`^<[A-Za-z][A-Za-z0-9.+-]{1,31}:[^<>\x00-\x20]*>`)
+	cm_email_autolink    = regexp.MustCompile("^<[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*>")
+)
+
+/* returns the name of the tag at the start of data, if it is followed by
+ * the end of the line, a space or the end of the tag */
+func cm_tag_name(data []byte) string {
+	i := 1
+	if i < len(data) && data[i] == '/' {
+		i++
+	}
+	b := i
+	for i < len(data) && isalnum(data[i]) {
+		i++
+	}
+	if i == b || !isalpha(data[b]) {
+		return ""
+	}
+	if i < len(data) && !isspace(data[i]) && data[i] != '>' &&
+		!(data[i] == '/' && i+1 < len(data) && data[i+1] == '>') {
+		return ""
+	}
+	return strings.ToLower(string(data[b:i]))
+}
+
+/* whether the line starts an html block of the given type; block_tags
+ * are the changes of Config.BlockTags to the tags of type 6 */
+func cm_html_block_start(block_tags map[string]bool, data []byte, t int) bool {
+	switch t {
+	case 1:
+		return cm_html_block1_start.Match(data)
+	case 2:
+		return bytes.HasPrefix(data, []byte("<!--"))
+	case 3:
+		return bytes.HasPrefix(data, []byte("<?"))
+	case 4:
+		return len(data) > 2 && data[1] == '!' && isalpha(data[2])
+	case 5:
+		return bytes.HasPrefix(data, []byte("<![CDATA["))
+	case 6:
+		name := cm_tag_name(data)
+		if on, ok := block_tags[name]; ok {
+			return on
+		}
+		return cm_block_tags[name]
+	case 7:
+		switch cm_tag_name(data) {
+		case "script", "pre", "textarea", "style":
+			return false
+		}
+		return cm_html_block7.Match(data)
+	}
+	return false
+}
+
+/* whether the line ends an html block of the given type */
+func cm_html_block_end(t int, data []byte) bool {
+	switch t {
+	case 1:
+		return cm_html_block1_end.Match(data)
+	case 2:
+		return bytes.Contains(data, []byte("-->"))
+	case 3:
+		return bytes.Contains(data, []byte("?>"))
+	case 4:
+		return bytes.IndexByte(data, '>') >= 0
+	case 5:
+		return bytes.Contains(data, []byte("]]>"))
+	}
+	return false
+}
+
+/* parses a list marker at the current position, advancing over it and the
+ * spaces after it; returns the item, nil if there is no marker */
+func (p *cm_parser) list_marker(container *cm_block) *cm_block {
+	if p.indent >= 4 {
+		return nil
+	}
+	line := p.line
+	rest := line[p.next_nonspace:]
+	item := &cm_block{typ: CM_ITEM, marker_offset: p.indent, start: 1}
+	n := 0
+	if len(rest) > 0 && (rest[0] == '*' || rest[0] == '+' || rest[0] == '-') {
+		item.marker = rest[0]
+		n = 1
+	} else {
+		start := 0
+		for n < len(rest) && n < 9 && rest[n] >= '0' && rest[n] <= '9' {
+			start = start*10 + int(rest[n]-'0')
+			n++
+		}
+		/* only a list starting with 1 interrupts a paragraph */
+		if n == 0 || n >= len(rest) || (rest[n] != '.' && rest[n] != ')') ||
+			(container.typ == CM_PARAGRAPH && start != 1) {
+			return nil
+		}
+		item.ordered = true
+		item.start = start
+		item.marker = rest[n]
+		n++
+	}
+	if n < len(rest) && !is_space_tab(rest[n]) {
+		return nil
+	}
+	if container.typ == CM_PARAGRAPH && len(bytes.Trim(rest[n:], " \t")) == 0 {
+		return nil
+	}
+
+	p.advance_next_nonspace()
+	p.advance_offset(n, true)
+	col, offset := p.column, p.offset
+	for {
+		p.advance_offset(1, true)
+		if p.column-col >= 5 || p.offset >= len(line) || !is_space_tab(line[p.offset]) {
+			break
+		}
+	}
+	spaces := p.column - col
+	if spaces >= 5 || spaces < 1 || p.offset >= len(line) {
+		/* the content starts right after the marker and its space */
+		item.padding = n + 1
+		p.column, p.offset = col, offset
+		if p.offset < len(line) && is_space_tab(line[p.offset]) {
+			p.advance_offset(1, true)
+		}
+	} else {
+		item.padding = n + spaces
+	}
+	return item
+}
+
+/* looks for the start of a block; returns 0 if there is none, 1 for a
+ * container and 2 for a leaf, which takes the rest of the line */
+func (p *cm_parser) block_start(container *cm_block) int {
+	line := p.line
+	rest := line[p.next_nonspace:]
+	var c byte
+	if len(rest) > 0 {
+		c = rest[0]
+	}
+	maybe_lazy := !p.all_closed && !p.blank && p.tip.typ == CM_PARAGRAPH
+
+	if !p.indented {
+		switch c {
+		case '>':
+			p.advance_next_nonspace()
+			p.advance_offset(1, false)
+			if p.offset < len(line) && is_space_tab(line[p.offset]) {
+				p.advance_offset(1, true)
+			}
+			p.close_unmatched()
+			p.add_child(CM_QUOTE)
+			return 1
+
+		case '#':
+			level := 0
+			for level < len(rest) && rest[level] == '#' {
+				level++
+			}
+			if level <= 6 && (level == len(rest) || is_space_tab(rest[level])) {
+				p.advance_next_nonspace()
+				p.advance_offset(level, false)
+				p.close_unmatched()
+				b := p.add_child(CM_HEADER)
+				b.level = level
+				b.content, b.attrs = cm_atx_content(p.rndr, line[p.offset:])
+				p.advance_offset(len(line)-p.offset, false)
+				return 2
+			}
+
+		case '`', '~':
+			n := 0
+			for n < len(rest) && rest[n] == c {
+				n++
+			}
+			/* the info string of a backtick fence has no backticks */
+			if n >= 3 && (c == '~' || bytes.IndexByte(rest[n:], '`') < 0) {
+				p.close_unmatched()
+				b := p.add_child(CM_CODE)
+				b.fenced = true
+				b.fence_char = c
+				b.fence_len = n
+				b.fence_offset = p.indent
+				p.advance_next_nonspace()
+				p.advance_offset(n, false)
+				return 2
+			}
+
+		case '<':
+			for t := 1; t <= 7; t++ {
+				if t == 7 && (container.typ == CM_PARAGRAPH || maybe_lazy) {
+					break
+				}
+				if cm_html_block_start(p.rndr.cfg.BlockTags, rest, t) {
+					p.close_unmatched()
+					/* the spaces are part of the block */
+					b := p.add_child(CM_HTML)
+					b.html_type = t
+					return 2
+				}
+			}
+		}
+
+		if container.typ == CM_PARAGRAPH && (c == '=' || c == '-') && is_setext_line(rest) {
+			p.close_unmatched()
+			p.take_refs(container)
+			if len(container.content) > 0 {
+				container.typ = CM_HEADER
+				container.level = 1
+				if c == '-' {
+					container.level = 2
+				}
+				p.advance_offset(len(line)-p.offset, false)
+				return 2
+			}
+		}
+
+		if is_hrule_cm(rest) {
+			p.close_unmatched()
+			p.add_child(CM_HRULE)
+			p.advance_offset(len(line)-p.offset, false)
+			return 2
+		}
+
+		if container.typ != CM_PARAGRAPH && !maybe_lazy {
+			if b := p.foreign_start(container); b != nil {
+				p.advance_offset(len(line)-p.offset, false)
+				return 2
+			}
+		}
+	}
+
+	if !p.indented || container.typ == CM_LIST {
+		if item := p.list_marker(container); item != nil {
+			p.close_unmatched()
+			if p.tip.typ != CM_LIST || !p.tip.ordered == item.ordered || p.tip.marker != item.marker {
+				list := p.add_child(CM_LIST)
+				list.ordered = item.ordered
+				list.marker = item.marker
+				list.start = item.start
+				list.tight = true
+			}
+			b := p.add_child(CM_ITEM)
+			b.ordered = item.ordered
+			b.marker = item.marker
+			b.marker_offset = item.marker_offset
+			b.padding = item.padding
+			return 1
+		}
+	}
+
+	if p.indented && p.tip.typ != CM_PARAGRAPH && !p.blank {
+		p.advance_offset(4, true)
+		p.close_unmatched()
+		p.add_child(CM_CODE)
+		return 2
+	}
+	return 0
+}
+
+/* returns the content and the attributes of an ATX header, without the
+ * closing sequence */
+func cm_atx_content(rndr *render, data []byte) ([]byte, *mkd_attrs) {
+	end := len(data)
+	var attrs *mkd_attrs
+	if rndr.ext_flags&MKDEXT_ATTRIBUTES != 0 {
+		end, attrs = trailing_attrs(data, 0, end)
+	}
+	for end > 0 && is_space_tab(data[end-1]) {
+		end--
+	}
+
+	/* optional closing sequence, after a space */
+	e := end
+	for e > 0 && data[e-1] == '#' {
+		e--
+	}
+	if e < end && (e == 0 || is_space_tab(data[e-1])) {
+		end = e
+	}
+
+	if attrs == nil && rndr.ext_flags&MKDEXT_ATTRIBUTES != 0 {
+		end, attrs = trailing_attrs(data, 0, end)
+	}
+	return append([]byte(nil), bytes.Trim(data[:end], " \t")...), attrs
+}
+
+/* starts the block of an extension on the current line, if there is one */
+func (p *cm_parser) foreign_start(container *cm_block) *cm_block {
+	rndr := p.rndr
+	rest := p.line[p.next_nonspace:]
+	var parse func(*bytes.Buffer, *render, []byte) int
+	var more func([]byte) bool
+	switch {
+	case rndr.ext_flags&MKDEXT_TABLES != 0 && bytes.IndexByte(rest, '|') >= 0:
+		parse = parse_table
+		more = func(line []byte) bool { return bytes.IndexByte(line, '|') >= 0 }
+	case rndr.ext_flags&MKDEXT_INCLUDE != 0 && bytes.HasPrefix(rest, []byte("{{")):
+		parse = parse_include
+		more = func(line []byte) bool { return false }
+	case rndr.ext_flags&(MKDEXT_DETAILS|MKDEXT_DIRECTIVES) != 0 && is_container_start(rndr, rest):
+		parse = parse_container
+		more = func(line []byte) bool { return true }
+	default:
+		return nil
+	}
+
+	text := p.gather(container, rest, more)
+	n := cm_dry_run(rndr, parse, text)
+	if n == 0 {
+		return nil
+	}
+	lines := bytes.Count(text[:n], []byte("\n"))
+	if text[n-1] != '\n' {
+		lines++
+	}
+
+	p.close_unmatched()
+	b := p.add_child(CM_FOREIGN)
+	b.parse = parse
+	b.content = text[:n]
+	b.lines = lines - 1
+	return b
+}
+
+/* collects the text of a block starting with first, adding the following
+ * lines while the containers go on and more accepts them */
+func (p *cm_parser) gather(container *cm_block, first []byte, more func([]byte) bool) []byte {
+	var path []*cm_block
+	for b := container; b.typ != CM_DOCUMENT; b = b.parent {
+		path = append([]*cm_block{b}, path...)
+	}
+
+	text := append(append([]byte(nil), first...), '\n')
+	for n := p.line_number + 1; n < len(p.lines); n++ {
+		q := *p
+		q.line = p.lines[n]
+		q.offset, q.column, q.partial_tab = 0, 0, false
+		for _, b := range path {
+			q.find_next_nonspace()
+			if q.cont(b) != 0 {
+				return text
+			}
+		}
+		line := q.line[q.offset:]
+		if q.partial_tab {
+			line = append([]byte("    "[:4-q.column%4]), q.line[q.offset+1:]...)
+		}
+		if !more(line) {
+			break
+		}
+		text = append(append(text, line...), '\n')
+	}
+	return text
+}
+
+/* returns the length parse takes of data, without rendering anything */
+func cm_dry_run(rndr *render, parse func(*bytes.Buffer, *render, []byte) int, data []byte) int {
+	dry := *rndr
+	dry.make = &mkd_renderer{}
+	dry.active_char = [256]byte{}
+	dry.nesting = rndr.max_nesting + 1
+	cfg := *rndr.cfg
+	cfg.Directives = nil
+	dry.cfg = &cfg
+	var ob bytes.Buffer
+	return parse(&ob, &dry, data)
+}
+
+/* reads a line into the tree */
+func (p *cm_parser) incorporate(line []byte) {
+	container := p.doc
+	p.oldtip = p.tip
+	p.offset, p.column = 0, 0
+	p.blank = false
+	p.partial_tab = false
+	p.line = line
+
+	/* the open blocks the line continues */
+	for {
+		n := len(container.children)
+		if n == 0 || !container.children[n-1].open {
+			break
+		}
+		container = container.children[n-1]
+		p.find_next_nonspace()
+		r := p.cont(container)
+		if r == 2 {
+			return
+		}
+		if r == 1 {
+			container = container.parent
+			break
+		}
+	}
+
+	p.all_closed = container == p.oldtip
+	p.last_matched = container
+
+	/* the blocks it starts */
+	leaf := container.typ != CM_PARAGRAPH && cm_accepts_lines(container.typ)
+	for !leaf {
+		p.find_next_nonspace()
+		r := p.block_start(container)
+		if r == 0 {
+			p.advance_next_nonspace()
+			break
+		}
+		container = p.tip
+		leaf = r == 2
+	}
+
+	/* the rest is text */
+	if !p.all_closed && !p.blank && p.tip.typ == CM_PARAGRAPH {
+		/* lazy continuation of a paragraph */
+		p.add_line()
+		return
+	}
+	p.close_unmatched()
+	if cm_accepts_lines(container.typ) {
+		p.add_line()
+		if container.typ == CM_HTML && container.html_type <= 5 &&
+			cm_html_block_end(container.html_type, line[p.offset:]) {
+			p.finalize(container, p.line_number)
+		}
+	} else if p.offset < len(line) && !p.blank {
+		p.add_child(CM_PARAGRAPH)
+		p.advance_next_nonspace()
+		p.add_line()
+	}
+}
+
+/* parses the blocks of data following the CommonMark spec */
+func parse_block_cm(ob *bytes.Buffer, rndr *render, data []byte) {
+	p := cm_parser{rndr: rndr}
+	p.doc = &cm_block{typ: CM_DOCUMENT, open: true}
+	p.tip = p.doc
+	p.lines = bytes.Split(data, []byte("\n"))
+	if n := len(p.lines); n > 0 && len(p.lines[n-1]) == 0 {
+		p.lines = p.lines[:n-1]
+	}
+	for p.line_number = 0; p.line_number < len(p.lines); p.line_number++ {
+		p.incorporate(p.lines[p.line_number])
+	}
+	for p.tip != nil {
+		p.finalize(p.tip, len(p.lines)-1)
+	}
+
+	for _, b := range p.doc.children {
+		cm_render(ob, rndr, b, false)
+	}
+}
+
+/* first pass of CommonMark: the references are read with the blocks, so
+ * only the line endings are normalized */
+func first_pass_cm(ib []byte) []byte {
+	var text bytes.Buffer
+	for i := 0; i < len(ib); i++ {
+		switch c := ib[i]; c {
+		case '\r':
+			text.WriteByte('\n')
+			if i+1 < len(ib) && ib[i+1] == '\n' {
+				i++
+			}
+		case 0:
+			text.WriteString("�")
+		default:
+			text.WriteByte(c)
+		}
+	}
+	ensure_ends_with_nl(&text)
+	return text.Bytes()
+}
+
+/***************
+ * RENDERING *
+ ***************/
+
+/* renders a block of the tree; the paragraphs of tight list items are
+ * rendered without the paragraph */
+func cm_render(ob *bytes.Buffer, rndr *render, b *cm_block, tight bool) {
+	defer un(trace("cm_render"))
+	rndr.raw_link = 0
+	switch b.typ {
+	case CM_PARAGRAPH:
+		cm_render_paragraph(ob, rndr, bytes.Trim(b.content, " \t\n"), tight)
+
+	case CM_HEADER:
+		data, attrs := bytes.Trim(b.content, " \t\n"), b.attrs
+		if attrs == nil && rndr.ext_flags&MKDEXT_ATTRIBUTES != 0 {
+			var e int
+			if e, attrs = trailing_attrs(data, 0, len(data)); attrs != nil {
+				data = bytes.TrimRight(data[:e], " \t")
+			}
+		}
+		var work bytes.Buffer
+		parse_inline(&work, rndr, data)
+		if rndr.make.header != nil {
+			rndr.make.header(ob, work.Bytes(), b.level, attrs, rndr.make.opaque)
+		}
+
+	case CM_HRULE:
+		if rndr.make.hrule != nil {
+			rndr.make.hrule(ob, rndr.make.opaque)
+		}
+
+	case CM_CODE:
+		var lang []byte
+		var attrs *mkd_attrs
+		text := b.content
+		if b.fenced {
+			lang, attrs = cm_code_info(rndr, b.info)
+			var work bytes.Buffer
+			work.Write(text)
+			include_code(rndr, attrs, &work)
+			text = work.Bytes()
+		}
+		if rndr.make.blockcode != nil {
+			rndr.make.blockcode(ob, text, lang, attrs, rndr.make.opaque)
+		}
+
+	case CM_HTML:
+		if rndr.make.blockhtml != nil {
+			rndr.make.blockhtml(ob, b.content, rndr.make.opaque)
+		}
+
+	case CM_FOREIGN:
+		b.parse(ob, rndr, b.content)
+
+	case CM_QUOTE:
+		if rndr.nesting > rndr.max_nesting {
+			return
+		}
+		rndr.nesting++
+		var work bytes.Buffer
+		for _, c := range b.children {
+			cm_render(&work, rndr, c, false)
+		}
+		rndr.nesting--
+		if rndr.make.blockquote != nil {
+			rndr.make.blockquote(ob, work.Bytes(), rndr.make.opaque)
+		}
+
+	case CM_LIST:
+		if rndr.nesting > rndr.max_nesting {
+			return
+		}
+		rndr.nesting++
+		flags := 0
+		if b.ordered {
+			flags = MKD_LIST_ORDERED
+		}
+		var items bytes.Buffer
+		for _, item := range b.children {
+			var work bytes.Buffer
+			for _, c := range item.children {
+				cm_render(&work, rndr, c, b.tight)
+			}
+			item_flags := flags
+			if !b.tight {
+				item_flags |= MKD_LI_BLOCK
+			}
+			if rndr.make.listitem != nil {
+				rndr.make.listitem(&items, work.Bytes(), item_flags, rndr.make.opaque)
+			}
+		}
+		rndr.nesting--
+		if rndr.make.list != nil {
+			rndr.make.list(ob, items.Bytes(), flags, b.start, rndr.make.opaque)
+		}
+	}
+}
+
+func cm_render_paragraph(ob *bytes.Buffer, rndr *render, data []byte, tight bool) {
+	if tight {
+		parse_inline(ob, rndr, data)
+		return
+	}
+
+	/* kramdown style {: #id .class} on the last line of the paragraph */
+	var attrs *mkd_attrs
+	if rndr.ext_flags&MKDEXT_ATTRIBUTES != 0 {
+		last := bytes.LastIndex(data, []byte("\n")) + 1
+		if last > 0 && len(data)-last > 2 && data[last] == '{' && data[last+1] == ':' {
+			if e, a := trailing_attrs(data, last, len(data)); a != nil && e == last {
+				attrs = a
+				data = bytes.TrimRight(data[:last], " \t\n")
+			}
+		}
+	}
+
+	if rndr.make.figure != nil && parse_figure(ob, rndr, data, attrs) {
+		return
+	}
+
+	var work bytes.Buffer
+	parse_inline(&work, rndr, data)
+	if rndr.make.paragraph != nil {
+		rndr.make.paragraph(ob, work.Bytes(), attrs, rndr.make.opaque)
+	}
+}
+
+/* splits the info string of a code fence into the language and the
+ * attributes, as is_codefence does */
+func cm_code_info(rndr *render, info []byte) ([]byte, *mkd_attrs) {
+	var a mkd_attrs
+	ial := rndr.ext_flags&MKDEXT_ATTRIBUTES != 0
+	if ial && len(info) > 0 && info[0] == '{' {
+		if parse_attrs(info, &a) > 0 {
+			return nil, &a
+		}
+	}
+	i := 0
+	for i < len(info) && !isspace(info[i]) {
+		i++
+	}
+	lang, rest := info[:i], bytes.TrimSpace(info[i:])
+	if len(rest) == 0 {
+		return lang, nil
+	}
+	if ial && rest[0] == '{' {
+		if parse_attrs(rest, &a) > 0 {
+			return lang, &a
+		}
+	} else if parse_attr_items(rest, &a, true) {
+		return lang, &a
+	}
+	return lang, nil
+}
+
+/*****************
+ * INLINE CONTENT *
+ *****************/
+
+/* characters starting an inline construct of the spec */
+func is_cm_special(c byte) bool {
+	switch c {
+	case '\\', '&', '`', '*', '_', '[', ']', '!', '<', '\n':
+		return true
+	}
+	return false
+}
+
+/* a piece of inline output waiting for the links and the emphasis */
+type cm_inline struct {
+	text      []byte /* rendered output, for plain pieces */
+	delim     byte   /* '*' or '_' for delimiter runs, 0 otherwise */
+	length    int    /* original length of the run */
+	count     int    /* delimiters still unmatched */
+	can_open  bool
+	can_close bool
+
+	/* '[' or '!' for the opening bracket of a link or an image */
+	bracket       byte
+	active        bool
+	bracket_after bool /* another bracket follows in the link text */
+	src           int  /* start of the link text */
+	raw_link      int  /* rndr.raw_link at the bracket */
+}
+
+/* left and right flanking rules of a delimiter run */
+func cm_flanking(data []byte, beg, end int) (left, right bool) {
+	before := rune_before(data, beg)
+	after := rune_at(data, end)
+	left = !isspace_rune(after) &&
+		(!ispunct_rune(after) || isspace_rune(before) || ispunct_rune(before))
+	right = !isspace_rune(before) &&
+		(!ispunct_rune(before) || isspace_rune(after) || ispunct_rune(after))
+
+	if data[beg] == '_' {
+		/* '_' does not work inside words */
+		open := left && (!right || ispunct_rune(before))
+		close := right && (!left || ispunct_rune(after))
+		return open, close
+	}
+	return left, right
+}
+
+/* inline content being parsed: the pieces and the open brackets */
+type cm_inlines struct {
+	rndr     *render
+	data     []byte
+	pieces   []*cm_inline
+	brackets []*cm_inline
+	cur      bytes.Buffer
+}
+
+func (in *cm_inlines) flush() {
+	if in.cur.Len() > 0 {
+		in.pieces = append(in.pieces, &cm_inline{text: append([]byte(nil), in.cur.Bytes()...)})
+		in.cur.Reset()
+	}
+}
+
+func (in *cm_inlines) text(ob *bytes.Buffer, text []byte) {
+	if in.rndr.make.normal_text != nil {
+		in.rndr.make.normal_text(ob, text, in.rndr.make.opaque)
+	} else {
+		ob.Write(text)
+	}
+}
+
+/* renders the inline content, collecting the brackets and the delimiter
+ * runs and matching them once the whole span is known */
+func parse_inline_cm(ob *bytes.Buffer, rndr *render, data []byte) {
+	in := cm_inlines{rndr: rndr, data: data}
+	size := len(data)
+	i := 0
+	for i < size {
+		end := i
+		for end < size && !is_cm_special(data[end]) && char_action(rndr, data, end) == 0 {
+			end++
+		}
+
+		/* spaces at the end of a line are dropped, two of them or more
+		 * making a hard break */
+		text := data[i:end]
+		spaces := 0
+		if end < size && data[end] == '\n' {
+			for spaces < len(text) && text[len(text)-1-spaces] == ' ' {
+				spaces++
+			}
+			text = text[:len(text)-spaces]
+		}
+		in.text(&in.cur, text)
+		if end >= size {
+			break
+		}
+		i = end
+
+		n := 0
+		switch c := data[i]; {
+		case c == '\n':
+			n = in.line_end(i, spaces >= 2, data[i-spaces:i+1])
+		case c == '\\':
+			n = in.escape(i)
+		case c == '&':
+			n = in.entity(i)
+		case c == '`':
+			n = in.codespan(i)
+		case (c == '*' || c == '_') && rndr.active_char[c] == MD_CHAR_EMPHASIS:
+			n = in.delim_run(i)
+		case c == '[':
+			n = in.open_bracket(i)
+		case c == '!':
+			if i+1 < size && data[i+1] == '[' && rndr.make.image != nil {
+				n = in.push_bracket(i, '!')
+			}
+		case c == ']':
+			n = in.close_bracket(i)
+		case c == '<':
+			n = cm_langle(&in.cur, rndr, data, i)
+		default:
+			n = in.trigger(i)
+		}
+		if n == 0 {
+			in.text(&in.cur, data[i:i+1])
+			n = 1
+		}
+		i += n
+	}
+	in.flush()
+
+	pieces := process_emphasis(rndr, in.pieces)
+	for _, p := range pieces {
+		write_cm_inline(ob, rndr, p)
+	}
+}
+
+/* a line ending: a hard break or a soft one, which skips the spaces at the
+ * start of the next line */
+func (in *cm_inlines) line_end(i int, hard bool, src []byte) int {
+	rndr := in.rndr
+	j := i + 1
+	for j < len(in.data) && in.data[j] == ' ' {
+		j++
+	}
+	if hard && rndr.make.linebreak != nil {
+		if rndr.make.linebreak(&in.cur, src, rndr.make.opaque) {
+			return j - i
+		}
+	}
+	in.text(&in.cur, []byte("\n"))
+	return j - i
+}
+
+func (in *cm_inlines) escape(i int) int {
+	data := in.data
+	if i+1 >= len(data) {
+		return 0
+	}
+	if data[i+1] == '\n' {
+		/* backslash hard line break */
+		return 1 + in.line_end(i+1, true, data[i:i+2])
+	}
+	if !ispunct(data[i+1]) {
+		return 0
+	}
+	set_source(in.rndr, mkd_source{text: data[i : i+2]})
+	in.text(&in.cur, data[i+1:i+2])
+	set_source(in.rndr, mkd_source{})
+	return 2
+}
+
+func (in *cm_inlines) entity(i int) int {
+	rndr := in.rndr
+	n := cm_entity_len(in.data[i:])
+	if n == 0 {
+		return 0
+	}
+	if rndr.make.entity != nil {
+		rndr.make.entity(&in.cur, in.data[i:i+n], rndr.make.opaque)
+	} else {
+		in.text(&in.cur, []byte(html.UnescapeString(string(in.data[i:i+n]))))
+	}
+	return n
+}
+
+/* code span: the closing run must be as long as the opening one, line
+ * endings become spaces and a single space is stripped on both sides */
+func (in *cm_inlines) codespan(i int) int {
+	rndr := in.rndr
+	data := in.data[i:]
+	size := len(data)
+	nb := 0
+	for nb < size && data[nb] == '`' {
+		nb++
+	}
+
+	/* looking for a backtick run of the same length */
+	end := nb
+	beg := -1
+	for end < size {
+		if data[end] != '`' {
+			end++
+			continue
+		}
+		run := end
+		for end < size && data[end] == '`' {
+			end++
+		}
+		if end-run == nb {
+			beg = run
+			break
+		}
+	}
+
+	if beg < 0 || rndr.make.codespan == nil {
+		/* no match: the opening run is literal text */
+		in.text(&in.cur, data[:nb])
+		return nb
+	}
+
+	code := bytes.Replace(data[nb:beg], []byte("\n"), []byte(" "), -1)
+	if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' &&
+		len(bytes.Trim(code, " ")) > 0 {
+		code = code[1 : len(code)-1]
+	}
+
+	set_source(rndr, mkd_source{text: data[:end]})
+	defer set_source(rndr, mkd_source{})
+	if !rndr.make.codespan(&in.cur, code, rndr.make.opaque) {
+		in.text(&in.cur, data[:end])
+	}
+	return end
+}
+
+func (in *cm_inlines) delim_run(i int) int {
+	data := in.data
+	c := data[i]
+	j := i
+	for j < len(data) && data[j] == c {
+		j++
+	}
+	left, right := cm_flanking(data, i, j)
+	in.flush()
+	in.pieces = append(in.pieces, &cm_inline{
+		delim:     c,
+		length:    j - i,
+		count:     j - i,
+		can_open:  left,
+		can_close: right})
+	return j - i
+}
+
+func (in *cm_inlines) open_bracket(i int) int {
+	rndr := in.rndr
+	data := in.data
+	if rndr.make.link == nil {
+		return 0
+	}
+	if rndr.ext_flags&MKDEXT_WIKI_LINKS != 0 && i+1 < len(data) && data[i+1] == '[' {
+		active := in.in_link()
+		rndr.in_link += active
+		n := char_wikilink(&in.cur, rndr, data[i:])
+		rndr.in_link -= active
+		if n > 0 {
+			return n
+		}
+	}
+	return in.push_bracket(i, '[')
+}
+
+/* adds the opening bracket of a link, or of an image with '!' */
+func (in *cm_inlines) push_bracket(i int, bracket byte) int {
+	n := 1
+	if bracket == '!' {
+		n = 2
+	}
+	in.flush()
+	in.text(&in.cur, in.data[i:i+n])
+	if len(in.brackets) > 0 {
+		in.brackets[len(in.brackets)-1].bracket_after = true
+	}
+	b := &cm_inline{
+		text:     append([]byte(nil), in.cur.Bytes()...),
+		bracket:  bracket,
+		active:   true,
+		src:      i + n,
+		raw_link: in.rndr.raw_link}
+	in.cur.Reset()
+	in.pieces = append(in.pieces, b)
+	in.brackets = append(in.brackets, b)
+	return n
+}
+
+/* ']': closes the last bracket into a link or an image when it is
+ * followed by a destination or names a reference */
+func (in *cm_inlines) close_bracket(i int) int {
+	rndr := in.rndr
+	data := in.data
+	size := len(data)
+	if len(in.brackets) == 0 {
+		return 0
+	}
+	opener := in.brackets[len(in.brackets)-1]
+	in.brackets = in.brackets[:len(in.brackets)-1]
+	if !opener.active {
+		return 0
+	}
+
+	label := data[opener.src:i]
+	end := i + 1
+	var dest_src, title_src, dest, title, ref []byte
+	var quote byte
+	matched := false
+
+	/* inline link */
+	if end < size && data[end] == '(' {
+		if d, t, q, e := cm_inline_link(data, end); e > 0 {
+			dest_src, title_src, quote = d, t, q
+			dest, title = cm_unescape(d), cm_unescape(t)
+			end = e
+			matched = true
+		}
+	}
+
+	/* reference link: full, collapsed or shortcut */
+	if !matched {
+		var id []byte
+		n := cm_link_label(data, end)
+		if n > 2 {
+			id = data[end+1 : end+n-1]
+		} else if !opener.bracket_after {
+			id = label
+		}
+		if id != nil && len(id) <= 999 {
+			if lr, ok := rndr.refs[cm_ref_key(id)]; ok {
+				dest, title, ref = lr.link, lr.title, id
+				dest_src, title_src = dest, title
+				matched = true
+				if n > 0 {
+					end += n
+				}
+			}
+		}
+	}
+	if !matched {
+		return 0
+	}
+
+	/* optional attribute list right after the link */
+	var attrs *mkd_attrs
+	if rndr.ext_flags&MKDEXT_ATTRIBUTES != 0 && end < size && data[end] == '{' {
+		var a mkd_attrs
+		if n := parse_attrs(data[end:], &a); n > 0 {
+			attrs = &a
+			end += n
+		}
+	}
+
+	/* the link text is parsed again, on its own */
+	is_img := opener.bracket == '!'
+	raw_link := rndr.raw_link
+	rndr.raw_link = opener.raw_link
+	var content, out bytes.Buffer
+	rndr.in_link++
+	if is_img && rndr.make.source != nil {
+		/* the formatter writes the alt text back as it was */
+		content.Write(label)
+	} else if is_img {
+		cm_plain_text(&content, rndr, label)
+	} else {
+		parse_inline(&content, rndr, label)
+	}
+	rndr.in_link--
+
+	set_source(rndr, mkd_source{link: dest_src, title: title_src, ref: ref, delim: quote})
+	ok := false
+	if is_img {
+		if rndr.figure != nil {
+			rndr.figure.title = title
+			rndr.figure.alt = content.Bytes()
+		}
+		ok = rndr.make.image(&out, dest, title, content.Bytes(), attrs, rndr.make.opaque)
+	} else {
+		ok = rndr.make.link(&out, dest, title, content.Bytes(), attrs, rndr.make.opaque)
+	}
+	set_source(rndr, mkd_source{})
+	if !ok {
+		rndr.raw_link = raw_link
+		return 0
+	}
+
+	/* the link replaces its text */
+	in.flush()
+	for k := len(in.pieces) - 1; k >= 0; k-- {
+		if in.pieces[k] == opener {
+			in.pieces = in.pieces[:k]
+			break
+		}
+	}
+	in.pieces = append(in.pieces, &cm_inline{text: out.Bytes()})
+
+	/* no links in links */
+	if !is_img {
+		for _, b := range in.brackets {
+			if b.bracket == '[' {
+				b.active = false
+			}
+		}
+	}
+	return end - i
+}
+
+/* any other active character: the triggers of the extensions, which don't
+ * link the text of a link being read */
+func (in *cm_inlines) trigger(i int) int {
+	rndr := in.rndr
+	action := rndr.active_char[in.data[i]]
+	if action == 0 || action == MD_CHAR_LINEBREAK {
+		return 0
+	}
+	active := in.in_link()
+	rndr.in_link += active
+	n := markdown_char_ptrs[action](&in.cur, rndr, in.data, i)
+	rndr.in_link -= active
+	return n
+}
+
+/* 1 inside the text of what may be a link, else 0 */
+func (in *cm_inlines) in_link() int {
+	for _, b := range in.brackets {
+		if b.active {
+			return 1
+		}
+	}
+	return 0
+}
+
+/* '<': an autolink or raw html */
+func cm_langle(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	data = data[offset:]
+	if rndr.make.autolink != nil {
+		typ := MKDA_NORMAL
+		m := cm_uri_autolink.Find(data)
+		if m == nil {
+			typ = MKDA_EMAIL
+			m = cm_email_autolink.Find(data)
+		}
+		if m != nil {
+			set_source(rndr, mkd_source{text: m})
+			ok := rndr.make.autolink(ob, m[1:len(m)-1], typ, rndr.make.opaque)
+			set_source(rndr, mkd_source{})
+			if ok {
+				return len(m)
+			}
+		}
+	}
+
+	m := cm_html_tag.Find(data)
+	if m == nil || rndr.make.raw_html_tag == nil || !rndr.make.raw_html_tag(ob, m, rndr.make.opaque) {
+		return 0
+	}
+	if is_html_tag(m, "a") || is_html_tag(m, "A") {
+		/* the text of a raw anchor is not linked again */
+		if m[1] == '/' {
+			if rndr.raw_link > 0 {
+				rndr.raw_link--
+			}
+		} else if m[len(m)-2] != '/' {
+			rndr.raw_link++
+		}
+	}
+	return len(m)
+}
+
+/* renders the text of an image alt, without any markup */
+func cm_plain_text(ob *bytes.Buffer, rndr *render, data []byte) {
+	plain := *rndr
+	plain.make = &cm_plain
+	parse_inline(ob, &plain, data)
+}
+
+var cm_plain = mkd_renderer{
+	autolink: func(ob *bytes.Buffer, link []byte, typ int, opaque interface{}) bool {
+		ob.Write(link)
+		return true
+	},
+	codespan: func(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+		ob.Write(text)
+		return true
+	},
+	double_emphasis: cm_plain_span,
+	emphasis:        cm_plain_span,
+	triple_emphasis: cm_plain_span,
+	strikethrough:   cm_plain_span,
+	image: func(ob *bytes.Buffer, link, title, alt []byte, attrs *mkd_attrs, opaque interface{}) bool {
+		ob.Write(alt)
+		return true
+	},
+	link: func(ob *bytes.Buffer, link, title, content []byte, attrs *mkd_attrs, opaque interface{}) bool {
+		ob.Write(content)
+		return true
+	},
+	linebreak: func(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+		ob.WriteByte('\n')
+		return true
+	},
+	raw_html_tag: func(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+		ob.Write(text)
+		return true
+	},
+	emoji: func(ob *bytes.Buffer, name, glyph, image []byte, opaque interface{}) bool {
+		if len(glyph) == 0 {
+			return false
+		}
+		ob.Write(glyph)
+		return true
+	},
+}
+
+func cm_plain_span(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	ob.Write(text)
+	return true
+}
+
+/* skips spaces and tabs, with up to one line ending */
+func cm_spnl(data []byte, i int) int {
+	for i < len(data) && is_space_tab(data[i]) {
+		i++
+	}
+	if i < len(data) && data[i] == '\n' {
+		i++
+		for i < len(data) && is_space_tab(data[i]) {
+			i++
+		}
+	}
+	return i
+}
+
+/* parses a link destination at data[i:]; returns it (without the angle
+ * brackets) and the offset after it, -1 if there is none */
+func cm_link_dest(data []byte, i int) ([]byte, int) {
+	size := len(data)
+	if i < size && data[i] == '<' {
+		for j := i + 1; j < size; j++ {
+			switch data[j] {
+			case '\\':
+				if j+1 < size && data[j+1] != '\n' {
+					j++
+				}
+			case '\n', '<':
+				return nil, -1
+			case '>':
+				return data[i+1 : j], j + 1
+			}
+		}
+		return nil, -1
+	}
+
+	j, depth := i, 0
+	for j < size {
+		c := data[j]
+		if c == '\\' && j+1 < size && ispunct(data[j+1]) {
+			j += 2
+			continue
+		}
+		if c == '(' {
+			depth++
+		} else if c == ')' {
+			if depth == 0 {
+				break
+			}
+			depth--
+		} else if c <= ' ' || c == 0x7f {
+			break
+		}
+		j++
+	}
+	if (j == i && (j >= size || data[j] != ')')) || depth != 0 {
+		return nil, -1
+	}
+	return data[i:j], j
+}
+
+/* parses a link title at data[i:]; returns it without the quotes and the
+ * offset after it, -1 if there is none */
+func cm_link_title(data []byte, i int) ([]byte, int) {
+	if i >= len(data) {
+		return nil, -1
+	}
+	open, close := data[i], data[i]
+	if open == '(' {
+		close = ')'
+	} else if open != '"' && open != '\'' {
+		return nil, -1
+	}
+	for j := i + 1; j < len(data); j++ {
+		switch c := data[j]; {
+		case c == '\\' && j+1 < len(data):
+			j++
+		case c == close:
+			return data[i+1 : j], j + 1
+		case c == '(' && open == '(':
+			return nil, -1
+		}
+	}
+	return nil, -1
+}
+
+/* parses the (destination "title") of an inline link, i being the offset
+ * of the parenthesis; returns the offset after it, 0 if there is none */
+func cm_inline_link(data []byte, i int) (dest, title []byte, quote byte, end int) {
+	j := cm_spnl(data, i+1)
+	dest, k := cm_link_dest(data, j)
+	if k < 0 {
+		return nil, nil, 0, 0
+	}
+	j = cm_spnl(data, k)
+	if j > k {
+		if t, e := cm_link_title(data, j); e > 0 {
+			title, quote = t, data[j]
+			j = cm_spnl(data, e)
+		}
+	}
+	if j >= len(data) || data[j] != ')' {
+		return nil, nil, 0, 0
+	}
+	return dest, title, quote, j + 1
+}
+
+/* returns the length of the link label at data[i:], brackets included,
+ * 0 if there is none */
+func cm_link_label(data []byte, i int) int {
+	if i >= len(data) || data[i] != '[' {
+		return 0
+	}
+	for j := i + 1; j < len(data) && j-i <= 1000; j++ {
+		switch data[j] {
+		case '\\':
+			j++
+		case '[':
+			return 0
+		case ']':
+			return j - i + 1
+		}
+	}
+	return 0
+}
+
+/* the key of a link reference: the label case folded, with its runs of
+ * whitespace collapsed */
+func cm_ref_key(label []byte) string {
+	words := bytes.FieldsFunc(label, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	key := strings.ToLower(strings.ToUpper(string(bytes.Join(words, []byte(" ")))))
+	return strings.Replace(key, "ß", "ss", -1)
+}
+
+/* parses a reference definition at the start of a paragraph; returns its
+ * length, 0 if there is none */
+func cm_parse_ref(rndr *render, data []byte) int {
+	n := cm_link_label(data, 0)
+	if n == 0 || n >= len(data) || data[n] != ':' {
+		return 0
+	}
+	label := data[1 : n-1]
+	key := cm_ref_key(label)
+	if key == "" {
+		return 0
+	}
+
+	i := cm_spnl(data, n+1)
+	dest, i := cm_link_dest(data, i)
+	if i < 0 || (len(dest) == 0 && data[i-1] != '>') {
+		return 0
+	}
+
+	/* the title, if any, must end the line, or the definition stops at
+	 * the destination */
+	at_eol := func(j int) int {
+		for j < len(data) && is_space_tab(data[j]) {
+			j++
+		}
+		if j < len(data) && data[j] != '\n' {
+			return -1
+		}
+		if j < len(data) {
+			j++
+		}
+		return j
+	}
+	var title []byte
+	end := -1
+	if j := cm_spnl(data, i); j > i {
+		if t, e := cm_link_title(data, j); e > 0 {
+			if end = at_eol(e); end >= 0 {
+				title = t
+			}
+		}
+	}
+	if end < 0 {
+		if end = at_eol(i); end < 0 {
+			return 0
+		}
+	}
+
+	if _, ok := rndr.refs[key]; !ok {
+		rndr.refs[key] = &LinkRef{id: label, link: cm_unescape(dest), title: cm_unescape(title)}
+	}
+	return end
+}
+
+/* returns the length of the entity or numeric character reference at the
+ * start of data, 0 if there is none */
+func cm_entity_len(data []byte) int {
+	size := len(data)
+	if size < 3 || data[0] != '&' {
+		return 0
+	}
+	i := 1
+	if data[1] == '#' {
+		i++
+		hex := i < size && (data[i] == 'x' || data[i] == 'X')
+		if hex {
+			i++
+		}
+		b := i
+		for i < size && ((hex && is_hex(data[i])) || (!hex && data[i] >= '0' && data[i] <= '9')) {
+			i++
+		}
+		if n := i - b; n == 0 || (hex && n > 6) || n > 7 || i >= size || data[i] != ';' {
+			return 0
+		}
+		return i + 1
+	}
+
+	for i < size && i <= 32 && isalnum(data[i]) {
+		i++
+	}
+	if i < 3 || !isalpha(data[1]) || i >= size || data[i] != ';' {
+		return 0
+	}
+	/* a name of the html5 list, which stands for one or two characters */
+	s := string(data[:i+1])
+	dec := html.UnescapeString(s)
+	if dec == s || utf8.RuneCountInString(dec) > 2 {
+		return 0
+	}
+	return i + 1
+}
+
+/* replaces the backslash escapes and the entities of a link destination,
+ * a title or an info string by the characters they stand for */
+func cm_unescape(data []byte) []byte {
+	if bytes.IndexByte(data, '\\') < 0 && bytes.IndexByte(data, '&') < 0 {
+		return data
+	}
+	var ob bytes.Buffer
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if c == '\\' && i+1 < len(data) && ispunct(data[i+1]) {
+			ob.WriteByte(data[i+1])
+			i++
+			continue
+		}
+		if c == '&' {
+			if n := cm_entity_len(data[i:]); n > 0 {
+				ob.WriteString(html.UnescapeString(string(data[i : i+n])))
+				i += n - 1
+				continue
+			}
+		}
+		ob.WriteByte(c)
+	}
+	return ob.Bytes()
+}
+
+/* writes a link the way CommonMark renders it: percent-encoded, keeping
+ * the escapes already there, and html escaped */
+func cm_href_escape(ob *bytes.Buffer, link []byte) {
+	const hex = "0123456789ABCDEF"
+	var u bytes.Buffer
+	for i := 0; i < len(link); i++ {
+		c := link[i]
+		switch {
+		case isalnum(c) || strings.IndexByte(";/?:@&=+$,-_.!~*'()#", c) >= 0:
+			u.WriteByte(c)
+		case c == '%' && i+2 < len(link) && is_hex(link[i+1]) && is_hex(link[i+2]):
+			u.WriteByte(c)
+		default:
+			u.WriteByte('%')
+			u.WriteByte(hex[c>>4])
+			u.WriteByte(hex[c&15])
+		}
+	}
+	attr_escape(ob, u.Bytes())
+}
+
+/* writes a piece, the unmatched delimiters as literal text */
+func write_cm_inline(ob *bytes.Buffer, rndr *render, p *cm_inline) {
+	if p.delim == 0 {
+		ob.Write(p.text)
+		return
+	}
+	if p.count > 0 {
+		run := bytes.Repeat([]byte{p.delim}, p.count)
+		if rndr.make.normal_text != nil {
+			rndr.make.normal_text(ob, run, rndr.make.opaque)
+		} else {
+			ob.Write(run)
+		}
+	}
+}
+
+/* matches closers with the nearest possible openers, replacing the pieces
+ * in between with the rendered emphasis */
+func process_emphasis(rndr *render, pieces []*cm_inline) []*cm_inline {
+	for ci := 0; ci < len(pieces); ci++ {
+		closer := pieces[ci]
+		if closer.delim == 0 || !closer.can_close || closer.count == 0 {
+			continue
+		}
+
+		oi := -1
+		for k := ci - 1; k >= 0; k-- {
+			o := pieces[k]
+			if o.delim != closer.delim || !o.can_open || o.count == 0 {
+				continue
+			}
+			/* rule of 3 */
+			if (o.can_close || closer.can_open) &&
+				(o.length+closer.length)%3 == 0 &&
+				!(o.length%3 == 0 && closer.length%3 == 0) {
+				continue
+			}
+			oi = k
+			break
+		}
+		if oi < 0 {
+			continue
+		}
+		opener := pieces[oi]
+
+		use := 1
+		if opener.count >= 2 && closer.count >= 2 {
+			use = 2
+		}
+
+		var content bytes.Buffer
+		for k := oi + 1; k < ci; k++ {
+			write_cm_inline(&content, rndr, pieces[k])
+		}
+
+		var em bytes.Buffer
+		ok := false
+		set_source(rndr, mkd_source{delim: closer.delim})
+		if use == 2 && rndr.make.double_emphasis != nil {
+			ok = rndr.make.double_emphasis(&em, content.Bytes(), rndr.make.opaque)
+		} else if use == 1 && rndr.make.emphasis != nil {
+			ok = rndr.make.emphasis(&em, content.Bytes(), rndr.make.opaque)
+		}
+		set_source(rndr, mkd_source{})
+		if !ok {
+			em.Reset()
+			run := bytes.Repeat([]byte{closer.delim}, use)
+			em.Write(run)
+			em.Write(content.Bytes())
+			em.Write(run)
+		}
+		opener.count -= use
+		closer.count -= use
+
+		rest := append([]*cm_inline{{text: em.Bytes()}}, pieces[ci:]...)
+		pieces = append(pieces[:oi+1], rest...)
+		/* the closer may still close an earlier opener */
+		ci = oi
+	}
+	return pieces
+}
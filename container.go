@@ -0,0 +1,524 @@
+package markup
+
+import (
+	"bytes"
+)
+
+/*
+ * Collapsible blocks (MKDEXT_DETAILS), written either with an indented body
+ *
+ *	??? "Summary text"
+ *	    body, parsed as markdown
+ *
+ * ("???+" renders the block open, a word before the summary is added as
+ * a class) or as a fence of three colons or more
+ *
+ *	:::details Summary text
+ *	body, parsed as markdown
+ *	:::
+ *
+ * where a fence can only be closed by a line of at least as many colons.
+ *
+ * Generic directives (MKDEXT_DIRECTIVES) use the same fences with any
+ * name and an optional attribute list, "::: warning {title="x"}" or
+ * "::: {.note}". The body is rendered and passed to the Config handler
+ * registered for the name, or wrapped in <div class="name">.
+ */
+
+var DETAILS_TAG []byte = []byte("details")
+
+/* checks for a "???" header line; returns the line length, 0 otherwise */
+func is_details_header(data []byte, kind, summary *[]byte, open *bool) int {
+	size := len(data)
+	if size < 3 || data[0] != '?' || data[1] != '?' || data[2] != '?' {
+		return 0
+	}
+	i := 3
+	*open = false
+	if i < size && data[i] == '+' {
+		*open = true
+		i++
+	}
+	if i < size && data[i] != ' ' && data[i] != '\t' && data[i] != '\n' {
+		return 0
+	}
+	for i < size && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+
+	/* optional type, then the optional quoted summary */
+	k := i
+	for i < size && (isalnum(data[i]) || data[i] == '-' || data[i] == '_') {
+		i++
+	}
+	*kind = data[k:i]
+	for i < size && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+	*summary = nil
+	if i < size && data[i] == '"' {
+		s := i + 1
+		for i++; i < size && data[i] != '"' && data[i] != '\n'; i++ {
+			if data[i] == '\\' && i+1 < size && data[i+1] != '\n' {
+				i++
+			}
+		}
+		if i >= size || data[i] != '"' {
+			return 0
+		}
+		*summary = data[s:i]
+		i++
+	}
+
+	if n := is_empty(data[i:]); n > 0 {
+		return i + n
+	}
+	if i == size {
+		return i
+	}
+	return 0
+}
+
+/* checks for an opening colon fence; returns the line length, 0 otherwise */
+func is_colon_fence(data []byte, colons *int, name, info *[]byte) int {
+	size := len(data)
+	i := 0
+	for i < 3 && i < size && data[i] == ' ' {
+		i++
+	}
+	n := 0
+	for i < size && data[i] == ':' {
+		i++
+		n++
+	}
+	if n < 3 {
+		return 0
+	}
+	for i < size && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+	b := i
+	for i < size && (isalnum(data[i]) || data[i] == '-' || data[i] == '_') {
+		i++
+	}
+	if i == b && (i >= size || data[i] != '{') {
+		return 0
+	}
+	*colons = n
+	*name = data[b:i]
+
+	e := i
+	for e < size && data[e] != '\n' {
+		e++
+	}
+	*info = bytes.TrimSpace(data[i:e])
+	if e < size {
+		e++
+	}
+	return e
+}
+
+/* checks for a line of at least n colons; returns the line length */
+func is_colon_fence_end(data []byte, n int) int {
+	size := len(data)
+	i := 0
+	for i < 3 && i < size && data[i] == ' ' {
+		i++
+	}
+	c := 0
+	for i < size && data[i] == ':' {
+		i++
+		c++
+	}
+	if c < n {
+		return 0
+	}
+	if w := is_empty(data[i:]); w > 0 {
+		return i + w
+	}
+	if i == size {
+		return i
+	}
+	return 0
+}
+
+/* returns the body of a colon fence opened by n colons and the length of
+ * the block; the body runs to the closing fence, or to the end */
+func colon_fence_body(data []byte, beg, n int) ([]byte, int) {
+	end := beg
+	for end < len(data) {
+		if w := is_colon_fence_end(data[end:], n); w > 0 {
+			return data[beg:end], end + w
+		}
+		for end < len(data) && data[end] != '\n' {
+			end++
+		}
+		if end < len(data) {
+			end++
+		}
+	}
+	return data[beg:end], end
+}
+
+/* whether the line opens a block of this file, which ends a paragraph */
+func is_container_start(rndr *render, data []byte) bool {
+	var kind, summary, name, info []byte
+	var open bool
+	var n int
+	if rndr.ext_flags&MKDEXT_DETAILS != 0 && is_details_header(data, &kind, &summary, &open) > 0 {
+		return true
+	}
+	if is_colon_fence(data, &n, &name, &info) == 0 {
+		return false
+	}
+	if rndr.ext_flags&MKDEXT_DETAILS != 0 && bytes.Equal(name, DETAILS_TAG) {
+		return true
+	}
+	_, _, ok := directive_head(name, info)
+	return rndr.ext_flags&MKDEXT_DIRECTIVES != 0 && ok
+}
+
+/* parses a collapsible block or a directive */
+func parse_container(ob *bytes.Buffer, rndr *render, data []byte) int {
+	var n int
+	var name, info []byte
+	if is_colon_fence(data, &n, &name, &info) > 0 {
+		if rndr.ext_flags&MKDEXT_DETAILS != 0 && bytes.Equal(name, DETAILS_TAG) {
+			return parse_details(ob, rndr, data)
+		}
+		if rndr.ext_flags&MKDEXT_DIRECTIVES != 0 {
+			return parse_directive(ob, rndr, data)
+		}
+		return 0
+	}
+	if rndr.ext_flags&MKDEXT_DETAILS != 0 {
+		return parse_details(ob, rndr, data)
+	}
+	return 0
+}
+
+/* parses a collapsible block in either form */
+func parse_details(ob *bytes.Buffer, rndr *render, data []byte) int {
+	defer un(trace("parse_details"))
+	var kind, summary []byte
+	var open bool
+	var work bytes.Buffer
+	var attrs *mkd_attrs
+	end := 0
+
+	if beg := is_details_header(data, &kind, &summary, &open); beg > 0 {
+		/* indented body, blank lines included when more follows */
+		end = beg
+		for end < len(data) {
+			line := end + 1
+			for line < len(data) && data[line-1] != '\n' {
+				line++
+			}
+			if pre := prefix_code(data[end:line]); pre > 0 {
+				work.Write(data[end+pre : line])
+			} else if is_empty(data[end:line]) > 0 && line < len(data) &&
+				(prefix_code(data[line:]) > 0 || is_empty(data[line:]) > 0) {
+				work.WriteByte('\n')
+			} else if is_empty(data[end:line]) == 0 {
+				break
+			}
+			end = line
+		}
+		if len(kind) > 0 {
+			attrs = &mkd_attrs{classes: [][]byte{kind}}
+			if summary == nil {
+				summary = append(bytes.ToUpper(kind[:1]), kind[1:]...)
+			}
+		}
+	} else {
+		var n int
+		var name []byte
+		if beg = is_colon_fence(data, &n, &name, &summary); beg == 0 || !bytes.Equal(name, DETAILS_TAG) {
+			return 0
+		}
+		if rndr.ext_flags&MKDEXT_ATTRIBUTES != 0 {
+			var e int
+			if e, attrs = trailing_attrs(summary, 0, len(summary)); attrs != nil {
+				summary = bytes.TrimSpace(summary[:e])
+			}
+		}
+
+		var body []byte
+		body, end = colon_fence_body(data, beg, n)
+		work.Write(body)
+	}
+
+	if len(summary) == 0 {
+		summary = []byte("Details")
+	}
+
+	if rndr.make.details != nil {
+		var title, body bytes.Buffer
+		parse_inline(&title, rndr, summary)
+		parse_block(&body, rndr, work.Bytes())
+		rndr.make.details(ob, title.Bytes(), body.Bytes(), open, attrs, rndr.make.opaque)
+	}
+	return end
+}
+
+/* splits the attributes off the title of a directive fence; a fence
+ * without a name needs them */
+func directive_head(name, title []byte) ([]byte, *mkd_attrs, bool) {
+	var attrs *mkd_attrs
+	if len(title) > 0 && title[0] == '{' {
+		var a mkd_attrs
+		if e := parse_attrs(title, &a); e > 0 {
+			attrs = &a
+			title = bytes.TrimSpace(title[e:])
+		}
+	}
+	if attrs == nil {
+		var e int
+		if e, attrs = trailing_attrs(title, 0, len(title)); attrs != nil {
+			title = bytes.TrimSpace(title[:e])
+		}
+	}
+	return title, attrs, len(name) > 0 || attrs != nil
+}
+
+/* parses a "::: name {attrs} title" fence */
+func parse_directive(ob *bytes.Buffer, rndr *render, data []byte) int {
+	defer un(trace("parse_directive"))
+	var n int
+	var name, title []byte
+	beg := is_colon_fence(data, &n, &name, &title)
+	if beg == 0 {
+		return 0
+	}
+
+	title, attrs, ok := directive_head(name, title)
+	if !ok {
+		return 0
+	}
+
+	body, end := colon_fence_body(data, beg, n)
+	var work bytes.Buffer
+	parse_block(&work, rndr, body)
+
+	if h := rndr.cfg.Directives[string(name)]; h != nil && len(name) > 0 {
+		if html, ok := h(string(name), string(title), attrs.to_map(), work.Bytes()); ok {
+			if ob.Len() > 0 {
+				ob.WriteByte('\n')
+			}
+			ob.Write(html)
+			ensure_ends_with_nl(ob)
+			return end
+		}
+	}
+
+	if rndr.make.directive != nil {
+		var head bytes.Buffer
+		if len(title) > 0 {
+			parse_inline(&head, rndr, title)
+		}
+		rndr.make.directive(ob, name, head.Bytes(), work.Bytes(), attrs, rndr.make.opaque)
+	}
+	return end
+}
+
+/* raw <details> block with markdown between the tags (lax html blocks).
+ * The tags are raw blocks of their own and the markdown blocks of the
+ * document, which the renderers without raw html write too. */
+func render_details_html(ob *bytes.Buffer, rndr *render, data []byte) {
+	head := bytes.IndexByte(data, '>') + 1
+	tail := bytes.LastIndex(data, []byte("</details>"))
+	if head == 0 || tail < head {
+		if rndr.make.blockhtml != nil {
+			rndr.make.blockhtml(ob, data, rndr.make.opaque)
+		}
+		return
+	}
+
+	/* the summary stays raw */
+	rest := bytes.TrimLeft(data[head:tail], " \t\n")
+	if bytes.HasPrefix(bytes.ToLower(rest), []byte("<summary")) {
+		if e := bytes.Index(bytes.ToLower(rest), []byte("</summary>")); e > 0 {
+			head = tail - len(rest) + e + len("</summary>")
+		}
+	}
+
+	if rndr.make.blockhtml != nil {
+		rndr.make.blockhtml(ob, data[:head], rndr.make.opaque)
+	}
+	parse_html_body(ob, rndr, data[head:tail])
+	if rndr.make.blockhtml != nil {
+		rndr.make.blockhtml(ob, data[tail:], rndr.make.opaque)
+	}
+}
+
+/* the markdown between the tags of an html block, parsed as blocks of the
+ * document */
+func parse_html_body(ob *bytes.Buffer, rndr *render, body []byte) {
+	body = bytes.TrimLeft(body, "\n")
+	if len(bytes.TrimSpace(body)) == 0 {
+		return
+	}
+	var text bytes.Buffer
+	text.Write(body)
+	ensure_ends_with_nl(&text)
+	parse_block(ob, rndr, text.Bytes())
+}
+
+/* finds the attribute name in an opening tag; returns its value and the
+ * span of the attribute with its leading whitespace */
+func html_tag_attr(tag []byte, name string) (value []byte, beg, end int, ok bool) {
+	size := len(tag)
+	i := 1
+	for i < size && isalnum(tag[i]) {
+		i++
+	}
+	for i < size && tag[i] != '>' {
+		beg = i
+		for i < size && isspace(tag[i]) {
+			i++
+		}
+		k := i
+		for i < size && !isspace(tag[i]) && tag[i] != '=' && tag[i] != '>' && tag[i] != '/' {
+			i++
+		}
+		key := tag[k:i]
+		var val []byte
+		if i < size && tag[i] == '=' {
+			i++
+			if i < size && (tag[i] == '"' || tag[i] == '\'') {
+				q := tag[i]
+				v := i + 1
+				for i++; i < size && tag[i] != q; i++ {
+				}
+				if i >= size {
+					return nil, 0, 0, false
+				}
+				val = tag[v:i]
+				i++
+			} else {
+				v := i
+				for i < size && !isspace(tag[i]) && tag[i] != '>' {
+					i++
+				}
+				val = tag[v:i]
+			}
+		}
+		if i == k {
+			i++ /* stray character like '/' */
+			continue
+		}
+		if bytes.EqualFold(key, []byte(name)) {
+			return val, beg, i, true
+		}
+	}
+	return nil, 0, 0, false
+}
+
+/* returns the length of the opening tag, quotes included */
+func html_tag_end(data []byte) int {
+	var q byte
+	for i := 1; i < len(data); i++ {
+		switch c := data[i]; {
+		case q != 0:
+			if c == q {
+				q = 0
+			}
+		case c == '"' || c == '\'':
+			q = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return 0
+}
+
+/* finds the tag closing the element opened at the start of data, counting
+ * the nested elements of the same name; returns its offset or -1 */
+func find_closing_tag(data []byte, tag []byte) int {
+	lower := bytes.ToLower(data)
+	depth := 0
+	for i := 0; i+2 < len(lower); i++ {
+		if lower[i] != '<' {
+			continue
+		}
+		j := i + 1
+		closing := lower[j] == '/'
+		if closing {
+			j++
+		}
+		if !bytes.HasPrefix(lower[j:], tag) || (j+len(tag) < len(lower) && isalnum(lower[j+len(tag)])) {
+			continue
+		}
+		if !closing {
+			depth++
+		} else if depth--; depth == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+/* html block whose opening tag has a markdown attribute: "1" or "block"
+ * parses the content as blocks, "span" as inline text; the attribute
+ * itself is removed. Returns the length of the block, 0 without one. */
+func parse_markdown_html(ob *bytes.Buffer, rndr *render, data []byte, tag []byte, do_render bool) int {
+	defer un(trace("parse_markdown_html"))
+	head := html_tag_end(data)
+	if head == 0 {
+		return 0
+	}
+	value, beg, end, ok := html_tag_attr(data[:head], "markdown")
+	if !ok {
+		return 0
+	}
+
+	/* the matching closing tag must end its line */
+	tail := find_closing_tag(data, tag)
+	if tail < head {
+		return 0
+	}
+	size := tail + bytes.IndexByte(data[tail:], '>') + 1
+	if size <= tail {
+		return 0
+	}
+	if w := is_empty(data[size:]); w > 0 {
+		size += w
+	} else if size < len(data) {
+		return 0
+	}
+
+	if !do_render {
+		return size
+	}
+
+	var work bytes.Buffer
+	if rndr.make.source != nil {
+		/* written back as markdown, the attribute stays */
+		work.Write(data[:head])
+	} else {
+		work.Write(data[:beg])
+		work.Write(data[end:head])
+	}
+	inner := data[head:tail]
+	switch string(bytes.ToLower(value)) {
+	case "1", "block":
+		/* only the tags go out raw */
+		if rndr.make.blockhtml != nil {
+			rndr.make.blockhtml(ob, work.Bytes(), rndr.make.opaque)
+		}
+		parse_html_body(ob, rndr, inner)
+		if rndr.make.blockhtml != nil {
+			rndr.make.blockhtml(ob, data[tail:size], rndr.make.opaque)
+		}
+		return size
+	case "span":
+		parse_inline(&work, rndr, bytes.TrimSpace(inner))
+	default:
+		work.Write(inner)
+	}
+	work.Write(data[tail:size])
+	if rndr.make.blockhtml != nil {
+		rndr.make.blockhtml(ob, work.Bytes(), rndr.make.opaque)
+	}
+	return size
+}
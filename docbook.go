@@ -0,0 +1,662 @@
+package markup
+
+import (
+	"bytes"
+	"html"
+	"strconv"
+	"unicode/utf8"
+)
+
+/*
+ * DocBook 5 renderer. Paragraphs become para, lists itemizedlist and
+ * orderedlist, code programlisting, tables CALS informaltables, links
+ * link xlink:href and images mediaobject. Raw html has no meaning in
+ * DocBook and is dropped.
+ *
+ * Headers nest: the header callback stores the header and writes a
+ * reference to it, docbook_section, the index and docbook_section again.
+ * The blocks holding other blocks turn the references they get into
+ * bridgeheads, a section can't be inside them; doc_footer turns the ones
+ * left into sections, closing those of the same or a deeper level, and
+ * wraps the document in its root element.
+ */
+
+/* DocBook options */
+const (
+	DOCBOOK_CHAPTER = 1 << 0 /* a chapter, to include in a book, rather than an article */
+	DOCBOOK_FIGURES = 1 << 1 /* figure elements, titled, for the paragraphs made of an image */
+)
+
+/* marks a reference to a header in the intermediate output */
+const docbook_section = '\x1c'
+
+/* marks the start of a block, for the list items mixing text and blocks */
+const docbook_start = '\x1d'
+
+const docbook_namespaces = ` xmlns="http://docbook.org/ns/docbook" xmlns:xlink="http://www.w3.org/1999/xlink" version="5.0"`
+
+// DocbookOptions are the settings of MarkdownToDocbook.
+type DocbookOptions struct {
+	// Flags is a combination of the DOCBOOK_* flags.
+	Flags uint
+
+	// Extensions are the MKDEXT_* flags of the parser.
+	Extensions uint
+
+	// Config holds the additional parser settings, it may be nil.
+	Config *Config
+}
+
+type docbook_head struct {
+	level int
+	title []byte
+	attrs *mkd_attrs
+}
+
+type docbook_renderopt struct {
+	flags   uint
+	headers []docbook_head
+}
+
+/* the directives written as the admonition of the same name */
+var docbook_admonitions = map[string]bool{
+	"note": true, "tip": true, "important": true, "caution": true, "warning": true, "danger": true,
+}
+
+/* escapes the markup characters, and the quotes in attribute values;
+ * the characters XML doesn't allow are dropped, invalid UTF-8 replaced */
+func docbook_escape(ob *bytes.Buffer, text []byte, attr bool) {
+	for len(text) > 0 {
+		r, n := utf8.DecodeRune(text)
+		switch {
+		case r == '&':
+			ob.WriteString("&amp;")
+		case r == '<':
+			ob.WriteString("&lt;")
+		case r == '>':
+			ob.WriteString("&gt;")
+		case r == '"' && attr:
+			ob.WriteString("&quot;")
+		case r == '\n' && attr:
+			ob.WriteString("&#10;")
+		case r < ' ' && r != '\t' && r != '\n', r == 0xfffe, r == 0xffff:
+		case r == utf8.RuneError && n == 1:
+			ob.WriteString("\ufffd")
+		default:
+			ob.Write(text[:n])
+		}
+		text = text[n:]
+	}
+}
+
+/* writes xml:id and role, from the id and the classes */
+func docbook_attrs(ob *bytes.Buffer, attrs *mkd_attrs) {
+	if attrs == nil {
+		return
+	}
+	if len(attrs.id) > 0 {
+		ob.WriteString(` xml:id="`)
+		docbook_escape(ob, attrs.id, true)
+		ob.WriteByte('"')
+	}
+	if class, ok := attrs.get("class"); ok {
+		ob.WriteString(` role="`)
+		docbook_escape(ob, class, true)
+		ob.WriteByte('"')
+	}
+}
+
+/* starts a block on a line of its own */
+func docbook_block(ob *bytes.Buffer) {
+	if ob.Len() > 0 {
+		ensure_ends_with_nl(ob)
+	}
+	ob.WriteByte(docbook_start)
+}
+
+/* writes <tag>text</tag> */
+func docbook_tag(ob *bytes.Buffer, tag string, text []byte) {
+	ob.WriteString("<" + tag + ">")
+	ob.Write(text)
+	ob.WriteString("</" + tag + ">")
+}
+
+/* calls found with the runs of text and the headers referenced between them */
+func docbook_split(opaque interface{}, text []byte, found func(run []byte, header *docbook_head)) {
+	options, _ := opaque.(*docbook_renderopt)
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, docbook_section)
+		if i < 0 {
+			i = len(text)
+		}
+		if i > 0 {
+			found(text[:i], nil)
+		}
+		if i == len(text) {
+			break
+		}
+		text = text[i+1:]
+		end := bytes.IndexByte(text, docbook_section)
+		if end < 0 {
+			break
+		}
+		idx, err := strconv.Atoi(string(text[:end]))
+		if err == nil && idx < len(options.headers) {
+			found(nil, &options.headers[idx])
+		}
+		text = text[end+1:]
+	}
+}
+
+/* writes the blocks of a block holding them, the headers as bridgeheads */
+func docbook_blocks(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	docbook_split(opaque, text, func(run []byte, header *docbook_head) {
+		if header == nil {
+			ob.Write(run)
+			return
+		}
+		ob.WriteString(`<bridgehead renderas="sect` + strconv.Itoa(header.level) + `"`)
+		docbook_attrs(ob, header.attrs)
+		ob.WriteByte('>')
+		ob.Write(header.title)
+		ob.WriteString("</bridgehead>")
+	})
+	ensure_ends_with_nl(ob)
+}
+
+/* the blocks, or an empty para where DocBook wants one */
+func docbook_content(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	if len(bytes.Trim(text, "\n\x1d")) == 0 {
+		ob.WriteString("<para/>\n")
+		return
+	}
+	docbook_blocks(ob, text, opaque)
+}
+
+func docbook_blockcode(ob *bytes.Buffer, text []byte, lang []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("docbook_blockcode"))
+	docbook_block(ob)
+	if len(lang) == 0 {
+		lang = code_lang(nil, attrs)
+	}
+	ob.WriteString("<programlisting")
+	if len(lang) > 0 {
+		ob.WriteString(` language="`)
+		docbook_escape(ob, lang, true)
+		ob.WriteByte('"')
+	}
+	if attrs != nil && len(attrs.id) > 0 {
+		ob.WriteString(` xml:id="`)
+		docbook_escape(ob, attrs.id, true)
+		ob.WriteByte('"')
+	}
+	ob.WriteByte('>')
+	docbook_escape(ob, bytes.TrimRight(text, "\n"), false)
+	ob.WriteString("</programlisting>\n")
+}
+
+func docbook_blockquote(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("docbook_blockquote"))
+	docbook_block(ob)
+	ob.WriteString("<blockquote>\n")
+	docbook_content(ob, text, opaque)
+	ob.WriteString("</blockquote>\n")
+}
+
+/* raw html is dropped */
+func docbook_raw_block(ob *bytes.Buffer, text []byte, opaque interface{}) {
+}
+
+func docbook_header(ob *bytes.Buffer, text []byte, level int, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("docbook_header"))
+	options, _ := opaque.(*docbook_renderopt)
+	if level < 1 {
+		level = 1
+	}
+	if level > 5 {
+		level = 5
+	}
+	docbook_block(ob)
+	ob.WriteByte(docbook_section)
+	ob.WriteString(strconv.Itoa(len(options.headers)))
+	ob.WriteByte(docbook_section)
+	ob.WriteByte('\n')
+	title := append([]byte(nil), bytes.Trim(text, " ")...)
+	options.headers = append(options.headers, docbook_head{level, title, attrs})
+}
+
+/* DocBook has no rule: the sections are the breaks it knows */
+func docbook_hrule(ob *bytes.Buffer, opaque interface{}) {
+}
+
+func docbook_list(ob *bytes.Buffer, text []byte, flags, start int, opaque interface{}) {
+	defer un(trace("docbook_list"))
+	tag := "itemizedlist"
+	if flags&MKD_LIST_ORDERED != 0 {
+		tag = "orderedlist"
+	}
+	docbook_block(ob)
+	ob.WriteString("<" + tag)
+	if flags&MKD_LIST_ORDERED != 0 && start != 1 {
+		ob.WriteString(" startingnumber=\"" + strconv.Itoa(start) + "\"")
+	}
+	ob.WriteString(">\n")
+	ob.Write(text)
+	ob.WriteString("</" + tag + ">\n")
+}
+
+/* the text of a tight item, up to its first block, goes in a para */
+func docbook_listitem(ob *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+	defer un(trace("docbook_listitem"))
+	ob.WriteString("<listitem>\n")
+	blocks := bytes.IndexByte(text, docbook_start)
+	if blocks < 0 {
+		blocks = len(text)
+	}
+	if inline := bytes.Trim(text[:blocks], " \n"); len(inline) > 0 {
+		docbook_tag(ob, "para", inline)
+		ob.WriteByte('\n')
+		docbook_blocks(ob, text[blocks:], opaque)
+	} else {
+		docbook_content(ob, text[blocks:], opaque)
+	}
+	ob.WriteString("</listitem>\n")
+}
+
+func docbook_paragraph(ob *bytes.Buffer, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("docbook_paragraph"))
+	text = bytes.Trim(text, " \n")
+	if len(text) == 0 {
+		return
+	}
+	docbook_block(ob)
+	ob.WriteString("<para")
+	docbook_attrs(ob, attrs)
+	ob.WriteByte('>')
+	ob.Write(text)
+	ob.WriteString("</para>\n")
+}
+
+/* a CALS table, the alignments on the column specifications */
+func docbook_table(ob *bytes.Buffer, header []byte, body []byte, opaque interface{}) {
+	defer un(trace("docbook_table"))
+	head, aligns := text_table_rows(header, nil)
+	rows, body_aligns := text_table_rows(nil, body)
+	if len(body_aligns) > len(aligns) {
+		aligns = append(aligns, body_aligns[len(aligns):]...)
+	}
+	if len(aligns) == 0 {
+		return
+	}
+
+	docbook_block(ob)
+	ob.WriteString("<informaltable frame=\"all\">\n<tgroup cols=\"" + strconv.Itoa(len(aligns)) + "\">\n")
+	for i, align := range aligns {
+		ob.WriteString(`<colspec colname="c` + strconv.Itoa(i+1) + `"`)
+		switch align {
+		case MKD_TABLE_ALIGN_L:
+			ob.WriteString(` align="left"`)
+		case MKD_TABLE_ALIGN_R:
+			ob.WriteString(` align="right"`)
+		case MKD_TABLE_ALIGN_CENTER:
+			ob.WriteString(` align="center"`)
+		}
+		ob.WriteString("/>\n")
+	}
+	for _, part := range []struct {
+		tag  string
+		rows [][][]byte
+	}{{"thead", head}, {"tbody", rows}} {
+		if len(part.rows) == 0 {
+			continue
+		}
+		ob.WriteString("<" + part.tag + ">\n")
+		for _, row := range part.rows {
+			ob.WriteString("<row>")
+			for _, cell := range row {
+				docbook_tag(ob, "entry", cell)
+			}
+			ob.WriteString("</row>\n")
+		}
+		ob.WriteString("</" + part.tag + ">\n")
+	}
+	ob.WriteString("</tgroup>\n</informaltable>\n")
+}
+
+func docbook_tablerow(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("docbook_tablerow"))
+	ob.Write(text)
+	ob.WriteByte(text_row)
+}
+
+func docbook_tablecell(ob *bytes.Buffer, text []byte, align int, opaque interface{}) {
+	defer un(trace("docbook_tablecell"))
+	ob.WriteByte(text_cell)
+	ob.WriteByte(byte('0' + align))
+	ob.Write(bytes.Trim(text, " "))
+}
+
+/* the image of a paragraph made of an image, as a block */
+func docbook_figure(ob *bytes.Buffer, image []byte, caption []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("docbook_figure"))
+	options, _ := opaque.(*docbook_renderopt)
+	if bytes.HasPrefix(image, []byte("<inline")) && bytes.HasSuffix(image, []byte("</inlinemediaobject>")) {
+		image = append([]byte("<"), image[len("<inline"):len(image)-len("</inlinemediaobject>")]...)
+		image = append(image, "</mediaobject>"...)
+	}
+	docbook_block(ob)
+	if options.flags&DOCBOOK_FIGURES != 0 {
+		ob.WriteString("<figure")
+		docbook_attrs(ob, attrs)
+		ob.WriteString(">\n")
+		docbook_tag(ob, "title", bytes.Trim(caption, " "))
+		ob.WriteByte('\n')
+		ob.Write(image)
+		ob.WriteString("\n</figure>\n")
+		return
+	}
+	ob.Write(image)
+	ob.WriteByte('\n')
+}
+
+/* DocBook can't fold a block: the summary is the title of a sidebar */
+func docbook_details(ob *bytes.Buffer, summary []byte, text []byte, open bool, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("docbook_details"))
+	docbook_block(ob)
+	ob.WriteString("<sidebar")
+	docbook_attrs(ob, attrs)
+	ob.WriteString(">\n")
+	docbook_tag(ob, "title", bytes.Trim(summary, " "))
+	ob.WriteByte('\n')
+	docbook_content(ob, text, opaque)
+	ob.WriteString("</sidebar>\n")
+}
+
+/* the admonitions keep their name, the other directives are sidebars
+ * with the name as role */
+func docbook_directive(ob *bytes.Buffer, name []byte, title []byte, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("docbook_directive"))
+	tag := "sidebar"
+	if docbook_admonitions[string(name)] {
+		tag = string(name)
+	} else if len(name) > 0 {
+		attrs = attrs.with_class(name)
+	}
+	docbook_block(ob)
+	ob.WriteString("<" + tag)
+	docbook_attrs(ob, attrs)
+	ob.WriteString(">\n")
+	if title = bytes.Trim(title, " "); len(title) > 0 {
+		docbook_tag(ob, "title", title)
+		ob.WriteByte('\n')
+	}
+	docbook_content(ob, text, opaque)
+	ob.WriteString("</" + tag + ">\n")
+}
+
+func docbook_autolink(ob *bytes.Buffer, link []byte, typ int, opaque interface{}) bool {
+	defer un(trace("docbook_autolink"))
+	if len(link) == 0 {
+		return false
+	}
+	if typ == MKDA_EMAIL || bytes.HasPrefix(link, []byte("mailto:")) {
+		ob.WriteString("<email>")
+		docbook_escape(ob, bytes.TrimPrefix(link, []byte("mailto:")), false)
+		ob.WriteString("</email>")
+		return true
+	}
+	ob.WriteString(`<link xlink:href="`)
+	docbook_escape(ob, link, true)
+	ob.WriteString(`">`)
+	docbook_escape(ob, link, false)
+	ob.WriteString("</link>")
+	return true
+}
+
+func docbook_codespan(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("docbook_codespan"))
+	ob.WriteString("<literal>")
+	docbook_escape(ob, text, false)
+	ob.WriteString("</literal>")
+	return true
+}
+
+func docbook_double_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("docbook_double_emphasis"))
+	if len(text) == 0 {
+		return false
+	}
+	ob.WriteString(`<emphasis role="strong">`)
+	ob.Write(text)
+	ob.WriteString("</emphasis>")
+	return true
+}
+
+func docbook_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("docbook_emphasis"))
+	if len(text) == 0 {
+		return false
+	}
+	docbook_tag(ob, "emphasis", text)
+	return true
+}
+
+func docbook_triple_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("docbook_triple_emphasis"))
+	if len(text) == 0 {
+		return false
+	}
+	ob.WriteString(`<emphasis role="strong"><emphasis>`)
+	ob.Write(text)
+	ob.WriteString("</emphasis></emphasis>")
+	return true
+}
+
+func docbook_strikethrough(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("docbook_strikethrough"))
+	if len(text) == 0 {
+		return false
+	}
+	ob.WriteString(`<emphasis role="strikethrough">`)
+	ob.Write(text)
+	ob.WriteString("</emphasis>")
+	return true
+}
+
+/* an inline image; docbook_figure makes a block of it */
+func docbook_image(ob *bytes.Buffer, link []byte, title []byte, alt []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("docbook_image"))
+	if len(link) == 0 {
+		return false
+	}
+	ob.WriteString("<inlinemediaobject")
+	docbook_attrs(ob, attrs)
+	ob.WriteString(`><imageobject><imagedata fileref="`)
+	docbook_escape(ob, link, true)
+	ob.WriteString(`"/></imageobject>`)
+	if len(alt) > 0 {
+		ob.WriteString("<textobject><phrase>")
+		docbook_escape(ob, alt, false)
+		ob.WriteString("</phrase></textobject>")
+	}
+	ob.WriteString("</inlinemediaobject>")
+	return true
+}
+
+/* the processing instruction of the DocBook XSL stylesheets */
+func docbook_linebreak(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("docbook_linebreak"))
+	ob.WriteString("<?linebreak?>\n")
+	return true
+}
+
+func docbook_link(ob *bytes.Buffer, link []byte, title []byte, content []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("docbook_link"))
+	if len(link) == 0 {
+		ob.Write(content)
+		return true
+	}
+	ob.WriteString(`<link xlink:href="`)
+	docbook_escape(ob, link, true)
+	if len(title) > 0 {
+		ob.WriteString(`" xlink:title="`)
+		docbook_escape(ob, title, true)
+	}
+	ob.WriteByte('"')
+	docbook_attrs(ob, attrs)
+	ob.WriteByte('>')
+	ob.Write(content)
+	ob.WriteString("</link>")
+	return true
+}
+
+/* inline html is dropped */
+func docbook_raw_html(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	return true
+}
+
+func docbook_emoji(ob *bytes.Buffer, name []byte, glyph []byte, image []byte, opaque interface{}) bool {
+	defer un(trace("docbook_emoji"))
+	if len(glyph) > 0 {
+		docbook_escape(ob, glyph, false)
+	} else {
+		ob.WriteByte(':')
+		docbook_escape(ob, name, false)
+		ob.WriteByte(':')
+	}
+	return true
+}
+
+func docbook_entity(ob *bytes.Buffer, entity []byte, opaque interface{}) {
+	defer un(trace("docbook_entity"))
+	docbook_escape(ob, []byte(html.UnescapeString(string(entity))), false)
+}
+
+func docbook_normal_text(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("docbook_normal_text"))
+	docbook_escape(ob, text, false)
+}
+
+/* nests the sections and wraps the document in its root element, the
+ * title of which is the first header when the others are all deeper */
+func docbook_finalize(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("docbook_finalize"))
+	options, _ := opaque.(*docbook_renderopt)
+	text := append([]byte(nil), ob.Bytes()...)
+	ob.Reset()
+
+	root := "article"
+	if options.flags&DOCBOOK_CHAPTER != 0 {
+		root = "chapter"
+	}
+	var title *docbook_head
+	titled := true
+	docbook_split(opaque, text, func(run []byte, header *docbook_head) {
+		switch {
+		case header == nil:
+			titled = titled && (title != nil || len(bytes.Trim(run, "\n\x1d")) == 0)
+		case title == nil:
+			title = header
+		case header.level <= title.level:
+			titled = false
+		}
+	})
+	if !titled {
+		title = nil
+	}
+
+	ob.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<" + root + docbook_namespaces)
+	if title != nil {
+		docbook_attrs(ob, title.attrs)
+	}
+	ob.WriteString(">\n")
+	if title != nil {
+		docbook_tag(ob, "title", title.title)
+		ob.WriteByte('\n')
+	} else if root == "chapter" {
+		/* a chapter needs one */
+		ob.WriteString("<title/>\n")
+	}
+
+	var open []int
+	docbook_split(opaque, text, func(run []byte, header *docbook_head) {
+		if header == nil {
+			run = bytes.Replace(run, []byte{docbook_start}, nil, -1)
+			ob.Write(bytes.TrimLeft(run, "\n"))
+			return
+		}
+		if header == title {
+			return
+		}
+		for len(open) > 0 && open[len(open)-1] >= header.level {
+			ob.WriteString("</section>\n")
+			open = open[:len(open)-1]
+		}
+		open = append(open, header.level)
+		ob.WriteString("<section")
+		docbook_attrs(ob, header.attrs)
+		ob.WriteString(">\n")
+		docbook_tag(ob, "title", header.title)
+		ob.WriteByte('\n')
+	})
+	ensure_ends_with_nl(ob)
+	for range open {
+		ob.WriteString("</section>\n")
+	}
+	ob.WriteString("</" + root + ">\n")
+}
+
+func docbook_renderer(options *DocbookOptions) *mkd_renderer {
+	renderer := &mkd_renderer{
+		docbook_blockcode,
+		docbook_blockquote,
+		docbook_raw_block,
+		docbook_header,
+		docbook_hrule,
+		docbook_list,
+		docbook_listitem,
+		docbook_paragraph,
+		docbook_table,
+		docbook_tablerow,
+		docbook_tablecell,
+		docbook_figure,
+		docbook_details,
+		docbook_directive,
+
+		docbook_autolink,
+		docbook_codespan,
+		docbook_double_emphasis,
+		docbook_emphasis,
+		docbook_image,
+		docbook_linebreak,
+		docbook_link,
+		docbook_raw_html,
+		docbook_triple_emphasis,
+		docbook_strikethrough,
+		docbook_emoji,
+
+		docbook_entity,
+		docbook_normal_text,
+
+		nil,
+		docbook_finalize,
+		nil,
+		nil}
+
+	renderer.opaque = &docbook_renderopt{flags: options.Flags}
+	return renderer
+}
+
+func (opts *DocbookOptions) renderer() (*mkd_renderer, *Config) {
+	return docbook_renderer(opts), opts.Config
+}
+
+// MarkdownToDocbook renders the markdown document as a DocBook 5 article
+// or, with DOCBOOK_CHAPTER, a chapter, the headers nesting sections.
+// A nil opts renders an article without extensions.
+func MarkdownToDocbook(ib []byte, opts *DocbookOptions) []byte {
+	if opts == nil {
+		opts = &DocbookOptions{}
+	}
+	return ups_markdown(docbook_renderer(opts), ib, opts.Extensions, opts.Config)
+}
@@ -0,0 +1,489 @@
+package markup
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// Token is a piece of highlighted source code. Class is a Pygments style
+// short class name ("k" keyword, "s" string, "c" comment, ...) or "" for
+// text that isn't highlighted.
+type Token struct {
+	Class string
+	Text  []byte
+}
+
+// Lexer splits source code into tokens. Joining the text of the tokens
+// must give back the code.
+type Lexer func(code []byte) []Token
+
+var (
+	lexers    = map[string]Lexer{}
+	lexers_mu sync.RWMutex /* RegisterLexer may run while documents render */
+)
+
+// RegisterLexer makes a lexer available to fenced code blocks with any of
+// the given language names, replacing the built-in lexer of that name.
+// It is safe to call concurrently with rendering.
+func RegisterLexer(lx Lexer, names ...string) {
+	lexers_mu.Lock()
+	defer lexers_mu.Unlock()
+	for _, name := range names {
+		lexers[strings.ToLower(name)] = lx
+	}
+}
+
+func find_lexer(lang []byte) Lexer {
+	lexers_mu.RLock()
+	defer lexers_mu.RUnlock()
+	return lexers[strings.ToLower(string(lang))]
+}
+
+/* inline styles for HTML_HIGHLIGHT_INLINE, roughly the Pygments default style */
+var highlight_styles = map[string]string{
+	"k":  "color:#008000;font-weight:bold",
+	"kt": "color:#b00040",
+	"kc": "color:#008000;font-weight:bold",
+	"nb": "color:#008000",
+	"nt": "color:#008000;font-weight:bold",
+	"nv": "color:#19177c",
+	"s":  "color:#ba2121",
+	"m":  "color:#666666",
+	"c":  "color:#408080;font-style:italic",
+	"cp": "color:#bc7a00",
+	"o":  "color:#666666",
+	"gd": "color:#a00000",
+	"gi": "color:#00a000",
+	"gh": "color:#000080;font-weight:bold",
+	"gu": "color:#800080;font-weight:bold",
+}
+
+/* writes highlighted tokens as <span class="k"> or <span style="..."> */
+func write_tokens(ob *bytes.Buffer, tokens []Token, inline bool) {
+	for _, t := range tokens {
+		if t.Class == "" {
+			attr_escape(ob, t.Text)
+			continue
+		}
+		if inline {
+			style, ok := highlight_styles[t.Class]
+			if !ok {
+				/* fall back to the token family: "kd" is styled like "k" */
+				style = highlight_styles[t.Class[:1]]
+			}
+			if style == "" {
+				attr_escape(ob, t.Text)
+				continue
+			}
+			ob.WriteString("<span style=\"")
+			ob.WriteString(style)
+		} else {
+			ob.WriteString("<span class=\"")
+			attr_escape(ob, []byte(t.Class))
+		}
+		ob.WriteString("\">")
+		attr_escape(ob, t.Text)
+		ob.WriteString("</span>")
+	}
+}
+
+/* splits tokens at newlines, the newline ends up as the last text of each line */
+func token_lines(tokens []Token) [][]Token {
+	var lines [][]Token
+	var line []Token
+	for _, t := range tokens {
+		text := t.Text
+		for len(text) > 0 {
+			nl := bytes.IndexByte(text, '\n')
+			if nl < 0 {
+				line = append(line, Token{t.Class, text})
+				break
+			}
+			if nl > 0 {
+				line = append(line, Token{t.Class, text[:nl]})
+			}
+			line = append(line, Token{"", text[nl : nl+1]})
+			lines = append(lines, line)
+			line = nil
+			text = text[nl+1:]
+		}
+	}
+	if len(line) > 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+/* appends a token, skipping empty ones */
+func add_token(tokens []Token, class string, text []byte) []Token {
+	if len(text) == 0 {
+		return tokens
+	}
+	return append(tokens, Token{class, text})
+}
+
+func words(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+/************************
+ * TABLE DRIVEN LEXERS *
+ ************************/
+
+/* describes one of the common keyword, string and comment languages */
+type lang_def struct {
+	line_comments  []string
+	block_comments [][2]string
+	quotes         string /* string delimiters */
+	raw_quotes     string /* string delimiters without escapes */
+	triple_quotes  bool   /* python """ strings */
+	keywords       map[string]bool
+	types          map[string]bool
+	constants      map[string]bool
+	builtins       map[string]bool
+	ident_extra    string /* extra identifier chars, e.g. '$' */
+	variables      bool   /* shell $VAR and ${VAR} */
+	keys           bool   /* "key": in JSON */
+	ignore_case    bool   /* SQL keywords */
+}
+
+func is_ident_char(c byte, extra string) bool {
+	return isalnum(c) || c == '_' || c >= 0x80 || (extra != "" && strings.IndexByte(extra, c) >= 0)
+}
+
+/* returns the length of a number literal at the start of data, 0 if none */
+func number_length(data []byte) int {
+	size := len(data)
+	if size == 0 || !(data[0] >= '0' && data[0] <= '9' || (data[0] == '.' && size > 1 && data[1] >= '0' && data[1] <= '9')) {
+		return 0
+	}
+	i := 1
+	for i < size && (isalnum(data[i]) || data[i] == '.' || data[i] == '_' ||
+		((data[i] == '-' || data[i] == '+') && (data[i-1] == 'e' || data[i-1] == 'E'))) {
+		i++
+	}
+	return i
+}
+
+/* returns the length of a string literal starting with a quote, up to the
+ * closing quote or the end of the line (or code for raw strings) */
+func string_length(data []byte, escapes bool, multiline bool) int {
+	q := data[0]
+	i := 1
+	for i < len(data) {
+		c := data[i]
+		if escapes && c == '\\' {
+			i += 2
+			continue
+		}
+		i++
+		if c == q {
+			return i
+		}
+		if c == '\n' && !multiline {
+			return i - 1
+		}
+	}
+	return len(data)
+}
+
+func (d *lang_def) lex(code []byte) []Token {
+	var tokens []Token
+	size := len(code)
+	i := 0
+	plain := 0
+
+	flush := func(class string, end int) {
+		tokens = add_token(tokens, "", code[plain:i])
+		tokens = add_token(tokens, class, code[i:end])
+		i = end
+		plain = end
+	}
+
+	for i < size {
+		c := code[i]
+		rest := code[i:]
+
+		/* comments */
+		found := false
+		for _, lc := range d.line_comments {
+			if bytes.HasPrefix(rest, []byte(lc)) {
+				/* shell '#' only starts a comment at the beginning of a word */
+				if lc == "#" && d.variables && i > 0 && !isspace(code[i-1]) {
+					continue
+				}
+				end := bytes.IndexByte(rest, '\n')
+				if end < 0 {
+					end = len(rest)
+				}
+				class := "c"
+				if i == 0 && bytes.HasPrefix(rest, []byte("#!")) {
+					class = "cp"
+				}
+				flush(class, i+end)
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		for _, bc := range d.block_comments {
+			if bytes.HasPrefix(rest, []byte(bc[0])) {
+				end := bytes.Index(rest[len(bc[0]):], []byte(bc[1]))
+				if end < 0 {
+					end = len(rest)
+				} else {
+					end += len(bc[0]) + len(bc[1])
+				}
+				flush("c", i+end)
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		switch {
+		case d.triple_quotes && (bytes.HasPrefix(rest, []byte(`"""`)) || bytes.HasPrefix(rest, []byte("'''"))):
+			end := bytes.Index(rest[3:], rest[:3])
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += 6
+			}
+			flush("s", i+end)
+
+		case strings.IndexByte(d.raw_quotes, c) >= 0:
+			flush("s", i+string_length(rest, false, true))
+
+		case strings.IndexByte(d.quotes, c) >= 0:
+			end := i + string_length(rest, true, false)
+			class := "s"
+			if d.keys {
+				/* JSON object keys */
+				j := end
+				for j < size && (code[j] == ' ' || code[j] == '\t') {
+					j++
+				}
+				if j < size && code[j] == ':' {
+					class = "nt"
+				}
+			}
+			flush(class, end)
+
+		case d.variables && c == '$' && i+1 < size:
+			end := i + 1
+			if code[end] == '{' {
+				for end < size && code[end] != '}' && code[end] != '\n' {
+					end++
+				}
+				if end < size && code[end] == '}' {
+					end++
+				}
+			} else {
+				for end < size && is_ident_char(code[end], "") {
+					end++
+				}
+				if end == i+1 && end < size && strings.IndexByte("?#@*$!0123456789-", code[end]) >= 0 {
+					end++
+				}
+			}
+			if end > i+1 {
+				flush("nv", end)
+			} else {
+				i++
+			}
+
+		case number_length(rest) > 0 && (i == 0 || !is_ident_char(code[i-1], d.ident_extra)):
+			flush("m", i+number_length(rest))
+
+		case is_ident_char(c, d.ident_extra) && !(c >= '0' && c <= '9'):
+			end := i + 1
+			for end < size && is_ident_char(code[end], d.ident_extra) {
+				end++
+			}
+			w := string(code[i:end])
+			if d.ignore_case {
+				w = strings.ToLower(w)
+			}
+			switch {
+			case d.keywords[w]:
+				flush("k", end)
+			case d.types[w]:
+				flush("kt", end)
+			case d.constants[w]:
+				flush("kc", end)
+			case d.builtins[w]:
+				flush("nb", end)
+			default:
+				i = end
+			}
+
+		default:
+			i++
+		}
+	}
+	i = size
+	flush("", size)
+	return tokens
+}
+
+var lang_go = &lang_def{
+	line_comments:  []string{"//"},
+	block_comments: [][2]string{{"/*", "*/"}},
+	quotes:         `"'`,
+	raw_quotes:     "`",
+	keywords:       words("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var"),
+	types:          words("bool byte complex64 complex128 error float32 float64 int int8 int16 int32 int64 rune string uint uint8 uint16 uint32 uint64 uintptr any"),
+	constants:      words("true false nil iota"),
+	builtins:       words("append cap clear close complex copy delete imag len make max min new panic print println real recover"),
+}
+
+var lang_shell = &lang_def{
+	line_comments: []string{"#"},
+	quotes:        `"`,
+	raw_quotes:    "'",
+	keywords:      words("if then else elif fi case esac for while until do done in function select return break continue local export readonly declare unset shift"),
+	builtins:      words("echo printf read cd pwd exit source eval exec test set trap alias kill wait true false"),
+	ident_extra:   "-",
+	variables:     true,
+}
+
+var lang_json = &lang_def{
+	quotes:    `"`,
+	constants: words("true false null"),
+	keys:      true,
+}
+
+var lang_python = &lang_def{
+	line_comments: []string{"#"},
+	quotes:        `"'`,
+	triple_quotes: true,
+	keywords:      words("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield match case"),
+	constants:     words("True False None"),
+	builtins:      words("abs all any bool bytes callable chr dict dir enumerate filter float format getattr hasattr hash int isinstance issubclass iter len list map max min next object open ord print range repr reversed round set setattr sorted str sum super tuple type zip self"),
+}
+
+var lang_javascript = &lang_def{
+	line_comments:  []string{"//"},
+	block_comments: [][2]string{{"/*", "*/"}},
+	quotes:         `"'`,
+	raw_quotes:     "`",
+	keywords:       words("async await break case catch class const continue debugger default delete do else export extends finally for from function if import in instanceof let new of return static super switch this throw try typeof var void while with yield"),
+	constants:      words("true false null undefined NaN Infinity"),
+	builtins:       words("Array Boolean Date Error JSON Map Math Number Object Promise RegExp Set String Symbol console document window require module"),
+	ident_extra:    "$",
+}
+
+var lang_sql = &lang_def{
+	line_comments:  []string{"--"},
+	block_comments: [][2]string{{"/*", "*/"}},
+	quotes:         `'"`,
+	keywords:       words("select from where and or not insert into values update set delete create table drop alter add column index view join inner left right outer full cross on as group by order having limit offset union all distinct case when then else end is null like in between exists primary key foreign references default unique begin commit rollback transaction with returning"),
+	types:          words("int integer bigint smallint serial decimal numeric real float double boolean char varchar text date time timestamp blob json"),
+	constants:      words("true false"),
+	builtins:       words("count sum avg min max coalesce now lower upper length substr cast"),
+	ignore_case:    true,
+}
+
+/* YAML is highlighted line by line: keys, comments, and scalar values */
+func lex_yaml(code []byte) []Token {
+	var tokens []Token
+	for len(code) > 0 {
+		end := bytes.IndexByte(code, '\n') + 1
+		if end == 0 {
+			end = len(code)
+		}
+		line := code[:end]
+		code = code[end:]
+
+		i := 0
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		tokens = add_token(tokens, "", line[:i])
+		if i+1 < len(line) && line[i] == '-' && line[i+1] == ' ' {
+			tokens = add_token(tokens, "o", line[i:i+1])
+			tokens = add_token(tokens, "", line[i+1:i+2])
+			i += 2
+		}
+		rest := line[i:]
+		switch {
+		case bytes.HasPrefix(rest, []byte("#")):
+			tokens = add_token(tokens, "c", bytes.TrimRight(rest, "\n"))
+			tokens = add_token(tokens, "", rest[len(bytes.TrimRight(rest, "\n")):])
+			continue
+		case bytes.HasPrefix(rest, []byte("---")) || bytes.HasPrefix(rest, []byte("...")):
+			tokens = add_token(tokens, "cp", rest)
+			continue
+		}
+		if colon := bytes.Index(rest, []byte(": ")); colon > 0 && rest[0] != '"' && rest[0] != '\'' {
+			tokens = add_token(tokens, "nt", rest[:colon])
+			tokens = add_token(tokens, "o", rest[colon:colon+1])
+			rest = rest[colon+1:]
+		} else if bytes.HasSuffix(bytes.TrimRight(rest, "\r\n"), []byte(":")) {
+			k := len(bytes.TrimRight(rest, "\r\n")) - 1
+			tokens = add_token(tokens, "nt", rest[:k])
+			tokens = add_token(tokens, "o", rest[k:k+1])
+			rest = rest[k+1:]
+		}
+		for _, t := range lang_yaml_value.lex(rest) {
+			tokens = add_token(tokens, t.Class, t.Text)
+		}
+	}
+	return tokens
+}
+
+var lang_yaml_value = &lang_def{
+	line_comments: []string{" #"},
+	quotes:        `"'`,
+	constants:     words("true false null yes no on off True False Null"),
+}
+
+/* diffs are highlighted by their line prefixes */
+func lex_diff(code []byte) []Token {
+	var tokens []Token
+	for len(code) > 0 {
+		end := bytes.IndexByte(code, '\n') + 1
+		if end == 0 {
+			end = len(code)
+		}
+		line := code[:end]
+		code = code[end:]
+
+		class := ""
+		switch {
+		case bytes.HasPrefix(line, []byte("+++")) || bytes.HasPrefix(line, []byte("---")) ||
+			bytes.HasPrefix(line, []byte("diff ")) || bytes.HasPrefix(line, []byte("index ")):
+			class = "gh"
+		case bytes.HasPrefix(line, []byte("@@")):
+			class = "gu"
+		case bytes.HasPrefix(line, []byte("+")):
+			class = "gi"
+		case bytes.HasPrefix(line, []byte("-")):
+			class = "gd"
+		}
+		text := bytes.TrimRight(line, "\n")
+		tokens = add_token(tokens, class, text)
+		tokens = add_token(tokens, "", line[len(text):])
+	}
+	return tokens
+}
+
+func init() {
+	RegisterLexer(lang_go.lex, "go", "golang")
+	RegisterLexer(lang_shell.lex, "sh", "bash", "shell", "zsh", "console")
+	RegisterLexer(lang_json.lex, "json")
+	RegisterLexer(lex_yaml, "yaml", "yml")
+	RegisterLexer(lang_python.lex, "python", "py", "python3")
+	RegisterLexer(lang_javascript.lex, "javascript", "js", "jsx", "typescript", "ts")
+	RegisterLexer(lang_sql.lex, "sql")
+	RegisterLexer(lex_diff, "diff", "patch")
+}
@@ -3,6 +3,11 @@ package markup
 import (
 	"bytes"
 	"fmt"
+	"html"
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -13,6 +18,15 @@ const (
 	MKDEXT_STRIKETHROUGH     = 1 << 4
 	MKDEXT_LAX_HTML_BLOCKS   = 1 << 5
 	MKDEXT_SPACE_HEADERS     = 1 << 6
+	MKDEXT_ATTRIBUTES        = 1 << 7
+	MKDEXT_WIKI_LINKS        = 1 << 8
+	MKDEXT_EMOJI             = 1 << 9
+	MKDEXT_MENTIONS          = 1 << 10
+	MKDEXT_INCLUDE           = 1 << 11
+	MKDEXT_COMMONMARK        = 1 << 12
+	MKDEXT_DETAILS           = 1 << 13
+	MKDEXT_DIRECTIVES        = 1 << 14
+	MKDEXT_MARKDOWN_IN_HTML  = 1 << 15
 )
 
 const (
@@ -26,6 +40,11 @@ const (
 	HTML_HARD_WRAP        = 1 << 9
 	HTML_GITHUB_BLOCKCODE = 1 << 10
 	HTML_USE_XHTML        = 1 << 11
+	HTML_HIGHLIGHT        = 1 << 12
+	HTML_HIGHLIGHT_INLINE = 1 << 13
+	HTML_FIGURES          = 1 << 14
+	HTML_COMPLETE_PAGE    = 1 << 15
+	HTML_SANITIZE         = 1 << 16
 )
 
 /* list/listitem flags */
@@ -50,37 +69,46 @@ type html_renderopt struct {
 		header_count  int
 		current_level int
 	}
-
-	flags     uint
-	close_tag string
+	figure_count int
+	page         *html_page
+	opts         *HtmlOptions /* nil for the defaults */
+	policy       *HtmlPolicy  /* sanitizes the raw html if not nil */
+
+	flags      uint
+	close_tag  string
+	commonmark bool /* links and code classes written as CommonMark does */
 }
 
 // functions for rendering parsed data
 type mkd_renderer struct {
 	// block level callbacks - NULL skips the block
-	blockcode  		func(*bytes.Buffer, []byte, []byte, interface{})
+	blockcode  		func(*bytes.Buffer, []byte, []byte, *mkd_attrs, interface{})
 	blockquote 		func(*bytes.Buffer, []byte, interface{})
 	blockhtml  		func(*bytes.Buffer, []byte, interface{})
-	header     		func(*bytes.Buffer, []byte, int, interface{})
+	header     		func(*bytes.Buffer, []byte, int, *mkd_attrs, interface{})
 	hrule      		func(*bytes.Buffer, interface{})
-	list       		func(*bytes.Buffer, []byte, int, interface{})
+	list       		func(*bytes.Buffer, []byte, int, int, interface{})
 	listitem   		func(*bytes.Buffer, []byte, int, interface{})
-	paragraph  		func(*bytes.Buffer, []byte, interface{})
+	paragraph  		func(*bytes.Buffer, []byte, *mkd_attrs, interface{})
 	table      		func(*bytes.Buffer, []byte, []byte, interface{})
 	table_row  		func(*bytes.Buffer, []byte, interface{})
 	table_cell 		func(*bytes.Buffer, []byte, int, interface{})
+	figure     		func(*bytes.Buffer, []byte, []byte, *mkd_attrs, interface{})
+	details    		func(*bytes.Buffer, []byte, []byte, bool, *mkd_attrs, interface{})
+	directive  		func(*bytes.Buffer, []byte, []byte, []byte, *mkd_attrs, interface{})
 
 	// span level callbacks - NULL or return 0 prints the span verbatim
 	autolink        func(*bytes.Buffer, []byte, int, interface{}) bool
 	codespan        func(*bytes.Buffer, []byte, interface{}) bool
 	double_emphasis func(*bytes.Buffer, []byte, interface{}) bool
 	emphasis        func(*bytes.Buffer, []byte, interface{}) bool
-	image           func(*bytes.Buffer, []byte, []byte, []byte, interface{}) bool
-	linebreak       func(*bytes.Buffer, interface{}) bool
-	link            func(*bytes.Buffer, []byte, []byte, []byte, interface{}) bool
+	image           func(*bytes.Buffer, []byte, []byte, []byte, *mkd_attrs, interface{}) bool
+	linebreak       func(*bytes.Buffer, []byte, interface{}) bool /* the break as written */
+	link            func(*bytes.Buffer, []byte, []byte, []byte, *mkd_attrs, interface{}) bool
 	raw_html_tag    func(*bytes.Buffer, []byte, interface{}) bool
 	triple_emphasis func(*bytes.Buffer, []byte, interface{}) bool
 	strikethrough   func(*bytes.Buffer, []byte, interface{}) bool
+	emoji           func(*bytes.Buffer, []byte, []byte, []byte, interface{}) bool
 
 	// low level callbacks - NULL copies input directly into the output
 	entity      	func(*bytes.Buffer, []byte, interface{})
@@ -92,6 +120,10 @@ type mkd_renderer struct {
 
 	// user data
 	opaque interface{}
+
+	// markdown source of the element being rendered, filled in by the
+	// parser when non-nil (only renderers writing markdown back need it)
+	source *mkd_source
 }
 
 /*
@@ -124,6 +156,10 @@ func ispunct(c byte) bool {
 	return false
 }
 
+func isalpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
 func isalnum(c byte) bool {
 	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z')
 }
@@ -161,6 +197,61 @@ func attr_escape(ob *bytes.Buffer, src []byte) {
 	ob.Write(src[last:])
 }
 
+/* copies a link, percent-encoding the quotes that would end the attribute */
+func href_escape(ob *bytes.Buffer, link []byte) {
+	ob.Write(bytes.Replace(link, []byte("\""), []byte("%22"), -1))
+}
+
+// attribute names that may be emitted from an attribute list
+var attr_allowlist = map[string]bool{
+	"id":       true,
+	"class":    true,
+	"title":    true,
+	"lang":     true,
+	"dir":      true,
+	"width":    true,
+	"height":   true,
+	"align":    true,
+	"target":   true,
+	"rel":      true,
+	"hreflang": true,
+	"loading":  true,
+	"start":    true,
+}
+
+// writes ' key="value"' for every allowed attribute of the list
+func write_attrs(ob *bytes.Buffer, attrs *mkd_attrs) {
+	if attrs == nil {
+		return
+	}
+	if len(attrs.id) > 0 {
+		ob.WriteString(" id=\"")
+		attr_escape(ob, attrs.id)
+		ob.WriteByte('"')
+	}
+	if len(attrs.classes) > 0 {
+		ob.WriteString(" class=\"")
+		for i, c := range attrs.classes {
+			if i > 0 {
+				ob.WriteByte(' ')
+			}
+			attr_escape(ob, c)
+		}
+		ob.WriteByte('"')
+	}
+	for _, p := range attrs.pairs {
+		key := string(bytes.ToLower(p.key))
+		if !attr_allowlist[key] || key == "id" || key == "class" {
+			continue
+		}
+		ob.WriteByte(' ')
+		ob.WriteString(key)
+		ob.WriteString("=\"")
+		attr_escape(ob, p.value)
+		ob.WriteByte('"')
+	}
+}
+
 func is_html_tag(tag []byte, tagname string) bool {
 	i := 0
 	size := len(tag)
@@ -201,6 +292,83 @@ func is_html_tag(tag []byte, tagname string) bool {
 /********************
  * GENERIC RENDERER *
  ********************/
+/* whether the link leaves the site, going to another host than those of
+ * HtmlOptions.InternalHosts; relative links don't */
+func is_external_link(link []byte, hosts []string) bool {
+	u, err := url.Parse(html.UnescapeString(string(link)))
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if strings.EqualFold(u.Scheme, "mailto") {
+		address := u.Opaque
+		if i := strings.IndexAny(address, "?#"); i >= 0 {
+			address = address[:i]
+		}
+		host = address[strings.LastIndexByte(address, '@')+1:]
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return false
+	}
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		if host == h || (strings.HasPrefix(h, ".") && (host == h[1:] || strings.HasSuffix(host, h))) {
+			return false
+		}
+	}
+	return true
+}
+
+/* the attribute list of a link, with the rel, target and class of the
+ * external links */
+func link_attrs(link []byte, attrs *mkd_attrs, options *html_renderopt) *mkd_attrs {
+	opts := options.opts
+	if opts == nil || (opts.ExternalRel == "" && !opts.ExternalNewTab && opts.ExternalClass == "") {
+		return attrs
+	}
+	if !is_external_link(link, opts.InternalHosts) {
+		return attrs
+	}
+
+	var r mkd_attrs
+	if attrs != nil {
+		r = *attrs
+	}
+	rel := strings.Fields(opts.ExternalRel)
+	r.pairs = nil
+	if attrs != nil {
+		for _, p := range attrs.pairs {
+			switch key := string(bytes.ToLower(p.key)); {
+			case key == "rel":
+				rel = append(strings.Fields(string(p.value)), rel...)
+			case key == "target" && opts.ExternalNewTab:
+			default:
+				r.pairs = append(r.pairs, p)
+			}
+		}
+	}
+	if opts.ExternalNewTab {
+		rel = append(rel, "noopener")
+		r.pairs = append(r.pairs, mkd_attr{[]byte("target"), []byte("_blank")})
+	}
+	if len(rel) > 0 {
+		var values []string
+		seen := make(map[string]bool)
+		for _, value := range rel {
+			if !seen[strings.ToLower(value)] {
+				seen[strings.ToLower(value)] = true
+				values = append(values, value)
+			}
+		}
+		r.pairs = append(r.pairs, mkd_attr{[]byte("rel"), []byte(strings.Join(values, " "))})
+	}
+	if opts.ExternalClass != "" {
+		return r.with_class([]byte(opts.ExternalClass))
+	}
+	return &r
+}
+
 func rndr_autolink(ob *bytes.Buffer, link []byte, typ int, opaque interface{}) bool {
 	defer un(trace("rndr_autolink"))
 	options, _ := opaque.(*html_renderopt)
@@ -219,56 +387,163 @@ func rndr_autolink(ob *bytes.Buffer, link []byte, typ int, opaque interface{}) b
 		ob.WriteString("mailto:")
 	}
 
-	ob.Write(link)
-	ob.WriteString("\">")
-
-	/*
-	 * Pretty printing: if we get an email address as
-	 * an actual URI, e.g. `mailto:foo@bar.com`, we don't
-	 * want to print the `mailto:` prefix
-	 */
-	if bytes.HasPrefix(link, []byte("mailto:")) {
-		attr_escape(ob, link[7:])
+	if options.commonmark {
+		cm_href_escape(ob, link)
 	} else {
-		attr_escape(ob, link)
+		href_escape(ob, link)
+	}
+	ob.WriteByte('"')
+	if typ == MKDA_EMAIL {
+		write_attrs(ob, link_attrs(append([]byte("mailto:"), link...), nil, options))
+	} else {
+		write_attrs(ob, link_attrs(link, nil, options))
 	}
+	ob.WriteByte('>')
+
+	/* the text is the link as written, a mailto: scheme included, as
+	 * GFM and CommonMark have it */
+	attr_escape(ob, link)
 
 	ob.WriteString("</a>")
 	return true
 }
 
-func rndr_blockcode(ob *bytes.Buffer, text []byte, lang []byte, opaque interface{}) {
-	if ob.Len() > 0 {
-		ob.WriteByte('\n')
+/* fenced code attributes that are rendered rather than copied */
+var code_block_keys = map[string]bool{"title": true, "linenos": true, "linenostart": true, "hl_lines": true}
+
+/* returns the attribute list without the keys in code_block_keys */
+func code_block_attrs(attrs *mkd_attrs) *mkd_attrs {
+	r := *attrs
+	r.pairs = nil
+	for _, p := range attrs.pairs {
+		if !code_block_keys[string(p.key)] {
+			r.pairs = append(r.pairs, p)
+		}
 	}
+	return &r
+}
 
-	if len(lang) > 0 {
-		ob.WriteString("<pre><code class=\"")
+/* writes the title caption of a code block, if any */
+func code_block_title(ob *bytes.Buffer, attrs *mkd_attrs) bool {
+	title, ok := attrs.get("title")
+	if !ok {
+		return false
+	}
+	ob.WriteString("<div class=\"code-block\">\n<div class=\"code-title\">")
+	attr_escape(ob, title)
+	ob.WriteString("</div>\n")
+	return true
+}
 
-		i := 0
-		cls := 0
-		for i < len(lang) {
-			i++
-			cls++
-			for i < len(lang) && isspace(lang[i]) {
-				i++
-			}
+/* returns the language of a code block, which is the first class for {.python} */
+func code_lang(lang []byte, attrs *mkd_attrs) []byte {
+	if len(lang) == 0 && attrs != nil && len(attrs.classes) > 0 {
+		return attrs.classes[0]
+	}
+	if f := bytes.Fields(lang); len(f) > 0 {
+		return bytes.TrimPrefix(f[0], []byte("."))
+	}
+	return nil
+}
+
+/*
+ * writes the code of a block, highlighted with HTML_HIGHLIGHT when there
+ * is a lexer for the language; with the linenos and hl_lines attributes
+ * every line gets wrapped into a span:
+ *
+ *		<span class="line hll"><span class="ln">3</span>...</span>
+ */
+func write_code_lines(ob *bytes.Buffer, text []byte, lang []byte, attrs *mkd_attrs, options *html_renderopt) {
+	tokens := []Token{{"", text}}
+	if options.flags&(HTML_HIGHLIGHT|HTML_HIGHLIGHT_INLINE) != 0 {
+		if lx := find_lexer(code_lang(lang, attrs)); lx != nil {
+			tokens = lx(text)
+		}
+	}
+	inline := options.flags&HTML_HIGHLIGHT_INLINE != 0
+
+	_, linenos := attrs.get("linenos")
+	spec, _ := attrs.get("hl_lines")
+	hl_lines := parse_line_ranges(spec)
+	if !linenos && len(hl_lines) == 0 {
+		write_tokens(ob, tokens, inline)
+		return
+	}
+
+	start := 1
+	if v, ok := attrs.get("linenostart"); ok {
+		if n, err := strconv.Atoi(string(v)); err == nil {
+			start = n
+		}
+	}
+
+	for i, line := range token_lines(tokens) {
+		n := i + 1
+		ob.WriteString("<span class=\"line")
+		if hl_lines.has(n) {
+			ob.WriteString(" hll")
+		}
+		ob.WriteString("\">")
+		if linenos {
+			ob.WriteString("<span class=\"ln\">")
+			ob.WriteString(strconv.Itoa(start + n - 1))
+			ob.WriteString("</span>")
+		}
+		nl := len(line) > 0 && line[len(line)-1].Text[0] == '\n'
+		if nl {
+			line = line[:len(line)-1]
+		}
+		write_tokens(ob, line, inline)
+		ob.WriteString("</span>")
+		if nl {
+			ob.WriteByte('\n')
+		}
+	}
+}
 
-			if i < len(lang) {
-				org := i
-				for i < len(lang) && !isspace(lang[i]) {
-					i++
-				}
+/* the blank line between two blocks. The CommonMark renderer only starts
+ * a block on a line of its own: in the <pre> of an html block, the blank
+ * line would show. */
+func html_block_sep(ob *bytes.Buffer, opaque interface{}) {
+	options, _ := opaque.(*html_renderopt)
+	if ob.Len() == 0 {
+		return
+	}
+	if !options.commonmark || ob.Bytes()[ob.Len()-1] != '\n' {
+		ob.WriteByte('\n')
+	}
+}
 
-				if lang[org] == '.' {
-					org++
-				}
+func rndr_blockcode(ob *bytes.Buffer, text []byte, lang []byte, attrs *mkd_attrs, opaque interface{}) {
+	options, _ := opaque.(*html_renderopt)
+	html_block_sep(ob, opaque)
+
+	has_title := code_block_title(ob, attrs)
+
+	class := lang
+	if options.commonmark && len(lang) > 0 {
+		/* CommonMark: <code class="language-go"> */
+		class = append([]byte("language-"), lang...)
+	}
 
-				if cls > 0 {
-					ob.WriteByte(' ')
-				}
-				attr_escape(ob, lang[org:])
+	if attrs != nil {
+		attrs := code_block_attrs(attrs)
+		if len(class) > 0 {
+			attrs = attrs.with_class(class)
+		}
+		ob.WriteString("<pre><code")
+		write_attrs(ob, attrs)
+		ob.WriteString(">")
+	} else if len(class) > 0 {
+		ob.WriteString("<pre><code class=\"")
+		for cls, c := range bytes.Fields(class) {
+			if c[0] == '.' {
+				c = c[1:]
 			}
+			if cls > 0 {
+				ob.WriteByte(' ')
+			}
+			attr_escape(ob, c)
 		}
 		ob.WriteString("\">")
 	} else {
@@ -276,9 +551,12 @@ func rndr_blockcode(ob *bytes.Buffer, text []byte, lang []byte, opaque interface
 	}
 
 	if len(text) > 0 {
-		attr_escape(ob, text)
+		write_code_lines(ob, text, lang, attrs, options)
 	}
 	ob.WriteString("</code></pre>\n")
+	if has_title {
+		ob.WriteString("</div>\n")
+	}
 }
 
 /*
@@ -291,20 +569,28 @@ func rndr_blockcode(ob *bytes.Buffer, text []byte, lang []byte, opaque interface
  * Unlike other parsers, we store the language identifier in the <pre>,
  * and don't let the user generate custom classes.
  *
- * The language identifier in the <pre> block gets postprocessed and all
- * the code inside gets syntax highlighted with Pygments. This is much safer
- * than letting the user specify a CSS class for highlighting.
+ * The code inside gets syntax highlighted with HTML_HIGHLIGHT, or the
+ * language identifier in the <pre> block can be used to postprocess it,
+ * e.g. with Pygments. This is much safer than letting the user specify a
+ * CSS class for highlighting.
  *
  * Note that we only generate HTML for the first specifier.
  * E.g.
  *		~~~~ {.python .numbered}	=>	<pre lang="python"><code>
  */
-func rndr_blockcode_github(ob *bytes.Buffer, text []byte, lang []byte, opaque interface{}) {
+func rndr_blockcode_github(ob *bytes.Buffer, text []byte, lang []byte, attrs *mkd_attrs, opaque interface{}) {
 	defer un(trace("rndr_blockcode_github"))
-	if ob.Len() > 0 {
-		ob.WriteByte('\n')
+	options, _ := opaque.(*html_renderopt)
+	html_block_sep(ob, opaque)
+
+	/* {.python .numbered}: the first class is the language, the
+	 * rest of the attribute list is dropped like other specifiers */
+	if len(lang) == 0 && attrs != nil && len(attrs.classes) > 0 {
+		lang = attrs.classes[0]
 	}
 
+	has_title := code_block_title(ob, attrs)
+
 	if len(lang) > 0 {
 		i := 0
 		ob.WriteString("<pre lang=\"")
@@ -326,10 +612,13 @@ func rndr_blockcode_github(ob *bytes.Buffer, text []byte, lang []byte, opaque in
 		ob.WriteString("<pre><code>")
 	}
 	if len(text) > 0 {
-		attr_escape(ob, text)
+		write_code_lines(ob, text, lang, attrs, options)
 	}
 
 	ob.WriteString("</code></pre>\n")
+	if has_title {
+		ob.WriteString("</div>\n")
+	}
 }
 
 func rndr_blockquote(ob *bytes.Buffer, text []byte, opaque interface{}) {
@@ -380,25 +669,90 @@ func rndr_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
 	return true
 }
 
-func rndr_header(ob *bytes.Buffer, text []byte, level int, opaque interface{}) {
+func rndr_header(ob *bytes.Buffer, text []byte, level int, attrs *mkd_attrs, opaque interface{}) {
 	defer un(trace("rndr_header"))
 	options, _ := opaque.(*html_renderopt)
 
-	if ob.Len() > 0 {
-		ob.WriteByte('\n')
-	}
+	html_block_sep(ob, opaque)
 
-	if options.flags&HTML_TOC != 0 {
-		ob.WriteString(fmt.Sprintf("<h%d id=\"toc_%d\">", level, options.toc_data.header_count))
+	if options.flags&HTML_TOC != 0 && (attrs == nil || attrs.id == nil) {
+		ob.WriteString(fmt.Sprintf("<h%d id=\"toc_%d\"", level, options.toc_data.header_count))
 		options.toc_data.header_count++
 	} else {
-		ob.WriteString(fmt.Sprintf("<h%d>", level))
+		ob.WriteString(fmt.Sprintf("<h%d", level))
 	}
+	write_attrs(ob, attrs)
+	ob.WriteByte('>')
 	ob.Write(text)
 	ob.WriteString(fmt.Sprintf("</h%d>\n", level))
+
+	if options.page != nil {
+		html_page_header(options.page, text, level, attrs)
+	}
+}
+
+/* numbered figure: the rendered image and its caption */
+func rndr_figure(ob *bytes.Buffer, image []byte, caption []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("rndr_figure"))
+	options, _ := opaque.(*html_renderopt)
+
+	html_block_sep(ob, opaque)
+
+	options.figure_count++
+	if attrs == nil || attrs.id == nil {
+		ob.WriteString(fmt.Sprintf("<figure id=\"fig_%d\"", options.figure_count))
+	} else {
+		ob.WriteString("<figure")
+	}
+	write_attrs(ob, attrs)
+	ob.WriteString(">\n")
+	ob.Write(image)
+	ensure_ends_with_nl(ob)
+	ob.WriteString(fmt.Sprintf("<figcaption><span class=\"figure-number\">Figure %d.</span>", options.figure_count))
+	if len(caption) > 0 {
+		ob.WriteByte(' ')
+		ob.Write(caption)
+	}
+	ob.WriteString("</figcaption>\n</figure>\n")
+}
+
+func rndr_details(ob *bytes.Buffer, summary []byte, text []byte, open bool, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("rndr_details"))
+	html_block_sep(ob, opaque)
+	ob.WriteString("<details")
+	write_attrs(ob, attrs)
+	if open {
+		ob.WriteString(" open")
+	}
+	ob.WriteString(">\n<summary>")
+	ob.Write(summary)
+	ob.WriteString("</summary>\n")
+	ob.Write(text)
+	ensure_ends_with_nl(ob)
+	ob.WriteString("</details>\n")
 }
 
-func rndr_link(ob *bytes.Buffer, link []byte, title []byte, content []byte, opaque interface{}) bool {
+/* fallback for directives without a handler */
+func rndr_directive(ob *bytes.Buffer, name []byte, title []byte, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("rndr_directive"))
+	html_block_sep(ob, opaque)
+	if len(name) > 0 {
+		attrs = attrs.with_class(name)
+	}
+	ob.WriteString("<div")
+	write_attrs(ob, attrs)
+	ob.WriteString(">\n")
+	if len(title) > 0 {
+		ob.WriteString("<p class=\"directive-title\">")
+		ob.Write(title)
+		ob.WriteString("</p>\n")
+	}
+	ob.Write(text)
+	ensure_ends_with_nl(ob)
+	ob.WriteString("</div>\n")
+}
+
+func rndr_link(ob *bytes.Buffer, link []byte, title []byte, content []byte, attrs *mkd_attrs, opaque interface{}) bool {
 	defer un(trace("rndr_link"))
 	options, _ := opaque.(*html_renderopt)
 
@@ -407,24 +761,30 @@ func rndr_link(ob *bytes.Buffer, link []byte, title []byte, content []byte, opaq
 	}
 
 	ob.WriteString("<a href=\"")
-	ob.Write(link)
+	if options.commonmark {
+		cm_href_escape(ob, link)
+	} else {
+		ob.Write(link)
+	}
 	if len(title) > 0 {
 		ob.WriteString("\" title=\"")
 		attr_escape(ob, title)
 	}
-	ob.WriteString("\">")
+	ob.WriteByte('"')
+	write_attrs(ob, link_attrs(link, attrs, options))
+	ob.WriteString(">")
 	ob.Write(content)
 	ob.WriteString("</a>")
 	return true
 }
 
-func rndr_list(ob *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+func rndr_list(ob *bytes.Buffer, text []byte, flags, start int, opaque interface{}) {
 	defer un(trace("rndr_list"))
-	if ob.Len() > 0 {
-		ob.WriteByte('\n')
-	}
+	html_block_sep(ob, opaque)
 
-	if flags&MKD_LIST_ORDERED != 0 {
+	if flags&MKD_LIST_ORDERED != 0 && start != 1 {
+		ob.WriteString("<ol start=\"" + strconv.Itoa(start) + "\">\n")
+	} else if flags&MKD_LIST_ORDERED != 0 {
 		ob.WriteString("<ol>\n")
 	} else {
 		ob.WriteString("<ul>\n")
@@ -448,15 +808,13 @@ func rndr_listitem(ob *bytes.Buffer, text []byte, flags int, opaque interface{})
 	ob.WriteString("</li>\n")
 }
 
-func rndr_paragraph(ob *bytes.Buffer, text []byte, opaque interface{}) {
+func rndr_paragraph(ob *bytes.Buffer, text []byte, attrs *mkd_attrs, opaque interface{}) {
 	defer un(trace("rndr_paragraph"))
 	options, _ := opaque.(*html_renderopt)
 
 	i := 0
 
-	if ob.Len() > 0 {
-		ob.WriteByte('\n')
-	}
+	html_block_sep(ob, opaque)
 
 	if len(text) == 0 {
 		return
@@ -471,7 +829,9 @@ func rndr_paragraph(ob *bytes.Buffer, text []byte, opaque interface{}) {
 		return
 	}
 
-	ob.WriteString("<p>")
+	ob.WriteString("<p")
+	write_attrs(ob, attrs)
+	ob.WriteByte('>')
 	if options.flags&HTML_HARD_WRAP != 0 {
 		for i < size {
 			org := i
@@ -499,6 +859,11 @@ func rndr_paragraph(ob *bytes.Buffer, text []byte, opaque interface{}) {
 
 func rndr_raw_block(ob *bytes.Buffer, text []byte, opaque interface{}) {
 	defer un(trace("rndr_raw_block"))
+	if options, _ := opaque.(*html_renderopt); options.policy != nil {
+		var clean bytes.Buffer
+		sanitize_html(&clean, text, options, true)
+		text = bytes.TrimSpace(clean.Bytes())
+	}
 	sz := len(text)
 	for sz > 0 && text[sz-1] == '\n' {
 		sz -= 1
@@ -507,9 +872,7 @@ func rndr_raw_block(ob *bytes.Buffer, text []byte, opaque interface{}) {
 	for ; org < sz && text[org] == '\n'; org++ {
 	}
 	if org < sz {
-		if ob.Len() > 0 {
-			ob.WriteByte('\n')
-		}
+		html_block_sep(ob, opaque)
 		ob.Write(text[org:sz])
 		ob.WriteByte('\n')
 	}
@@ -530,22 +893,24 @@ func rndr_hrule(ob *bytes.Buffer, opaque interface{}) {
 	defer un(trace("rndr_hrule"))
 	options, _ := opaque.(*html_renderopt)
 
-	if ob.Len() > 0 {
-		ob.WriteByte('\n')
-	}
+	html_block_sep(ob, opaque)
 
 	ob.WriteString("<hr")
 	ob.WriteString(options.close_tag)
 }
 
-func rndr_image(ob *bytes.Buffer, link []byte, title []byte, alt []byte, opaque interface{}) bool {
+func rndr_image(ob *bytes.Buffer, link []byte, title []byte, alt []byte, attrs *mkd_attrs, opaque interface{}) bool {
 	defer un(trace("rndr_image"))
 	options, _ := opaque.(*html_renderopt)
-	if len(link) == 0 {
+	if options.commonmark {
+		ob.WriteString("<img src=\"")
+		cm_href_escape(ob, link)
+	} else if len(link) == 0 {
 		return false
+	} else {
+		ob.WriteString("<img src=\"")
+		attr_escape(ob, link)
 	}
-	ob.WriteString("<img src=\"")
-	attr_escape(ob, link)
 	ob.WriteString("\" alt=\"")
 	attr_escape(ob, alt)
 	if len(title) > 0 {
@@ -554,11 +919,37 @@ func rndr_image(ob *bytes.Buffer, link []byte, title []byte, alt []byte, opaque
 	}
 
 	ob.WriteByte('"')
-	ob.WriteString(options.close_tag)
+	write_attrs(ob, attrs)
+	if options.commonmark {
+		/* no line break after an inline image */
+		ob.WriteString(strings.TrimSuffix(options.close_tag, "\n"))
+	} else {
+		ob.WriteString(options.close_tag)
+	}
 	return true
 }
 
-func rndr_linebreak(ob *bytes.Buffer, opaque interface{}) bool {
+func rndr_emoji(ob *bytes.Buffer, name []byte, glyph []byte, image []byte, opaque interface{}) bool {
+	defer un(trace("rndr_emoji"))
+	options, _ := opaque.(*html_renderopt)
+
+	if len(image) > 0 {
+		ob.WriteString("<img class=\"emoji\" src=\"")
+		attr_escape(ob, image)
+		ob.WriteString("\" alt=\":")
+		attr_escape(ob, name)
+		ob.WriteString(":\" title=\":")
+		attr_escape(ob, name)
+		ob.WriteString(":\"")
+		ob.WriteString(options.close_tag)
+		return true
+	}
+
+	attr_escape(ob, glyph)
+	return true
+}
+
+func rndr_linebreak(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
 	defer un(trace("rndr_linebreak"))
 	options, _ := opaque.(*html_renderopt)
 	ob.WriteString("<br")
@@ -586,15 +977,18 @@ func rndr_raw_html(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
 		return true
 	}
 
+	if options.policy != nil {
+		sanitize_html(ob, text, options, false)
+		return true
+	}
+
 	ob.Write(text)
 	return true
 }
 
 func rndr_table(ob *bytes.Buffer, header []byte, body []byte, opaque interface{}) {
 	defer un(trace("rndr_table"))
-	if ob.Len() > 0 {
-		ob.WriteByte('\n')
-	}
+	html_block_sep(ob, opaque)
 	ob.WriteString("<table><thead>\n")
 	ob.Write(header)
 	ob.WriteString("\n</thead><tbody>\n")
@@ -640,7 +1034,13 @@ func rndr_normal_text(ob *bytes.Buffer, text []byte, opaque interface{}) {
 	attr_escape(ob, text)
 }
 
-func toc_header(ob *bytes.Buffer, text []byte, level int, opaque interface{}) {
+/* CommonMark writes the characters of the entities */
+func rndr_entity(ob *bytes.Buffer, entity []byte, opaque interface{}) {
+	defer un(trace("rndr_entity"))
+	attr_escape(ob, []byte(html.UnescapeString(string(entity))))
+}
+
+func toc_header(ob *bytes.Buffer, text []byte, level int, attrs *mkd_attrs, opaque interface{}) {
 	defer un(trace("toc_header"))
 	options, _ := opaque.(*html_renderopt)
 
@@ -660,8 +1060,14 @@ func toc_header(ob *bytes.Buffer, text []byte, level int, opaque interface{}) {
 		options.toc_data.current_level--
 	}
 
-	ob.WriteString(fmt.Sprintf("<li><a href=\"#toc_%d\">", options.toc_data.header_count))
-	options.toc_data.header_count++
+	if attrs != nil && attrs.id != nil {
+		ob.WriteString("<li><a href=\"#")
+		attr_escape(ob, attrs.id)
+		ob.WriteString("\">")
+	} else {
+		ob.WriteString(fmt.Sprintf("<li><a href=\"#toc_%d\">", options.toc_data.header_count))
+		options.toc_data.header_count++
+	}
 	ob.Write(text)
 	ob.WriteString("</a></li>\n")
 }
@@ -694,6 +1100,9 @@ func upshtml_renderer(render_flags uint) *mkd_renderer {
 		rndr_table,
 		rndr_tablerow,
 		rndr_tablecell,
+		nil,
+		rndr_details,
+		rndr_directive,
 
 		rndr_autolink,
 		rndr_codespan,
@@ -705,10 +1114,12 @@ func upshtml_renderer(render_flags uint) *mkd_renderer {
 		rndr_raw_html,
 		rndr_triple_emphasis,
 		rndr_strikethrough,
+		rndr_emoji,
 
 		nil,
 		rndr_normal_text,
 
+		nil,
 		nil,
 		nil,
 		nil}
@@ -738,5 +1149,93 @@ func upshtml_renderer(render_flags uint) *mkd_renderer {
 		renderer.blockcode = rndr_blockcode_github
 	}
 
+	if render_flags&HTML_FIGURES != 0 {
+		renderer.figure = rndr_figure
+	}
+
+	if render_flags&HTML_COMPLETE_PAGE != 0 {
+		opts.page = &html_page{}
+		renderer.doc_footer = rndr_page
+	}
+
+	if render_flags&HTML_SANITIZE != 0 {
+		opts.policy = UGCPolicy()
+		renderer.doc_footer = rndr_sanitized_footer
+	}
+
+	return renderer
+}
+
+// HtmlOptions are the settings of the HTML renderer, for
+// MarkdownToHtmlPage and Node.Render: those MarkdownToHtmlConfig takes
+// as arguments, and those of a complete page (HTML_COMPLETE_PAGE).
+type HtmlOptions struct {
+	// Flags is a combination of the HTML_* flags.
+	Flags uint
+
+	// Extensions are the MKDEXT_* flags of the parser.
+	Extensions uint
+
+	// Config holds the additional parser settings, it may be nil.
+	Config *Config
+
+	// Lang is the language of the page, the lang of the front matter
+	// or "en" if empty.
+	Lang string
+
+	// Title is the title of the page. If empty, it is the title of the
+	// front matter or the text of the first level 1 header.
+	Title string
+
+	// Stylesheet is the url of a stylesheet the page links to.
+	Stylesheet string
+
+	// CSS is a stylesheet embedded in the page. It is trusted, not
+	// escaped.
+	CSS string
+
+	// Template writes the page, executed with an HtmlPage. The default
+	// one is used when it is nil.
+	Template *template.Template
+
+	// InternalHosts are the hosts of the site, "example.com", or
+	// ".example.com" for the domain and its subdomains. The links to
+	// other hosts, email addresses included, are external and get the
+	// settings below.
+	InternalHosts []string
+
+	// ExternalRel is the rel of the external links, such as
+	// "nofollow noopener ugc".
+	ExternalRel string
+
+	// ExternalNewTab opens the external links in a new tab, with
+	// target="_blank" and a rel of noopener.
+	ExternalNewTab bool
+
+	// ExternalClass is a class of the external links, for an icon.
+	ExternalClass string
+
+	// Policy sanitizes the raw html, instead of the UGCPolicy of
+	// HTML_SANITIZE. The raw html is kept as it is when both are unset.
+	Policy *HtmlPolicy
+}
+
+/* the html renderer with the settings of opts */
+func html_renderer(opts *HtmlOptions) *mkd_renderer {
+	renderer := upshtml_renderer(opts.Flags)
+	options, _ := renderer.opaque.(*html_renderopt)
+	options.opts = opts
+	if opts.Extensions&MKDEXT_COMMONMARK != 0 {
+		options.commonmark = true
+		renderer.entity = rndr_entity
+	}
+	if opts.Policy != nil {
+		options.policy = opts.Policy
+		renderer.doc_footer = rndr_sanitized_footer
+	}
 	return renderer
 }
+
+func (opts *HtmlOptions) renderer() (*mkd_renderer, *Config) {
+	return html_renderer(opts), opts.Config
+}
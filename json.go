@@ -0,0 +1,890 @@
+package markup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+/*
+ * JSON export of the document tree, and the way back.
+ *
+ * The callbacks build a tree of Nodes: each one stores its node and writes
+ * a reference to it, json_node, the index and json_node again, so that
+ * the parent finds its children in the text it gets. The text between
+ * the references becomes text nodes. doc_footer replaces the output by
+ * the JSON of the document.
+ *
+ * Node.Render walks a tree, parsed or loaded from JSON, calling the
+ * callbacks of any renderer the way the parser does.
+ *
+ * Schema, version 1. Every node is an object with "type", "attributes"
+ * and "children"; the attributes absent from a node are left out.
+ *
+ *   document         the root, it also has "version"
+ *   paragraph        id, classes, pairs
+ *   header           level, id, classes, pairs
+ *   blockquote
+ *   code_block       literal, lang (the info string), id, classes, pairs
+ *   html_block       literal; or, with markdown="span" inside, html
+ *                    children for the html between the inlines
+ *   hrule
+ *   list             ordered, start (of an ordered list, if not 1)
+ *   list_item        ordered, block (the item is made of blocks)
+ *   table            a table_head and a table_body
+ *   table_head       table_row children
+ *   table_body       table_row children
+ *   table_row        table_cell children
+ *   table_cell       align ("left", "right" or "center")
+ *   figure           id, classes, pairs; the image, then a caption
+ *   caption
+ *   details          open, id, classes, pairs; a summary, then the blocks
+ *   summary
+ *   directive        name, id, classes, pairs; a title, then the blocks
+ *   title
+ *   text             literal
+ *   entity           literal, the entity as written ("&amp;")
+ *   code             literal
+ *   html             literal
+ *   emphasis
+ *   strong
+ *   strong_emphasis
+ *   strikethrough
+ *   link             href, title, id, classes, pairs
+ *   image            href, title, alt, id, classes, pairs
+ *   autolink         href, email; the text shown
+ *   linebreak        literal, the break as written ("  \n" or "\\\n")
+ *   emoji            name, glyph, image
+ *
+ * New node types and attributes may be added within a version; a change
+ * of the meaning of the existing ones makes a new version.
+ */
+
+/* JSON options */
+const (
+	JSON_INDENT  = 1 << 0 /* one attribute or child per line, indented */
+	JSON_FIGURES = 1 << 1 /* figure nodes for the paragraphs made of an image, like HTML_FIGURES */
+)
+
+// JsonSchemaVersion is the version of the JSON written by MarkdownToJson.
+const JsonSchemaVersion = 1
+
+/* marks a reference to a node in the intermediate output */
+const json_node = '\x1a'
+
+// Node is a node of the document tree: its type, attributes and
+// children, see the schema in json.go.
+type Node struct {
+	Version    int            `json:"version,omitempty"`
+	Type       string         `json:"type"`
+	Attributes NodeAttributes `json:"attributes"`
+	Children   []*Node        `json:"children"`
+}
+
+// NodeAttributes are the attributes of a Node, each used by some of the
+// node types.
+type NodeAttributes struct {
+	Level   int         `json:"level,omitempty"`
+	Ordered bool        `json:"ordered,omitempty"`
+	Start   *int        `json:"start,omitempty"`
+	Block   bool        `json:"block,omitempty"`
+	Lang    string      `json:"lang,omitempty"`
+	Align   string      `json:"align,omitempty"`
+	Href    string      `json:"href,omitempty"`
+	Title   string      `json:"title,omitempty"`
+	Alt     string      `json:"alt,omitempty"`
+	Email   bool        `json:"email,omitempty"`
+	Open    bool        `json:"open,omitempty"`
+	Name    string      `json:"name,omitempty"`
+	Glyph   string      `json:"glyph,omitempty"`
+	Image   string      `json:"image,omitempty"`
+	Literal string      `json:"literal,omitempty"`
+	Id      string      `json:"id,omitempty"`
+	Classes []string    `json:"classes,omitempty"`
+	Pairs   [][2]string `json:"pairs,omitempty"`
+}
+
+// JsonOptions are the settings of MarkdownToJson.
+type JsonOptions struct {
+	// Flags is a combination of the JSON_* flags.
+	Flags uint
+
+	// Extensions are the MKDEXT_* flags of the parser.
+	Extensions uint
+
+	// Config holds the additional parser settings, it may be nil.
+	Config *Config
+}
+
+// Renderer is the options of one of the renderers, *HtmlOptions,
+// *TextOptions, *MarkdownOptions, *LatexOptions, *ManOptions,
+// *AnsiOptions or *JsonOptions, for Node.Render.
+type Renderer interface {
+	renderer() (*mkd_renderer, *Config)
+}
+
+type json_renderopt struct {
+	flags uint
+	nodes []*Node
+}
+
+var json_alignments = map[int]string{
+	MKD_TABLE_ALIGN_L:      "left",
+	MKD_TABLE_ALIGN_R:      "right",
+	MKD_TABLE_ALIGN_CENTER: "center",
+}
+
+/* a node of the type, with no children yet */
+func json_new(typ string) *Node {
+	return &Node{Type: typ, Children: []*Node{}}
+}
+
+/* stores the node and writes its reference */
+func json_ref(ob *bytes.Buffer, opaque interface{}, node *Node) {
+	options, _ := opaque.(*json_renderopt)
+	ob.WriteByte(json_node)
+	ob.WriteString(strconv.Itoa(len(options.nodes)))
+	ob.WriteByte(json_node)
+	options.nodes = append(options.nodes, node)
+}
+
+/* appends text to the children, joined to a text node before it */
+func json_text(children []*Node, text string) []*Node {
+	if n := len(children); n > 0 && children[n-1].Type == "text" {
+		children[n-1].Attributes.Literal += text
+		return children
+	}
+	node := json_new("text")
+	node.Attributes.Literal = text
+	return append(children, node)
+}
+
+/* the nodes referenced in text, the text around them becoming text nodes;
+ * between blocks, the line ends are dropped */
+func json_children(opaque interface{}, text []byte, blocks bool) []*Node {
+	children := []*Node{}
+	json_split(opaque, text, func(run []byte, node *Node) {
+		if node != nil {
+			children = append(children, node)
+		} else if !blocks || len(bytes.TrimSpace(run)) > 0 {
+			children = json_text(children, string(run))
+		}
+	})
+	return children
+}
+
+/* calls found with the runs of text and the nodes referenced between them */
+func json_split(opaque interface{}, text []byte, found func(run []byte, node *Node)) {
+	options, _ := opaque.(*json_renderopt)
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, json_node)
+		if i < 0 {
+			i = len(text)
+		}
+		if i > 0 {
+			found(text[:i], nil)
+		}
+		if i == len(text) {
+			break
+		}
+		text = text[i+1:]
+		end := bytes.IndexByte(text, json_node)
+		if end < 0 {
+			break
+		}
+		idx, err := strconv.Atoi(string(text[:end]))
+		if err == nil && idx < len(options.nodes) {
+			found(nil, options.nodes[idx])
+		}
+		text = text[end+1:]
+	}
+}
+
+/* copies the attribute list to the attributes of the node */
+func json_attrs(node *Node, attrs *mkd_attrs) {
+	if attrs == nil {
+		return
+	}
+	node.Attributes.Id = string(attrs.id)
+	for _, class := range attrs.classes {
+		node.Attributes.Classes = append(node.Attributes.Classes, string(class))
+	}
+	for _, pair := range attrs.pairs {
+		node.Attributes.Pairs = append(node.Attributes.Pairs, [2]string{string(pair.key), string(pair.value)})
+	}
+}
+
+/* the attribute list of the node, nil when it has none */
+func node_attrs(node *Node) *mkd_attrs {
+	a := &node.Attributes
+	if a.Id == "" && len(a.Classes) == 0 && len(a.Pairs) == 0 {
+		return nil
+	}
+	attrs := &mkd_attrs{}
+	if a.Id != "" {
+		attrs.id = []byte(a.Id)
+	}
+	for _, class := range a.Classes {
+		attrs.classes = append(attrs.classes, []byte(class))
+	}
+	for _, pair := range a.Pairs {
+		attrs.pairs = append(attrs.pairs, mkd_attr{[]byte(pair[0]), []byte(pair[1])})
+	}
+	return attrs
+}
+
+func json_blockcode(ob *bytes.Buffer, text []byte, lang []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("json_blockcode"))
+	node := json_new("code_block")
+	node.Attributes.Literal = string(text)
+	node.Attributes.Lang = string(lang)
+	json_attrs(node, attrs)
+	json_ref(ob, opaque, node)
+}
+
+func json_blockquote(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("json_blockquote"))
+	node := json_new("blockquote")
+	node.Children = json_children(opaque, text, true)
+	json_ref(ob, opaque, node)
+}
+
+/* the html around the markdown of markdown="span" blocks becomes html
+ * children */
+func json_raw_block(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("json_raw_block"))
+	node := json_new("html_block")
+	if bytes.IndexByte(text, json_node) < 0 {
+		node.Attributes.Literal = string(text)
+	} else {
+		json_split(opaque, text, func(run []byte, child *Node) {
+			if child == nil && len(run) == 0 {
+				return
+			}
+			if child == nil {
+				child = json_new("html")
+				child.Attributes.Literal = string(run)
+			}
+			node.Children = append(node.Children, child)
+		})
+	}
+	json_ref(ob, opaque, node)
+}
+
+func json_header(ob *bytes.Buffer, text []byte, level int, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("json_header"))
+	node := json_new("header")
+	node.Attributes.Level = level
+	json_attrs(node, attrs)
+	node.Children = json_children(opaque, text, false)
+	json_ref(ob, opaque, node)
+}
+
+func json_hrule(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("json_hrule"))
+	json_ref(ob, opaque, json_new("hrule"))
+}
+
+func json_list(ob *bytes.Buffer, text []byte, flags, start int, opaque interface{}) {
+	defer un(trace("json_list"))
+	node := json_new("list")
+	node.Attributes.Ordered = flags&MKD_LIST_ORDERED != 0
+	if node.Attributes.Ordered && start != 1 {
+		node.Attributes.Start = &start
+	}
+	node.Children = json_children(opaque, text, true)
+	json_ref(ob, opaque, node)
+}
+
+func json_listitem(ob *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+	defer un(trace("json_listitem"))
+	node := json_new("list_item")
+	node.Attributes.Ordered = flags&MKD_LIST_ORDERED != 0
+	node.Attributes.Block = flags&MKD_LI_BLOCK != 0
+	node.Children = json_children(opaque, text, node.Attributes.Block)
+	json_ref(ob, opaque, node)
+}
+
+func json_paragraph(ob *bytes.Buffer, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("json_paragraph"))
+	node := json_new("paragraph")
+	json_attrs(node, attrs)
+	node.Children = json_children(opaque, text, false)
+	json_ref(ob, opaque, node)
+}
+
+func json_table(ob *bytes.Buffer, header []byte, body []byte, opaque interface{}) {
+	defer un(trace("json_table"))
+	node := json_new("table")
+	head, rows := json_new("table_head"), json_new("table_body")
+	head.Children = json_children(opaque, header, true)
+	rows.Children = json_children(opaque, body, true)
+	node.Children = []*Node{head, rows}
+	json_ref(ob, opaque, node)
+}
+
+func json_tablerow(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("json_tablerow"))
+	node := json_new("table_row")
+	node.Children = json_children(opaque, text, true)
+	json_ref(ob, opaque, node)
+}
+
+func json_tablecell(ob *bytes.Buffer, text []byte, align int, opaque interface{}) {
+	defer un(trace("json_tablecell"))
+	node := json_new("table_cell")
+	node.Attributes.Align = json_alignments[align]
+	node.Children = json_children(opaque, text, false)
+	json_ref(ob, opaque, node)
+}
+
+func json_figure(ob *bytes.Buffer, image []byte, caption []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("json_figure"))
+	node := json_new("figure")
+	json_attrs(node, attrs)
+	node.Children = json_children(opaque, image, false)
+	caption_node := json_new("caption")
+	caption_node.Children = json_children(opaque, caption, false)
+	node.Children = append(node.Children, caption_node)
+	json_ref(ob, opaque, node)
+}
+
+func json_details(ob *bytes.Buffer, summary []byte, text []byte, open bool, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("json_details"))
+	node := json_new("details")
+	node.Attributes.Open = open
+	json_attrs(node, attrs)
+	sum := json_new("summary")
+	sum.Children = json_children(opaque, summary, false)
+	node.Children = append([]*Node{sum}, json_children(opaque, text, true)...)
+	json_ref(ob, opaque, node)
+}
+
+func json_directive(ob *bytes.Buffer, name []byte, title []byte, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("json_directive"))
+	node := json_new("directive")
+	node.Attributes.Name = string(name)
+	json_attrs(node, attrs)
+	tit := json_new("title")
+	tit.Children = json_children(opaque, title, false)
+	node.Children = append([]*Node{tit}, json_children(opaque, text, true)...)
+	json_ref(ob, opaque, node)
+}
+
+func json_autolink(ob *bytes.Buffer, link []byte, typ int, opaque interface{}) bool {
+	defer un(trace("json_autolink"))
+	if len(link) == 0 {
+		return false
+	}
+	node := json_new("autolink")
+	node.Attributes.Href = string(link)
+	node.Attributes.Email = typ == MKDA_EMAIL
+	node.Children = json_text(node.Children, string(link))
+	json_ref(ob, opaque, node)
+	return true
+}
+
+/* a span with a literal */
+func json_literal(ob *bytes.Buffer, typ string, text []byte, opaque interface{}) bool {
+	node := json_new(typ)
+	node.Attributes.Literal = string(text)
+	json_ref(ob, opaque, node)
+	return true
+}
+
+/* a span with children, none when the text is empty */
+func json_span(ob *bytes.Buffer, typ string, text []byte, opaque interface{}) bool {
+	if len(text) == 0 {
+		return false
+	}
+	node := json_new(typ)
+	node.Children = json_children(opaque, text, false)
+	json_ref(ob, opaque, node)
+	return true
+}
+
+func json_codespan(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("json_codespan"))
+	return json_literal(ob, "code", text, opaque)
+}
+
+func json_double_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("json_double_emphasis"))
+	return json_span(ob, "strong", text, opaque)
+}
+
+func json_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("json_emphasis"))
+	return json_span(ob, "emphasis", text, opaque)
+}
+
+func json_triple_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("json_triple_emphasis"))
+	return json_span(ob, "strong_emphasis", text, opaque)
+}
+
+func json_strikethrough(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("json_strikethrough"))
+	return json_span(ob, "strikethrough", text, opaque)
+}
+
+func json_image(ob *bytes.Buffer, link []byte, title []byte, alt []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("json_image"))
+	if len(link) == 0 {
+		return false
+	}
+	node := json_new("image")
+	node.Attributes.Href = string(link)
+	node.Attributes.Title = string(title)
+	node.Attributes.Alt = string(alt)
+	json_attrs(node, attrs)
+	json_ref(ob, opaque, node)
+	return true
+}
+
+func json_linebreak(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("json_linebreak"))
+	node := json_new("linebreak")
+	node.Attributes.Literal = string(text)
+	json_ref(ob, opaque, node)
+	return true
+}
+
+func json_link(ob *bytes.Buffer, link []byte, title []byte, content []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("json_link"))
+	node := json_new("link")
+	node.Attributes.Href = string(link)
+	node.Attributes.Title = string(title)
+	json_attrs(node, attrs)
+	node.Children = json_children(opaque, content, false)
+	json_ref(ob, opaque, node)
+	return true
+}
+
+func json_raw_html(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("json_raw_html"))
+	return json_literal(ob, "html", text, opaque)
+}
+
+func json_emoji(ob *bytes.Buffer, name []byte, glyph []byte, image []byte, opaque interface{}) bool {
+	defer un(trace("json_emoji"))
+	node := json_new("emoji")
+	node.Attributes.Name = string(name)
+	node.Attributes.Glyph = string(glyph)
+	node.Attributes.Image = string(image)
+	json_ref(ob, opaque, node)
+	return true
+}
+
+func json_entity(ob *bytes.Buffer, entity []byte, opaque interface{}) {
+	defer un(trace("json_entity"))
+	json_literal(ob, "entity", entity, opaque)
+}
+
+/* text is written as it is, for the parser rewinding it when it turns
+ * out to be the start of an autolink; json_children makes it a node */
+func json_normal_text(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("json_normal_text"))
+	for _, c := range text {
+		if c != json_node {
+			ob.WriteByte(c)
+		}
+	}
+}
+
+/* replaces the output by the JSON of the document */
+func json_finalize(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("json_finalize"))
+	options, _ := opaque.(*json_renderopt)
+	doc := json_new("document")
+	doc.Version = JsonSchemaVersion
+	doc.Children = json_children(opaque, ob.Bytes(), true)
+
+	ob.Reset()
+	enc := json.NewEncoder(ob)
+	enc.SetEscapeHTML(false)
+	if options.flags&JSON_INDENT != 0 {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(doc)
+}
+
+func json_renderer(options *JsonOptions) *mkd_renderer {
+	renderer := &mkd_renderer{
+		json_blockcode,
+		json_blockquote,
+		json_raw_block,
+		json_header,
+		json_hrule,
+		json_list,
+		json_listitem,
+		json_paragraph,
+		json_table,
+		json_tablerow,
+		json_tablecell,
+		nil,
+		json_details,
+		json_directive,
+
+		json_autolink,
+		json_codespan,
+		json_double_emphasis,
+		json_emphasis,
+		json_image,
+		json_linebreak,
+		json_link,
+		json_raw_html,
+		json_triple_emphasis,
+		json_strikethrough,
+		json_emoji,
+
+		json_entity,
+		json_normal_text,
+
+		nil,
+		json_finalize,
+		nil,
+		nil}
+
+	renderer.opaque = &json_renderopt{flags: options.Flags}
+	if options.Flags&JSON_FIGURES != 0 {
+		renderer.figure = json_figure
+	}
+	return renderer
+}
+
+func (opts *JsonOptions) renderer() (*mkd_renderer, *Config) {
+	return json_renderer(opts), nil
+}
+
+// MarkdownToJson writes the document tree as JSON, see the schema in
+// json.go. A nil opts writes it on a single line, without extensions.
+// Directives stay directive nodes, the handlers of the Config being run
+// by Node.Render.
+func MarkdownToJson(ib []byte, opts *JsonOptions) []byte {
+	defer un(trace("MarkdownToJson"))
+	if opts == nil {
+		opts = &JsonOptions{}
+	}
+
+	var cfg Config
+	if opts.Config != nil {
+		cfg = *opts.Config
+	}
+	cfg.Directives = nil
+
+	return ups_markdown(json_renderer(opts), ib, opts.Extensions, &cfg)
+}
+
+// JsonToNode loads a document tree written by MarkdownToJson, for
+// Node.Render. It fails on JSON that isn't a document of a known
+// version of the schema.
+func JsonToNode(data []byte) (*Node, error) {
+	var doc Node
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Type != "document" {
+		return nil, errors.New("markup: the JSON is not a document")
+	}
+	if doc.Version < 1 || doc.Version > JsonSchemaVersion {
+		return nil, fmt.Errorf("markup: unknown JSON schema version %d", doc.Version)
+	}
+	return &doc, nil
+}
+
+// Render renders the document tree with the renderer of r, calling its
+// callbacks the way the parser does. The Extensions of r are not used,
+// the tree being parsed already, and of its Config only the Directives.
+func (n *Node) Render(r Renderer) []byte {
+	defer un(trace("Node.Render"))
+	renderer, cfg := r.renderer()
+	if cfg != nil && len(cfg.Directives) > 0 {
+		renderer = render_directives(renderer, cfg.Directives)
+	}
+	var ob bytes.Buffer
+	if renderer.doc_header != nil {
+		renderer.doc_header(&ob, renderer.opaque)
+	}
+	if n.Type == "document" {
+		for _, child := range n.Children {
+			render_node(&ob, renderer, child)
+		}
+	} else {
+		render_node(&ob, renderer, n)
+	}
+	if renderer.doc_footer != nil {
+		renderer.doc_footer(&ob, renderer.opaque)
+	}
+	return ob.Bytes()
+}
+
+/* a copy of the renderer handing the directives to their handler first,
+ * like parse_directive; the handler gets the text of the rendered title */
+func render_directives(renderer *mkd_renderer, handlers map[string]Directive) *mkd_renderer {
+	fallback := renderer.directive
+	with := *renderer
+	with.directive = func(ob *bytes.Buffer, name []byte, title []byte, text []byte, attrs *mkd_attrs, opaque interface{}) {
+		if h := handlers[string(name)]; h != nil && len(name) > 0 {
+			if html, ok := h(string(name), string(title), attrs.to_map(), text); ok {
+				if ob.Len() > 0 {
+					ob.WriteByte('\n')
+				}
+				ob.Write(html)
+				ensure_ends_with_nl(ob)
+				return
+			}
+		}
+		if fallback != nil {
+			fallback(ob, name, title, text, attrs, opaque)
+		}
+	}
+	return &with
+}
+
+/* renders the children of a node */
+func render_children(renderer *mkd_renderer, nodes []*Node) []byte {
+	var ob bytes.Buffer
+	for _, child := range nodes {
+		render_node(&ob, renderer, child)
+	}
+	return ob.Bytes()
+}
+
+/* text the way the parser writes it when no callback takes it */
+func render_text(ob *bytes.Buffer, renderer *mkd_renderer, text string) {
+	if renderer.normal_text != nil {
+		renderer.normal_text(ob, []byte(text), renderer.opaque)
+	} else {
+		ob.WriteString(text)
+	}
+}
+
+/* a span that wasn't rendered: its text between its delimiters */
+func render_span_text(ob *bytes.Buffer, renderer *mkd_renderer, delim string, content []byte) {
+	render_text(ob, renderer, delim)
+	ob.Write(content)
+	render_text(ob, renderer, delim)
+}
+
+/* the source a renderer writing markdown reads a link from */
+func render_source(renderer *mkd_renderer, link, title string) {
+	if renderer.source != nil {
+		refs := renderer.source.refs
+		*renderer.source = mkd_source{refs: refs}
+		if link != "" {
+			renderer.source.link = []byte(link)
+		}
+		if title != "" {
+			renderer.source.title = []byte(title)
+		}
+	}
+}
+
+/* renders a node with the callbacks; like the parser, the block callbacks
+ * left nil skip the block, the span callbacks left nil or failing write
+ * the text of the span */
+func render_node(ob *bytes.Buffer, renderer *mkd_renderer, n *Node) {
+	a := &n.Attributes
+	opaque := renderer.opaque
+	switch n.Type {
+	case "paragraph":
+		if renderer.paragraph != nil {
+			renderer.paragraph(ob, render_children(renderer, n.Children), node_attrs(n), opaque)
+		}
+	case "header":
+		if renderer.header != nil {
+			renderer.header(ob, render_children(renderer, n.Children), a.Level, node_attrs(n), opaque)
+		}
+	case "blockquote":
+		if renderer.blockquote != nil {
+			renderer.blockquote(ob, render_children(renderer, n.Children), opaque)
+		}
+	case "code_block":
+		if renderer.blockcode != nil {
+			renderer.blockcode(ob, []byte(a.Literal), []byte(a.Lang), node_attrs(n), opaque)
+		}
+	case "html_block":
+		if renderer.blockhtml != nil && len(n.Children) == 0 {
+			renderer.blockhtml(ob, []byte(a.Literal), opaque)
+		} else if renderer.blockhtml != nil {
+			/* the markdown between the html, as parse_markdown_html
+			 * renders a span */
+			var text bytes.Buffer
+			var blocks []*Node
+			for _, child := range append(n.Children, nil) {
+				if child != nil && child.Type != "html" {
+					blocks = append(blocks, child)
+					continue
+				}
+				if len(blocks) > 0 {
+					text.Write(bytes.TrimLeft(render_children(renderer, blocks), "\n"))
+				}
+				blocks = nil
+				if child != nil {
+					text.WriteString(child.Attributes.Literal)
+				}
+			}
+			renderer.blockhtml(ob, text.Bytes(), opaque)
+		}
+	case "hrule":
+		if renderer.hrule != nil {
+			renderer.hrule(ob, opaque)
+		}
+	case "list":
+		flags := 0
+		if a.Ordered {
+			flags |= MKD_LIST_ORDERED
+		}
+		var items bytes.Buffer
+		for _, item := range n.Children {
+			if item.Attributes.Block {
+				flags |= MKD_LI_BLOCK
+			}
+			if renderer.listitem != nil {
+				renderer.listitem(&items, render_children(renderer, item.Children), flags, opaque)
+			}
+		}
+		start := 1
+		if a.Start != nil {
+			start = *a.Start
+		}
+		if renderer.list != nil {
+			renderer.list(ob, items.Bytes(), flags, start, opaque)
+		}
+	case "table":
+		var parts [2]bytes.Buffer
+		for _, part := range n.Children {
+			i := 1
+			if part.Type == "table_head" {
+				i = 0
+			}
+			for _, row := range part.Children {
+				render_node(&parts[i], renderer, row)
+			}
+		}
+		if renderer.table != nil {
+			renderer.table(ob, parts[0].Bytes(), parts[1].Bytes(), opaque)
+		}
+	case "table_row":
+		if renderer.table_row != nil {
+			renderer.table_row(ob, render_children(renderer, n.Children), opaque)
+		}
+	case "table_cell":
+		align := 0
+		for flags, name := range json_alignments {
+			if name == a.Align {
+				align = flags
+			}
+		}
+		if renderer.table_cell != nil {
+			renderer.table_cell(ob, render_children(renderer, n.Children), align, opaque)
+		}
+	case "figure":
+		var image, caption []byte
+		for _, child := range n.Children {
+			if child.Type == "caption" {
+				caption = render_children(renderer, child.Children)
+			} else {
+				image = append(image, render_children(renderer, []*Node{child})...)
+			}
+		}
+		if renderer.figure != nil {
+			renderer.figure(ob, image, caption, node_attrs(n), opaque)
+		} else if renderer.paragraph != nil {
+			/* what the parser makes of it without figures */
+			renderer.paragraph(ob, image, node_attrs(n), opaque)
+		}
+	case "details", "directive":
+		var head []byte
+		var blocks []*Node
+		for _, child := range n.Children {
+			if child.Type == "summary" || child.Type == "title" {
+				head = render_children(renderer, child.Children)
+			} else {
+				blocks = append(blocks, child)
+			}
+		}
+		text := render_children(renderer, blocks)
+		if n.Type == "details" && renderer.details != nil {
+			renderer.details(ob, head, text, a.Open, node_attrs(n), opaque)
+		} else if n.Type == "directive" && renderer.directive != nil {
+			renderer.directive(ob, []byte(a.Name), head, text, node_attrs(n), opaque)
+		}
+
+	case "text":
+		render_text(ob, renderer, a.Literal)
+	case "entity":
+		if renderer.entity != nil {
+			renderer.entity(ob, []byte(a.Literal), opaque)
+		} else {
+			ob.WriteString(a.Literal)
+		}
+	case "code":
+		if renderer.codespan == nil || !renderer.codespan(ob, []byte(a.Literal), opaque) {
+			render_span_text(ob, renderer, "`", []byte(a.Literal))
+		}
+	case "html":
+		if renderer.raw_html_tag == nil || !renderer.raw_html_tag(ob, []byte(a.Literal), opaque) {
+			render_text(ob, renderer, a.Literal)
+		}
+	case "emphasis", "strong", "strong_emphasis", "strikethrough":
+		content := render_children(renderer, n.Children)
+		var span func(*bytes.Buffer, []byte, interface{}) bool
+		delim := map[string]string{"emphasis": "*", "strong": "**", "strong_emphasis": "***", "strikethrough": "~~"}[n.Type]
+		switch n.Type {
+		case "emphasis":
+			span = renderer.emphasis
+		case "strong":
+			span = renderer.double_emphasis
+		case "strong_emphasis":
+			span = renderer.triple_emphasis
+		default:
+			span = renderer.strikethrough
+		}
+		render_source(renderer, "", "")
+		if span == nil || !span(ob, content, opaque) {
+			render_span_text(ob, renderer, delim, content)
+		}
+	case "link":
+		content := render_children(renderer, n.Children)
+		render_source(renderer, a.Href, a.Title)
+		if renderer.link == nil || !renderer.link(ob, []byte(a.Href), []byte(a.Title), content, node_attrs(n), opaque) {
+			ob.Write(content)
+		}
+		render_source(renderer, "", "")
+	case "image":
+		render_source(renderer, a.Href, a.Title)
+		if renderer.image == nil || !renderer.image(ob, []byte(a.Href), []byte(a.Title), []byte(a.Alt), node_attrs(n), opaque) {
+			render_text(ob, renderer, a.Alt)
+		}
+		render_source(renderer, "", "")
+	case "autolink":
+		typ := MKDA_NORMAL
+		if a.Email {
+			typ = MKDA_EMAIL
+		}
+		if renderer.autolink == nil || !renderer.autolink(ob, []byte(a.Href), typ, opaque) {
+			render_text(ob, renderer, a.Href)
+		}
+	case "linebreak":
+		/* a break without its literal is the usual two spaces */
+		text := a.Literal
+		if text == "" {
+			text = "  \n"
+		}
+		if renderer.linebreak == nil || !renderer.linebreak(ob, []byte(text), opaque) {
+			render_text(ob, renderer, "\n")
+		}
+	case "emoji":
+		if renderer.emoji == nil || !renderer.emoji(ob, []byte(a.Name), []byte(a.Glyph), []byte(a.Image), opaque) {
+			render_text(ob, renderer, ":"+a.Name+":")
+		}
+
+	default:
+		/* an unknown node keeps its content */
+		ob.Write(render_children(renderer, n.Children))
+	}
+}
@@ -0,0 +1,502 @@
+package markup
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strconv"
+)
+
+/*
+ * LaTeX renderer. Headers become \section and below, lists itemize and
+ * enumerate, code verbatim (lstlisting when it has a language, with the
+ * language option when listings knows it), tables tabular with the
+ * column alignments of the table. Raw html has no meaning in LaTeX and
+ * is dropped.
+ *
+ * With LATEX_STANDALONE, doc_header and doc_footer wrap the output in a
+ * document with a preamble loading the packages the output uses.
+ */
+
+/* LaTeX options */
+const (
+	LATEX_STANDALONE = 1 << 0 /* a complete document, with the preamble */
+)
+
+/* packages of the commands the renderer writes */
+const latex_preamble = `\documentclass{article}
+\usepackage[utf8]{inputenc}
+\usepackage[T1]{fontenc}
+\usepackage{graphicx}
+\usepackage[normalem]{ulem}
+\usepackage{listings}
+\usepackage{hyperref}
+
+\begin{document}
+`
+
+// LatexOptions are the settings of MarkdownToLatex.
+type LatexOptions struct {
+	// Flags is a combination of the LATEX_* flags.
+	Flags uint
+
+	// Extensions are the MKDEXT_* flags of the parser.
+	Extensions uint
+
+	// Config holds the additional parser settings, it may be nil.
+	Config *Config
+}
+
+type latex_renderopt struct {
+	flags uint
+}
+
+/* the listings languages of the fence languages, by their lower case
+ * name; listings has no definitions for the others */
+var latex_languages = map[string]string{
+	"ada": "Ada", "awk": "Awk", "bash": "bash", "c": "C", "c++": "C++",
+	"cpp": "C++", "cobol": "Cobol", "csh": "csh", "delphi": "Delphi",
+	"eiffel": "Eiffel", "erlang": "erlang", "fortran": "Fortran",
+	"gnuplot": "Gnuplot", "haskell": "Haskell", "html": "HTML",
+	"java": "Java", "ksh": "ksh", "lisp": "Lisp", "make": "make",
+	"makefile": "make", "mathematica": "Mathematica", "matlab": "Matlab",
+	"ocaml": "Caml", "octave": "Octave", "pascal": "Pascal", "perl": "Perl",
+	"php": "PHP", "postscript": "PostScript", "prolog": "Prolog",
+	"python": "Python", "py": "Python", "r": "R", "ruby": "Ruby",
+	"rb": "Ruby", "sh": "sh", "shell": "sh", "sql": "SQL", "tcl": "tcl",
+	"tex": "TeX", "vbscript": "VBScript", "verilog": "Verilog",
+	"vhdl": "VHDL", "xml": "XML", "xslt": "XSLT",
+}
+
+/* sectioning commands by header level */
+var latex_sections = []string{"section", "subsection", "subsubsection", "paragraph", "subparagraph", "subparagraph"}
+
+/* escapes the characters LaTeX gives a meaning to */
+func latex_escape(ob *bytes.Buffer, text []byte) {
+	for _, c := range text {
+		switch c {
+		case '\\':
+			ob.WriteString(`\textbackslash{}`)
+		case '{', '}', '$', '&', '#', '%', '_':
+			ob.WriteByte('\\')
+			ob.WriteByte(c)
+		case '~':
+			ob.WriteString(`\textasciitilde{}`)
+		case '^':
+			ob.WriteString(`\textasciicircum{}`)
+		case '<':
+			ob.WriteString(`\textless{}`)
+		case '>':
+			ob.WriteString(`\textgreater{}`)
+		case '|':
+			ob.WriteString(`\textbar{}`)
+		case text_row, text_cell:
+		default:
+			ob.WriteByte(c)
+		}
+	}
+}
+
+/* writes an url for \href, \url and \includegraphics: # and % are
+ * escaped, what would end the argument is percent-encoded */
+func latex_url(ob *bytes.Buffer, link []byte) {
+	for _, c := range link {
+		switch {
+		case c == '#' || c == '%':
+			ob.WriteByte('\\')
+			ob.WriteByte(c)
+		case c == '\\' || c == '{' || c == '}' || c <= ' ' || c == 0x7f:
+			fmt.Fprintf(ob, "%%%02X", c)
+		default:
+			ob.WriteByte(c)
+		}
+	}
+}
+
+/* a label keeps the characters that are safe there */
+func latex_name(ob *bytes.Buffer, name []byte) {
+	for _, c := range name {
+		if isalnum(c) || c == '-' || c == '+' || c == ':' || c == '.' {
+			ob.WriteByte(c)
+		}
+	}
+}
+
+/* writes \cmd{text} */
+func latex_cmd(ob *bytes.Buffer, cmd string, text []byte) {
+	ob.WriteByte('\\')
+	ob.WriteString(cmd)
+	ob.WriteByte('{')
+	ob.Write(text)
+	ob.WriteByte('}')
+}
+
+func latex_blockcode(ob *bytes.Buffer, text []byte, lang []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("latex_blockcode"))
+	text_block(ob)
+	if len(lang) == 0 {
+		lang = code_lang(nil, attrs)
+	}
+	if len(lang) > 0 {
+		ob.WriteString(`\begin{lstlisting}`)
+		if name, ok := latex_languages[string(bytes.ToLower(lang))]; ok {
+			ob.WriteString("[language=")
+			ob.WriteString(name)
+			ob.WriteByte(']')
+		}
+		ob.WriteByte('\n')
+	} else {
+		ob.WriteString("\\begin{verbatim}\n")
+	}
+	ob.Write(text)
+	ensure_ends_with_nl(ob)
+	if len(lang) > 0 {
+		ob.WriteString("\\end{lstlisting}\n")
+	} else {
+		ob.WriteString("\\end{verbatim}\n")
+	}
+}
+
+func latex_blockquote(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("latex_blockquote"))
+	text_block(ob)
+	ob.WriteString("\\begin{quote}\n")
+	ob.Write(bytes.Trim(text, "\n"))
+	ob.WriteString("\n\\end{quote}\n")
+}
+
+/* raw html is dropped */
+func latex_raw_block(ob *bytes.Buffer, text []byte, opaque interface{}) {
+}
+
+func latex_header(ob *bytes.Buffer, text []byte, level int, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("latex_header"))
+	text_block(ob)
+	if level < 1 {
+		level = 1
+	}
+	if level > len(latex_sections) {
+		level = len(latex_sections)
+	}
+	latex_cmd(ob, latex_sections[level-1], bytes.Trim(text, " "))
+	if attrs != nil && len(attrs.id) > 0 {
+		ob.WriteString(`\label{`)
+		latex_name(ob, attrs.id)
+		ob.WriteByte('}')
+	}
+	ob.WriteByte('\n')
+}
+
+func latex_hrule(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("latex_hrule"))
+	text_block(ob)
+	ob.WriteString("\\noindent\\rule{\\textwidth}{0.4pt}\n")
+}
+
+func latex_list(ob *bytes.Buffer, text []byte, flags, start int, opaque interface{}) {
+	defer un(trace("latex_list"))
+	env := "itemize"
+	if flags&MKD_LIST_ORDERED != 0 {
+		env = "enumerate"
+	}
+	text_block(ob)
+	ob.WriteString("\\begin{" + env + "}\n")
+	if flags&MKD_LIST_ORDERED != 0 && start != 1 {
+		ob.WriteString("\\setcounter{enumi}{" + strconv.Itoa(start-1) + "}\n")
+	}
+	ob.Write(text)
+	ob.WriteString("\\end{" + env + "}\n")
+}
+
+func latex_listitem(ob *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+	defer un(trace("latex_listitem"))
+	text = bytes.Trim(text, "\n")
+	ob.WriteString(`\item `)
+	if len(text) > 0 && text[0] == '[' {
+		/* not the optional label of the item */
+		ob.WriteString("{}")
+	}
+	ob.Write(text)
+	ob.WriteByte('\n')
+}
+
+func latex_paragraph(ob *bytes.Buffer, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("latex_paragraph"))
+	text = bytes.Trim(text, " \n")
+	if len(text) == 0 {
+		return
+	}
+	text_block(ob)
+	ob.Write(text)
+	ob.WriteByte('\n')
+}
+
+/* tabular with a column per cell, aligned like the table */
+func latex_table(ob *bytes.Buffer, header []byte, body []byte, opaque interface{}) {
+	defer un(trace("latex_table"))
+	text_block(ob)
+
+	rows, aligns := text_table_rows(header, body)
+	ob.WriteString(`\begin{tabular}{`)
+	for _, align := range aligns {
+		switch align {
+		case MKD_TABLE_ALIGN_R:
+			ob.WriteByte('r')
+		case MKD_TABLE_ALIGN_CENTER:
+			ob.WriteByte('c')
+		default:
+			ob.WriteByte('l')
+		}
+	}
+	ob.WriteString("}\n\\hline\n")
+	for r, row := range rows {
+		for i, cell := range row {
+			if i > 0 {
+				ob.WriteString(" & ")
+			}
+			ob.Write(cell)
+		}
+		ob.WriteString(" \\\\\n")
+		if r == 0 {
+			ob.WriteString("\\hline\n")
+		}
+	}
+	ob.WriteString("\\hline\n\\end{tabular}\n")
+}
+
+func latex_tablerow(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("latex_tablerow"))
+	ob.Write(text)
+	ob.WriteByte(text_row)
+}
+
+func latex_tablecell(ob *bytes.Buffer, text []byte, align int, opaque interface{}) {
+	defer un(trace("latex_tablecell"))
+	ob.WriteByte(text_cell)
+	ob.WriteByte(byte('0' + align))
+	ob.Write(bytes.Trim(text, " "))
+}
+
+/* a paper can't be folded: the summary in bold, then the body */
+func latex_details(ob *bytes.Buffer, summary []byte, text []byte, open bool, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("latex_details"))
+	text_block(ob)
+	ob.WriteString(`\noindent`)
+	latex_cmd(ob, "textbf", bytes.Trim(summary, " "))
+	ob.WriteByte('\n')
+	if text = bytes.Trim(text, "\n"); len(text) > 0 {
+		ob.WriteByte('\n')
+		ob.Write(text)
+		ob.WriteByte('\n')
+	}
+}
+
+func latex_directive(ob *bytes.Buffer, name []byte, title []byte, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("latex_directive"))
+	if title = bytes.Trim(title, " "); len(title) > 0 {
+		text_block(ob)
+		ob.WriteString(`\noindent`)
+		latex_cmd(ob, "textbf", title)
+		ob.WriteByte('\n')
+	}
+	if text = bytes.Trim(text, "\n"); len(text) > 0 {
+		text_block(ob)
+		ob.Write(text)
+		ob.WriteByte('\n')
+	}
+}
+
+func latex_autolink(ob *bytes.Buffer, link []byte, typ int, opaque interface{}) bool {
+	defer un(trace("latex_autolink"))
+	if len(link) == 0 {
+		return false
+	}
+	if typ == MKDA_EMAIL || bytes.HasPrefix(link, []byte("mailto:")) {
+		address := bytes.TrimPrefix(link, []byte("mailto:"))
+		ob.WriteString(`\href{mailto:`)
+		latex_url(ob, address)
+		ob.WriteString("}{")
+		latex_escape(ob, address)
+		ob.WriteByte('}')
+		return true
+	}
+	ob.WriteString(`\url{`)
+	latex_url(ob, link)
+	ob.WriteByte('}')
+	return true
+}
+
+func latex_codespan(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("latex_codespan"))
+	ob.WriteString(`\texttt{`)
+	latex_escape(ob, text)
+	ob.WriteByte('}')
+	return true
+}
+
+func latex_double_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("latex_double_emphasis"))
+	if len(text) == 0 {
+		return false
+	}
+	latex_cmd(ob, "textbf", text)
+	return true
+}
+
+func latex_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("latex_emphasis"))
+	if len(text) == 0 {
+		return false
+	}
+	latex_cmd(ob, "emph", text)
+	return true
+}
+
+func latex_triple_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("latex_triple_emphasis"))
+	if len(text) == 0 {
+		return false
+	}
+	ob.WriteString(`\textbf{\emph{`)
+	ob.Write(text)
+	ob.WriteString("}}")
+	return true
+}
+
+func latex_strikethrough(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("latex_strikethrough"))
+	if len(text) == 0 {
+		return false
+	}
+	latex_cmd(ob, "sout", text)
+	return true
+}
+
+func latex_image(ob *bytes.Buffer, link []byte, title []byte, alt []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("latex_image"))
+	if len(link) == 0 {
+		return false
+	}
+	ob.WriteString(`\includegraphics{`)
+	latex_url(ob, link)
+	ob.WriteByte('}')
+	return true
+}
+
+func latex_linebreak(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("latex_linebreak"))
+	/* {} keeps a following [ or * from being read as an argument */
+	ob.WriteString("\\\\{}\n")
+	return true
+}
+
+func latex_link(ob *bytes.Buffer, link []byte, title []byte, content []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("latex_link"))
+	if len(link) == 0 {
+		ob.Write(content)
+		return true
+	}
+	ob.WriteString(`\href{`)
+	latex_url(ob, link)
+	ob.WriteString("}{")
+	ob.Write(content)
+	ob.WriteByte('}')
+	return true
+}
+
+/* inline html is dropped */
+func latex_raw_html(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	return true
+}
+
+func latex_emoji(ob *bytes.Buffer, name []byte, glyph []byte, image []byte, opaque interface{}) bool {
+	defer un(trace("latex_emoji"))
+	if len(glyph) > 0 {
+		latex_escape(ob, glyph)
+	} else {
+		ob.WriteByte(':')
+		latex_escape(ob, name)
+		ob.WriteByte(':')
+	}
+	return true
+}
+
+func latex_entity(ob *bytes.Buffer, entity []byte, opaque interface{}) {
+	defer un(trace("latex_entity"))
+	latex_escape(ob, []byte(html.UnescapeString(string(entity))))
+}
+
+func latex_normal_text(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("latex_normal_text"))
+	latex_escape(ob, text)
+}
+
+func latex_doc_header(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("latex_doc_header"))
+	ob.WriteString(latex_preamble)
+}
+
+func latex_doc_footer(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("latex_doc_footer"))
+	text_block(ob)
+	ob.WriteString("\\end{document}\n")
+}
+
+func latex_renderer(options *LatexOptions) *mkd_renderer {
+	renderer := &mkd_renderer{
+		latex_blockcode,
+		latex_blockquote,
+		latex_raw_block,
+		latex_header,
+		latex_hrule,
+		latex_list,
+		latex_listitem,
+		latex_paragraph,
+		latex_table,
+		latex_tablerow,
+		latex_tablecell,
+		nil,
+		latex_details,
+		latex_directive,
+
+		latex_autolink,
+		latex_codespan,
+		latex_double_emphasis,
+		latex_emphasis,
+		latex_image,
+		latex_linebreak,
+		latex_link,
+		latex_raw_html,
+		latex_triple_emphasis,
+		latex_strikethrough,
+		latex_emoji,
+
+		latex_entity,
+		latex_normal_text,
+
+		nil,
+		nil,
+		nil,
+		nil}
+
+	renderer.opaque = &latex_renderopt{flags: options.Flags}
+	if options.Flags&LATEX_STANDALONE != 0 {
+		renderer.doc_header = latex_doc_header
+		renderer.doc_footer = latex_doc_footer
+	}
+	return renderer
+}
+
+func (opts *LatexOptions) renderer() (*mkd_renderer, *Config) {
+	return latex_renderer(opts), opts.Config
+}
+
+// MarkdownToLatex renders the markdown document as LaTeX, a fragment to
+// \input into a document or, with LATEX_STANDALONE, a complete document.
+// A nil opts renders a fragment without extensions.
+func MarkdownToLatex(ib []byte, opts *LatexOptions) []byte {
+	if opts == nil {
+		opts = &LatexOptions{}
+	}
+	return ups_markdown(latex_renderer(opts), ib, opts.Extensions, opts.Config)
+}
@@ -0,0 +1,659 @@
+package markup
+
+import (
+	"bytes"
+	"html"
+	"strconv"
+)
+
+/*
+ * roff renderer for man pages, using the man macros. Headers become .SH
+ * and .SS, lists .IP items (.TP for "term:" items), code .nf/.fi blocks
+ * and tables tbl tables. Raw html is dropped.
+ *
+ * The .TH line comes from a front matter of title, section, date,
+ * source and manual fields between "---" lines at the top of the
+ * document or, without a title there, from a first level 1 header. That
+ * header may be written the ronn way, "name(section) -- description",
+ * which also gives the NAME section.
+ *
+ * Text is escaped so that roff reads it as text: backslashes become \e,
+ * hyphens \-, and lines starting with a dot or an apostrophe, which roff
+ * takes for requests, start with \& instead.
+ */
+
+/* starts the output of a list, for the item it is nested in */
+const man_sublist = '\x04'
+
+// ManOptions are the settings of MarkdownToMan.
+type ManOptions struct {
+	// Extensions are the MKDEXT_* flags of the parser.
+	Extensions uint
+
+	// Config holds the additional parser settings, it may be nil.
+	Config *Config
+}
+
+type man_renderopt struct {
+	/* .TH fields, roff text */
+	title, section, date, source, manual []byte
+
+	/* NAME section of a ronn style title header */
+	name, description []byte
+
+	headers int  /* header levels taken by the title */
+	seen    bool /* a header was rendered */
+	tables  bool /* the page needs tbl */
+}
+
+/* escapes the characters roff gives a meaning to, and drops the markers */
+func man_escape(ob *bytes.Buffer, text []byte) {
+	for _, c := range text {
+		switch c {
+		case '\\':
+			ob.WriteString(`\e`)
+		case '-':
+			ob.WriteString(`\-`)
+		case text_wrap, text_break, text_item, man_sublist, text_row, text_cell:
+		default:
+			ob.WriteByte(c)
+		}
+	}
+}
+
+/* writes text lines without their indentation, which roff keeps, and
+ * protects the lines roff would read as requests */
+func man_lines(ob *bytes.Buffer, text []byte) {
+	text = bytes.Replace(text, []byte{text_break}, []byte("\n.br\n"), -1)
+	for _, line := range bytes.Split(text, []byte("\n")) {
+		line = bytes.Trim(line, " \t")
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '.' || line[0] == '\'' {
+			if !bytes.Equal(line, []byte(".br")) {
+				ob.WriteString(`\&`)
+			}
+		}
+		ob.Write(line)
+		ob.WriteByte('\n')
+	}
+}
+
+/* the font of text in font inner within text in font outer */
+func man_font_in(outer, inner string) string {
+	if inner == "R" || inner == outer || outer == "BI" {
+		return outer
+	}
+	return "BI"
+}
+
+/* writes \f escape of a font */
+func man_font_escape(ob *bytes.Buffer, font string) {
+	ob.WriteString(`\f`)
+	if len(font) > 1 {
+		ob.WriteByte('(')
+	}
+	ob.WriteString(font)
+}
+
+/* writes text in font, the fonts switched to inside it combined with it */
+func man_font(ob *bytes.Buffer, text []byte, font string) {
+	man_font_escape(ob, font)
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' || i+1 >= len(text) {
+			ob.WriteByte(text[i])
+			continue
+		}
+		if text[i+1] != 'f' || i+2 >= len(text) {
+			/* some other escape, copied whole */
+			ob.Write(text[i : i+2])
+			i++
+			continue
+		}
+		inner := string(text[i+2])
+		i += 2
+		if inner == "(" && i+2 < len(text) {
+			inner = string(text[i+1 : i+3])
+			i += 2
+		}
+		man_font_escape(ob, man_font_in(font, inner))
+	}
+	ob.WriteString(`\fR`)
+}
+
+/* text without its font escapes */
+func man_plain(text []byte) []byte {
+	var out bytes.Buffer
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+2 < len(text) && text[i+1] == 'f' {
+			if text[i+2] == '(' {
+				i += 4
+			} else {
+				i += 2
+			}
+			continue
+		}
+		out.WriteByte(text[i])
+		if text[i] == '\\' && i+1 < len(text) {
+			out.WriteByte(text[i+1])
+			i++
+		}
+	}
+	return out.Bytes()
+}
+
+/* upper cases the letters of roff text, leaving the escapes alone */
+func man_upper(text []byte) []byte {
+	out := make([]byte, len(text))
+	copy(out, text)
+	for i := 0; i < len(out); i++ {
+		if out[i] == '\\' {
+			i++
+		} else if out[i] >= 'a' && out[i] <= 'z' {
+			out[i] -= 'a' - 'A'
+		}
+	}
+	return out
+}
+
+/* writes a quoted macro argument */
+func man_arg(ob *bytes.Buffer, arg []byte) {
+	ob.WriteString(` "`)
+	ob.Write(bytes.Replace(arg, []byte(`"`), []byte(`\(dq`), -1))
+	ob.WriteByte('"')
+}
+
+/* starts a block on a new line */
+func man_block(ob *bytes.Buffer) {
+	ensure_ends_with_nl(ob)
+}
+
+func man_blockcode(ob *bytes.Buffer, text []byte, lang []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("man_blockcode"))
+	man_block(ob)
+	ob.WriteString(".PP\n.RS 4\n.nf\n")
+	text = bytes.TrimRight(text, "\n")
+	for _, line := range bytes.Split(text, []byte("\n")) {
+		if len(line) > 0 && (line[0] == '.' || line[0] == '\'') {
+			ob.WriteString(`\&`)
+		}
+		man_escape(ob, line)
+		ob.WriteByte('\n')
+	}
+	ob.WriteString(".fi\n.RE\n")
+}
+
+func man_blockquote(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("man_blockquote"))
+	man_block(ob)
+	ob.WriteString(".RS 4\n")
+	ob.Write(bytes.Trim(text, "\n"))
+	ob.WriteString("\n.RE\n")
+}
+
+/* raw html is dropped */
+func man_raw_block(ob *bytes.Buffer, text []byte, opaque interface{}) {
+}
+
+/* takes a first level 1 header for the title of the page, otherwise .SH
+ * for the top level of headers, .SS for the next and bold paragraphs
+ * below */
+func man_header(ob *bytes.Buffer, text []byte, level int, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("man_header"))
+	options, _ := opaque.(*man_renderopt)
+	text = bytes.Trim(bytes.Replace(text, []byte("\n"), []byte(" "), -1), " ")
+
+	first := !options.seen
+	options.seen = true
+	if first && level == 1 && len(options.title) == 0 {
+		man_title(options, text)
+		options.headers = 1
+		return
+	}
+
+	man_block(ob)
+	switch level - options.headers {
+	case 0, 1:
+		ob.WriteString(".SH\n")
+		man_lines(ob, text)
+	case 2:
+		ob.WriteString(".SS\n")
+		man_lines(ob, text)
+	default:
+		ob.WriteString(".PP\n")
+		var bold bytes.Buffer
+		man_font(&bold, text, "B")
+		man_lines(ob, bold.Bytes())
+	}
+}
+
+/* reads "name(section) -- description" or a plain title off a header */
+func man_title(options *man_renderopt, text []byte) {
+	text = man_plain(text)
+	name := text
+	for _, sep := range []string{` \-\- `, ` \- `} {
+		if i := bytes.Index(text, []byte(sep)); i > 0 {
+			name = bytes.TrimRight(text[:i], " ")
+			options.description = bytes.TrimLeft(text[i+len(sep):], " ")
+			break
+		}
+	}
+	if n := len(name); n > 0 && name[n-1] == ')' {
+		if i := bytes.LastIndexByte(name, '('); i > 0 && i < n-2 {
+			options.section = name[i+1 : n-1]
+			name = bytes.TrimRight(name[:i], " ")
+		}
+	}
+	options.title = man_upper(name)
+	if len(options.description) > 0 {
+		options.name = name
+	}
+}
+
+func man_hrule(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("man_hrule"))
+	man_block(ob)
+	ob.WriteString(".PP\n.ce\n* * *\n")
+}
+
+/* tags the items, .TP for the "term:" items and .IP for the others */
+func man_list(ob *bytes.Buffer, text []byte, flags, start int, opaque interface{}) {
+	defer un(trace("man_list"))
+	man_block(ob)
+	ob.WriteByte(man_sublist)
+	items := bytes.Split(text, []byte{text_item})
+	for i, item := range items[1:] {
+		head := item
+		rest := []byte(nil)
+		if j := bytes.IndexByte(item, '\n'); j >= 0 {
+			head, rest = item[:j], item[j+1:]
+		}
+		n := len(head)
+		if n > 1 && head[n-1] == ':' && len(rest) > 0 {
+			ob.WriteString(".TP 4\n")
+			ob.Write(bytes.TrimRight(head[:n-1], " "))
+			ob.WriteByte('\n')
+			ob.Write(rest)
+			continue
+		}
+		if flags&MKD_LIST_ORDERED != 0 {
+			ob.WriteString(".IP " + strconv.Itoa(start+i) + ". 4\n")
+		} else {
+			ob.WriteString(".IP \\(bu 4\n")
+		}
+		ob.Write(item)
+	}
+}
+
+/* the running text of the item, then its other blocks indented like the
+ * text; lines of the text that aren't requests start with a tag */
+func man_listitem(ob *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+	defer un(trace("man_listitem"))
+	text = bytes.Trim(text, "\n")
+
+	var head, rest []byte
+	if flags&MKD_LI_BLOCK != 0 {
+		/* the lines of a first paragraph, already protected */
+		if bytes.HasPrefix(text, []byte(".PP\n")) {
+			text = text[4:]
+			end := len(text)
+			for i := 0; i < len(text); i++ {
+				if (i == 0 || text[i-1] == '\n') && (text[i] == '.' || text[i] == man_sublist) {
+					end = i
+					break
+				}
+			}
+			head, rest = text[:end], text[end:]
+		} else {
+			rest = text
+		}
+	} else {
+		end := bytes.IndexByte(text, man_sublist)
+		if end < 0 {
+			end = len(text)
+		}
+		var lines bytes.Buffer
+		man_lines(&lines, text[:end])
+		head, rest = lines.Bytes(), text[end:]
+	}
+
+	ob.WriteByte(text_item)
+	if head = bytes.TrimRight(head, "\n"); len(head) > 0 {
+		ob.Write(head)
+		ob.WriteByte('\n')
+	}
+	if rest = bytes.Trim(rest, "\n"); len(rest) > 0 {
+		ob.WriteString(".RS 4\n")
+		ob.Write(rest)
+		ob.WriteString("\n.RE\n")
+	}
+}
+
+func man_paragraph(ob *bytes.Buffer, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("man_paragraph"))
+	text = bytes.Trim(text, " \n")
+	if len(text) == 0 {
+		return
+	}
+	man_block(ob)
+	ob.WriteString(".PP\n")
+	man_lines(ob, text)
+}
+
+/* a tbl table, the header row in bold and ruled off */
+func man_table(ob *bytes.Buffer, header []byte, body []byte, opaque interface{}) {
+	defer un(trace("man_table"))
+	options, _ := opaque.(*man_renderopt)
+	options.tables = true
+	man_block(ob)
+
+	rows, aligns := text_table_rows(header, body)
+	ob.WriteString(".TS\n")
+	for _, bold := range []string{"b", "."} {
+		for i, align := range aligns {
+			if i > 0 {
+				ob.WriteByte(' ')
+			}
+			switch align {
+			case MKD_TABLE_ALIGN_R:
+				ob.WriteByte('r')
+			case MKD_TABLE_ALIGN_CENTER:
+				ob.WriteByte('c')
+			default:
+				ob.WriteByte('l')
+			}
+			if bold == "b" {
+				ob.WriteByte('b')
+			}
+		}
+		if bold == "." {
+			ob.WriteByte('.')
+		}
+		ob.WriteByte('\n')
+	}
+	for r, row := range rows {
+		for i, cell := range row {
+			if i > 0 {
+				ob.WriteByte('\t')
+			}
+			/* a dot starts a request, a lone _ or = is a rule */
+			if len(cell) > 0 && (cell[0] == '.' || cell[0] == '\'') ||
+				bytes.Equal(cell, []byte("_")) || bytes.Equal(cell, []byte("=")) {
+				ob.WriteString(`\&`)
+			}
+			ob.Write(cell)
+		}
+		ob.WriteByte('\n')
+		if r == 0 {
+			ob.WriteString("_\n")
+		}
+	}
+	ob.WriteString(".TE\n")
+}
+
+func man_tablerow(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("man_tablerow"))
+	ob.Write(text)
+	ob.WriteByte(text_row)
+}
+
+func man_tablecell(ob *bytes.Buffer, text []byte, align int, opaque interface{}) {
+	defer un(trace("man_tablecell"))
+	ob.WriteByte(text_cell)
+	ob.WriteByte(byte('0' + align))
+	text = bytes.Trim(text, " ")
+	text = bytes.Replace(text, []byte{'\t'}, []byte{' '}, -1)
+	text = bytes.Replace(text, []byte{text_break}, []byte{' '}, -1)
+	ob.Write(bytes.Replace(text, []byte{'\n'}, []byte{' '}, -1))
+}
+
+/* a page can't be folded: the summary in bold, then the body */
+func man_details(ob *bytes.Buffer, summary []byte, text []byte, open bool, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("man_details"))
+	man_paragraph(ob, man_bold(bytes.Trim(summary, " ")), nil, opaque)
+	if text = bytes.Trim(text, "\n"); len(text) > 0 {
+		man_block(ob)
+		ob.Write(text)
+		ob.WriteByte('\n')
+	}
+}
+
+func man_directive(ob *bytes.Buffer, name []byte, title []byte, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("man_directive"))
+	if title = bytes.Trim(title, " "); len(title) > 0 {
+		man_paragraph(ob, man_bold(title), nil, opaque)
+	}
+	if text = bytes.Trim(text, "\n"); len(text) > 0 {
+		man_block(ob)
+		ob.Write(text)
+		ob.WriteByte('\n')
+	}
+}
+
+func man_bold(text []byte) []byte {
+	var out bytes.Buffer
+	man_font(&out, text, "B")
+	return out.Bytes()
+}
+
+func man_autolink(ob *bytes.Buffer, link []byte, typ int, opaque interface{}) bool {
+	defer un(trace("man_autolink"))
+	if len(link) == 0 {
+		return false
+	}
+	man_escape(ob, bytes.TrimPrefix(link, []byte("mailto:")))
+	return true
+}
+
+func man_codespan(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("man_codespan"))
+	var code bytes.Buffer
+	man_escape(&code, text)
+	man_font(ob, code.Bytes(), "B")
+	return true
+}
+
+func man_double_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("man_double_emphasis"))
+	if len(text) == 0 {
+		return false
+	}
+	man_font(ob, text, "B")
+	return true
+}
+
+func man_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("man_emphasis"))
+	if len(text) == 0 {
+		return false
+	}
+	man_font(ob, text, "I")
+	return true
+}
+
+func man_triple_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("man_triple_emphasis"))
+	if len(text) == 0 {
+		return false
+	}
+	man_font(ob, text, "BI")
+	return true
+}
+
+/* roff has no strike through, the text is kept */
+func man_strikethrough(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("man_strikethrough"))
+	if len(text) == 0 {
+		return false
+	}
+	ob.Write(text)
+	return true
+}
+
+func man_image(ob *bytes.Buffer, link []byte, title []byte, alt []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("man_image"))
+	if len(link) == 0 {
+		return false
+	}
+	man_escape(ob, alt)
+	return true
+}
+
+func man_linebreak(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("man_linebreak"))
+	ob.WriteByte(text_break)
+	return true
+}
+
+/* the text of the link, then its url in angle brackets */
+func man_link(ob *bytes.Buffer, link []byte, title []byte, content []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("man_link"))
+	ob.Write(content)
+	if len(link) == 0 || text_is_url(man_plain(content), link) {
+		return true
+	}
+	ob.WriteString(" <")
+	man_escape(ob, link)
+	ob.WriteByte('>')
+	return true
+}
+
+/* inline html is dropped */
+func man_raw_html(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	return true
+}
+
+func man_emoji(ob *bytes.Buffer, name []byte, glyph []byte, image []byte, opaque interface{}) bool {
+	defer un(trace("man_emoji"))
+	if len(glyph) > 0 {
+		man_escape(ob, glyph)
+	} else {
+		ob.WriteByte(':')
+		man_escape(ob, name)
+		ob.WriteByte(':')
+	}
+	return true
+}
+
+func man_entity(ob *bytes.Buffer, entity []byte, opaque interface{}) {
+	defer un(trace("man_entity"))
+	man_escape(ob, []byte(html.UnescapeString(string(entity))))
+}
+
+func man_normal_text(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("man_normal_text"))
+	man_escape(ob, text)
+}
+
+/* puts the .TH line and the NAME section in front of the page */
+func man_finalize(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("man_finalize"))
+	options, _ := opaque.(*man_renderopt)
+
+	var out bytes.Buffer
+	if options.tables {
+		out.WriteString("'\\\" t\n")
+	}
+	if len(options.title) > 0 {
+		section := options.section
+		if len(section) == 0 {
+			section = []byte("1")
+		}
+		out.WriteString(".TH")
+		man_arg(&out, options.title)
+		man_arg(&out, section)
+		fields := [][]byte{options.date, options.source, options.manual}
+		for len(fields) > 0 && len(fields[len(fields)-1]) == 0 {
+			fields = fields[:len(fields)-1]
+		}
+		for _, field := range fields {
+			man_arg(&out, field)
+		}
+		out.WriteByte('\n')
+	}
+	if len(options.name) > 0 {
+		out.WriteString(".SH NAME\n")
+		man_lines(&out, append(append(options.name, ` \- `...), options.description...))
+	}
+	out.Write(bytes.Replace(ob.Bytes(), []byte{man_sublist}, nil, -1))
+
+	ob.Reset()
+	ob.Write(out.Bytes())
+}
+
+/* takes the fields of a front matter off the top of the document */
+func man_front_matter(ib []byte, options *man_renderopt) []byte {
+	fields, rest := front_matter(ib)
+	if fields == nil {
+		return ib
+	}
+	for _, key := range []string{"title", "section", "date", "source", "manual"} {
+		var value bytes.Buffer
+		man_escape(&value, fields[key])
+		fields[key] = value.Bytes()
+	}
+	options.title = man_upper(fields["title"])
+	options.section = fields["section"]
+	options.date = fields["date"]
+	options.source = fields["source"]
+	options.manual = fields["manual"]
+	return rest
+}
+
+func man_renderer(options *ManOptions) *mkd_renderer {
+	renderer := &mkd_renderer{
+		man_blockcode,
+		man_blockquote,
+		man_raw_block,
+		man_header,
+		man_hrule,
+		man_list,
+		man_listitem,
+		man_paragraph,
+		man_table,
+		man_tablerow,
+		man_tablecell,
+		nil,
+		man_details,
+		man_directive,
+
+		man_autolink,
+		man_codespan,
+		man_double_emphasis,
+		man_emphasis,
+		man_image,
+		man_linebreak,
+		man_link,
+		man_raw_html,
+		man_triple_emphasis,
+		man_strikethrough,
+		man_emoji,
+
+		man_entity,
+		man_normal_text,
+
+		nil,
+		man_finalize,
+		nil,
+		nil}
+
+	renderer.opaque = &man_renderopt{}
+	return renderer
+}
+
+func (opts *ManOptions) renderer() (*mkd_renderer, *Config) {
+	return man_renderer(opts), opts.Config
+}
+
+// MarkdownToMan renders the markdown document as a man page, roff source
+// for the man macros. A nil opts renders without extensions.
+func MarkdownToMan(ib []byte, opts *ManOptions) []byte {
+	defer un(trace("MarkdownToMan"))
+	if opts == nil {
+		opts = &ManOptions{}
+	}
+	renderer := man_renderer(opts)
+	ib = man_front_matter(ib, renderer.opaque.(*man_renderopt))
+	return ups_markdown(renderer, ib, opts.Extensions, opts.Config)
+}
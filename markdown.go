@@ -0,0 +1,1088 @@
+package markup
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Markdown renderer, the formatter behind MarkdownToMarkdown: the document
+ * is written back in a single style ("-" bullets, atx headers, fenced code,
+ * aligned pipe tables) without changing what it renders to.
+ *
+ * The callbacks get their content as rendered markdown, like the other
+ * renderers get it as html or text. What the parser doesn't hand over
+ * (escapes, code spans, autolinks, link destinations before unscape_text,
+ * the emphasis characters) is read from the mkd_source of the span, so
+ * that it is written back exactly as it was.
+ */
+
+/* markdown options */
+const (
+	MARKDOWN_INLINE_REFS = 1 << 0 /* reference links written as inline links */
+)
+
+// MarkdownOptions are the settings of MarkdownToMarkdown.
+type MarkdownOptions struct {
+	// Flags is a combination of the MARKDOWN_* flags.
+	Flags uint
+
+	// Extensions are the MKDEXT_* flags of the parser, the output only
+	// uses the syntax they enable.
+	Extensions uint
+
+	// Config holds the additional parser settings, it may be nil.
+	Config *Config
+}
+
+/* marks the blank line between two blocks in CommonMark, where the blocks
+ * of a tight list item can't be apart */
+const md_sep = '\x05'
+
+type md_renderopt struct {
+	flags  uint
+	ext    uint
+	source mkd_source
+
+	refs      []string        /* keys of the references kept, in order of use */
+	refs_used map[string]bool /* keys of the references used at all */
+
+	/* the list written last, which a list right after it must not
+	 * continue in CommonMark */
+	last_list   *bytes.Buffer
+	list_end    int
+	list_marker byte
+}
+
+/* starts a block, after a blank line if it follows another */
+func md_block(ob *bytes.Buffer, opaque interface{}) {
+	options, _ := opaque.(*md_renderopt)
+	if options.ext&MKDEXT_COMMONMARK == 0 {
+		text_block(ob)
+	} else if ob.Len() > 0 {
+		ensure_ends_with_nl(ob)
+		ob.WriteByte(md_sep)
+		ob.WriteByte('\n')
+	}
+}
+
+/* the blocks of a container, apart or, in a tight list item, not */
+func md_blocks(text []byte, apart bool) []byte {
+	sep := []byte("\n")
+	if !apart {
+		sep = nil
+	}
+	return bytes.Replace(text, []byte{md_sep, '\n'}, sep, -1)
+}
+
+/* copies text, dropping the markers of the intermediate output */
+func md_text(ob *bytes.Buffer, text []byte) {
+	for _, c := range text {
+		switch c {
+		case text_item, text_row, text_cell:
+		default:
+			ob.WriteByte(c)
+		}
+	}
+}
+
+/* writes an attribute value, quoted with what it doesn't contain */
+func md_attr_value(ob *bytes.Buffer, value []byte) {
+	q := byte('"')
+	if bytes.IndexByte(value, '"') >= 0 {
+		q = '\''
+		if bytes.IndexByte(value, '\'') >= 0 {
+			ob.Write(value)
+			return
+		}
+	}
+	ob.WriteByte(q)
+	ob.Write(value)
+	ob.WriteByte(q)
+}
+
+func is_attr_name(name []byte) bool {
+	for _, c := range name {
+		if !is_attr_name_char(c) {
+			return false
+		}
+	}
+	return len(name) > 0
+}
+
+/* writes the items of an attribute list: #id .class key="value" */
+func md_attr_items(ob *bytes.Buffer, attrs *mkd_attrs) {
+	sep := ""
+	if attrs.id != nil {
+		if is_attr_name(attrs.id) {
+			ob.WriteByte('#')
+			ob.Write(attrs.id)
+		} else {
+			ob.WriteString("id=")
+			md_attr_value(ob, attrs.id)
+		}
+		sep = " "
+	}
+	for _, class := range attrs.classes {
+		ob.WriteString(sep)
+		if is_attr_name(class) {
+			ob.WriteByte('.')
+			ob.Write(class)
+		} else {
+			ob.WriteString("class=")
+			md_attr_value(ob, class)
+		}
+		sep = " "
+	}
+	for _, pair := range attrs.pairs {
+		ob.WriteString(sep)
+		ob.Write(pair.key)
+		ob.WriteByte('=')
+		md_attr_value(ob, pair.value)
+		sep = " "
+	}
+}
+
+func md_attrs(ob *bytes.Buffer, attrs *mkd_attrs) {
+	ob.WriteByte('{')
+	md_attr_items(ob, attrs)
+	ob.WriteByte('}')
+}
+
+/* the fence of a colon block, longer than the fences in its body */
+func md_colon_fence(body []byte) string {
+	n := 3
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		i := skip_spaces(line, 3)
+		c := 0
+		for i < len(line) && line[i] == ':' {
+			i++
+			c++
+		}
+		if c >= n {
+			n = c + 1
+		}
+	}
+	return strings.Repeat(":", n)
+}
+
+/* whether the code can be fenced: no line of it may close the fence,
+ * or be taken for a reference definition once it isn't indented */
+func md_fenceable(text []byte) bool {
+	for len(text) > 0 {
+		if is_codefence(text, nil, nil, false) > 0 || is_ref(nil, text) > 0 {
+			return false
+		}
+		i := bytes.IndexByte(text, '\n')
+		if i < 0 {
+			break
+		}
+		text = text[i+1:]
+	}
+	return true
+}
+
+/* a fence of c longer than the runs of c starting the lines of the code */
+func md_code_fence(text []byte, c byte) string {
+	n := 3
+	for _, line := range bytes.Split(text, []byte("\n")) {
+		line = bytes.TrimLeft(line, " ")
+		i := 0
+		for i < len(line) && line[i] == c {
+			i++
+		}
+		if i >= n {
+			n = i + 1
+		}
+	}
+	return strings.Repeat(string(c), n)
+}
+
+func md_blockcode(ob *bytes.Buffer, text []byte, lang []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("md_blockcode"))
+	options, _ := opaque.(*md_renderopt)
+	md_block(ob, opaque)
+	/* the blank lines at the end of a fenced block are code */
+	cm := options.ext&MKDEXT_COMMONMARK != 0
+	if !cm {
+		text = bytes.TrimRight(text, "\n")
+	}
+
+	if !cm && (options.ext&MKDEXT_FENCED_CODE == 0 || !md_fenceable(text)) {
+		for _, line := range bytes.Split(text, []byte("\n")) {
+			if len(line) > 0 {
+				ob.WriteString("    ")
+				ob.Write(line)
+			}
+			ob.WriteByte('\n')
+		}
+		return
+	}
+
+	fence := "```"
+	if bytes.IndexByte(lang, '`') >= 0 {
+		fence = "~~~"
+	}
+	if cm {
+		/* longer than the fences in the code */
+		fence = md_code_fence(text, fence[0])
+	}
+	ob.WriteString(fence)
+	if bytes.IndexAny(lang, " \t") >= 0 {
+		ob.WriteByte('{')
+		ob.Write(lang)
+		ob.WriteByte('}')
+	} else {
+		ob.Write(lang)
+	}
+	if attrs != nil {
+		ob.WriteByte(' ')
+		if options.ext&MKDEXT_ATTRIBUTES != 0 {
+			md_attrs(ob, attrs)
+		} else {
+			md_attr_items(ob, attrs)
+		}
+	}
+	ob.WriteByte('\n')
+	if len(text) > 0 {
+		ob.Write(text)
+		ensure_ends_with_nl(ob)
+	}
+	ob.WriteString(fence)
+	ob.WriteByte('\n')
+}
+
+func md_blockquote(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("md_blockquote"))
+	md_block(ob, opaque)
+	text_indent(ob, bytes.Trim(md_blocks(text, true), "\n"), "> ", "> ")
+}
+
+func md_raw_block(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("md_raw_block"))
+	md_block(ob, opaque)
+	ob.Write(bytes.Trim(text, "\n"))
+	ob.WriteByte('\n')
+}
+
+func md_header(ob *bytes.Buffer, text []byte, level int, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("md_header"))
+	options, _ := opaque.(*md_renderopt)
+	md_block(ob, opaque)
+
+	/* setext headers may span lines, which an atx header can't */
+	setext := level <= 2 && bytes.IndexByte(text, '\n') >= 0
+	if !setext {
+		ob.WriteString(strings.Repeat("#", level))
+		ob.WriteByte(' ')
+	}
+	if setext {
+		var lines bytes.Buffer
+		md_text(&lines, text)
+		md_paragraph_lines(ob, options, lines.Bytes())
+	} else {
+		md_text(ob, text)
+		/* a text ending in hashes takes a closing sequence, which the
+		 * parsers strip rather than the hashes of the text */
+		if ob.Len() > 0 && ob.Bytes()[ob.Len()-1] == '#' {
+			ob.WriteString(" #")
+		}
+	}
+	if attrs != nil {
+		ob.WriteByte(' ')
+		md_attrs(ob, attrs)
+	}
+	ob.WriteByte('\n')
+	if setext {
+		if level == 1 {
+			ob.WriteString("===\n")
+		} else {
+			ob.WriteString("---\n")
+		}
+	}
+}
+
+/* "* * *" rather than "---", which would be a rule in a list item too */
+func md_hrule(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("md_hrule"))
+	md_block(ob, opaque)
+	ob.WriteString("* * *\n")
+}
+
+/* bullets the items; the blank line after an item makes it a block item */
+func md_list(ob *bytes.Buffer, text []byte, flags, start int, opaque interface{}) {
+	defer un(trace("md_list"))
+	options, _ := opaque.(*md_renderopt)
+	cm := options.ext&MKDEXT_COMMONMARK != 0
+	marker, other := byte('-'), byte('*')
+	if flags&MKD_LIST_ORDERED != 0 {
+		marker, other = '.', ')'
+	}
+	/* in CommonMark a list right after a list of the same marker would
+	 * continue it, it takes the other marker */
+	if cm && options.last_list == ob && options.list_end == ob.Len() && options.list_marker == marker {
+		marker = other
+	}
+
+	md_block(ob, opaque)
+	items := bytes.Split(text, []byte{text_item})[1:]
+	for i, item := range items {
+		bullet := string(marker) + " "
+		if flags&MKD_LIST_ORDERED != 0 {
+			bullet = strconv.Itoa(start+i) + string(marker) + " "
+		}
+		/* CommonMark takes the content at the column after the bullet */
+		indent := "    "
+		if cm {
+			indent = strings.Repeat(" ", len(bullet))
+		}
+		item = bytes.Trim(item, "\n")
+		if len(item) == 0 {
+			ob.WriteString(bullet)
+			ob.WriteByte('\n')
+		} else {
+			text_indent(ob, item, bullet, indent)
+		}
+		if i+1 < len(items) && (md_block_item(items[i]) || md_block_item(items[i+1])) {
+			ob.WriteByte('\n')
+		}
+	}
+	options.last_list = ob
+	options.list_end = ob.Len()
+	options.list_marker = marker
+}
+
+/* whether the item rendered by md_listitem is a block item. An empty
+ * item renders the same either way, a blank line after it would make the
+ * list loose. */
+func md_block_item(item []byte) bool {
+	return len(item) > 0 && item[0] == '\n' && len(bytes.Trim(item, "\n")) > 0
+}
+
+func md_listitem(ob *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+	defer un(trace("md_listitem"))
+	options, _ := opaque.(*md_renderopt)
+	ob.WriteByte(text_item)
+	if flags&MKD_LI_BLOCK != 0 {
+		ob.WriteByte('\n')
+		ob.Write(md_blocks(text, true))
+		return
+	}
+
+	if options.ext&MKDEXT_COMMONMARK != 0 {
+		/* the blocks of a tight item follow each other */
+		first := text
+		if i := bytes.IndexByte(text, md_sep); i >= 0 {
+			first = text[:i]
+		}
+		md_paragraph_lines(ob, options, first)
+		ob.Write(md_blocks(text[len(first):], false))
+		return
+	}
+
+	/* the sublist follows the inline content without a blank line */
+	if i := bytes.Index(text, []byte("\n\n")); i >= 0 {
+		md_paragraph_lines(ob, options, text[:i+1])
+		ob.Write(text[i+2:])
+	} else {
+		md_paragraph_lines(ob, options, text)
+	}
+}
+
+/* whether the line would start a block after a line of a paragraph, in
+ * CommonMark */
+func md_cm_interrupts(line []byte) bool {
+	if len(line) == 0 {
+		return false
+	}
+	switch c := line[0]; c {
+	case '>':
+		return true
+	case '#':
+		n := 0
+		for n < len(line) && line[n] == '#' {
+			n++
+		}
+		return n <= 6 && (n == len(line) || is_space_tab(line[n]))
+	case '`':
+		return bytes.HasPrefix(line, []byte("```")) && bytes.IndexByte(bytes.TrimLeft(line, "`"), '`') < 0
+	case '~':
+		return bytes.HasPrefix(line, []byte("~~~"))
+	case '<':
+		for t := 1; t <= 6; t++ {
+			if cm_html_block_start(nil, line, t) {
+				return true
+			}
+		}
+		return false
+	case '=', '-':
+		if is_setext_line(line) {
+			return true
+		}
+	}
+	if is_hrule_cm(line) {
+		return true
+	}
+
+	/* a list item, with some content */
+	n := 0
+	if line[0] == '-' || line[0] == '+' || line[0] == '*' {
+		n = 1
+	} else {
+		for n < len(line) && line[n] >= '0' && line[n] <= '9' {
+			n++
+		}
+		if n == 0 || n >= len(line) || (line[n] != '.' && line[n] != ')') {
+			return false
+		}
+		n++
+	}
+	return n < len(line) && is_space_tab(line[n]) && len(bytes.Trim(line[n:], " \t")) > 0
+}
+
+/* writes the lines of a paragraph; in CommonMark those that would start a
+ * block are indented, which a paragraph line may be */
+func md_paragraph_lines(ob *bytes.Buffer, options *md_renderopt, text []byte) {
+	first := text
+	if i := bytes.IndexByte(text, '\n'); i >= 0 {
+		first = text[:i]
+	}
+	/* the text of a tight list item may start with a block */
+	if options.ext&MKDEXT_COMMONMARK == 0 || md_cm_interrupts(first) {
+		ob.Write(text)
+		return
+	}
+	for i, line := range bytes.SplitAfter(text, []byte("\n")) {
+		if i > 0 && md_cm_interrupts(line) {
+			ob.WriteString("    ")
+		}
+		ob.Write(line)
+	}
+}
+
+func md_paragraph(ob *bytes.Buffer, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("md_paragraph"))
+	options, _ := opaque.(*md_renderopt)
+	md_block(ob, opaque)
+	md_paragraph_lines(ob, options, text)
+	ensure_ends_with_nl(ob)
+	if attrs != nil {
+		ob.WriteString("{: ")
+		md_attr_items(ob, attrs)
+		ob.WriteString("}\n")
+	}
+}
+
+/* the rule under the header of a column, at least three characters */
+func md_table_rule(ob *bytes.Buffer, width int, align int) {
+	switch align {
+	case MKD_TABLE_ALIGN_L:
+		ob.WriteByte(':')
+		ob.WriteString(strings.Repeat("-", width-1))
+	case MKD_TABLE_ALIGN_R:
+		ob.WriteString(strings.Repeat("-", width-1))
+		ob.WriteByte(':')
+	case MKD_TABLE_ALIGN_CENTER:
+		ob.WriteByte(':')
+		ob.WriteString(strings.Repeat("-", width-2))
+		ob.WriteByte(':')
+	default:
+		ob.WriteString(strings.Repeat("-", width))
+	}
+}
+
+func md_table(ob *bytes.Buffer, header []byte, body []byte, opaque interface{}) {
+	defer un(trace("md_table"))
+	md_block(ob, opaque)
+
+	rows, aligns := text_table_rows(header, body)
+	widths := make([]int, len(aligns))
+	for i := range widths {
+		widths[i] = 3
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if w := text_width(cell); i < len(widths) && w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+
+	for r, row := range rows {
+		ob.WriteByte('|')
+		for i, w := range widths {
+			var cell []byte
+			if i < len(row) {
+				cell = row[i]
+			}
+			pad := w - text_width(cell)
+			left := 0
+			switch aligns[i] {
+			case MKD_TABLE_ALIGN_R:
+				left = pad
+			case MKD_TABLE_ALIGN_CENTER:
+				left = pad / 2
+			}
+			ob.WriteString(strings.Repeat(" ", left+1))
+			ob.Write(cell)
+			ob.WriteString(strings.Repeat(" ", pad-left+1))
+			ob.WriteByte('|')
+		}
+		ob.WriteByte('\n')
+
+		if r == 0 {
+			ob.WriteByte('|')
+			for i, w := range widths {
+				ob.WriteByte(' ')
+				md_table_rule(ob, w, aligns[i])
+				ob.WriteString(" |")
+			}
+			ob.WriteByte('\n')
+		}
+	}
+}
+
+func md_tablerow(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("md_tablerow"))
+	ob.Write(text)
+	ob.WriteByte(text_row)
+}
+
+func md_tablecell(ob *bytes.Buffer, text []byte, align int, opaque interface{}) {
+	defer un(trace("md_tablecell"))
+	ob.WriteByte(text_cell)
+	ob.WriteByte(byte('0' + align))
+	ob.Write(bytes.Trim(text, " "))
+}
+
+/* the kind of a "???" block, when the attributes are nothing but a kind */
+func md_details_kind(attrs *mkd_attrs) ([]byte, bool) {
+	if attrs == nil {
+		return nil, true
+	}
+	if attrs.id != nil || len(attrs.pairs) > 0 || len(attrs.classes) != 1 {
+		return nil, false
+	}
+	for _, c := range attrs.classes[0] {
+		if !isalnum(c) && c != '-' && c != '_' {
+			return nil, false
+		}
+	}
+	return attrs.classes[0], true
+}
+
+/* "???" blocks when the summary can be quoted, colon fences otherwise */
+func md_details(ob *bytes.Buffer, summary []byte, text []byte, open bool, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("md_details"))
+	md_block(ob, opaque)
+	text = bytes.Trim(md_blocks(text, true), "\n")
+
+	if kind, ok := md_details_kind(attrs); ok && bytes.IndexAny(summary, "\"\\\n") < 0 {
+		ob.WriteString("???")
+		if open {
+			ob.WriteByte('+')
+		}
+		if len(kind) > 0 {
+			ob.WriteByte(' ')
+			ob.Write(kind)
+		}
+		ob.WriteString(" \"")
+		ob.Write(summary)
+		ob.WriteString("\"\n")
+		if len(text) > 0 {
+			text_indent(ob, text, "    ", "    ")
+		}
+		return
+	}
+
+	fence := md_colon_fence(text)
+	ob.WriteString(fence)
+	ob.WriteString("details ")
+	md_text(ob, summary)
+	if attrs != nil {
+		ob.WriteByte(' ')
+		md_attrs(ob, attrs)
+	}
+	ob.WriteByte('\n')
+	if len(text) > 0 {
+		ob.Write(text)
+		ob.WriteByte('\n')
+	}
+	ob.WriteString(fence)
+	ob.WriteByte('\n')
+}
+
+func md_directive(ob *bytes.Buffer, name []byte, title []byte, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("md_directive"))
+	md_block(ob, opaque)
+	text = bytes.Trim(md_blocks(text, true), "\n")
+
+	fence := md_colon_fence(text)
+	ob.WriteString(fence)
+	if len(name) > 0 {
+		ob.WriteByte(' ')
+		ob.Write(name)
+	}
+	if attrs != nil {
+		ob.WriteByte(' ')
+		md_attrs(ob, attrs)
+	}
+	if len(title) > 0 {
+		ob.WriteByte(' ')
+		md_text(ob, title)
+	}
+	ob.WriteByte('\n')
+	if len(text) > 0 {
+		ob.Write(text)
+		ob.WriteByte('\n')
+	}
+	ob.WriteString(fence)
+	ob.WriteByte('\n')
+}
+
+func md_autolink(ob *bytes.Buffer, link []byte, typ int, opaque interface{}) bool {
+	defer un(trace("md_autolink"))
+	options, _ := opaque.(*md_renderopt)
+	if len(link) == 0 {
+		return false
+	}
+	if options.source.text != nil {
+		ob.Write(options.source.text)
+	} else {
+		ob.WriteByte('<')
+		ob.Write(link)
+		ob.WriteByte('>')
+	}
+	return true
+}
+
+func md_codespan(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("md_codespan"))
+	options, _ := opaque.(*md_renderopt)
+	if options.source.text != nil {
+		ob.Write(options.source.text)
+		return true
+	}
+
+	/* a fence longer than the backticks of the code */
+	n, run := 1, 0
+	for _, c := range text {
+		if c == '`' {
+			run++
+			if run >= n {
+				n = run + 1
+			}
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", n)
+	ob.WriteString(fence)
+	ob.WriteByte(' ')
+	ob.Write(text)
+	ob.WriteByte(' ')
+	ob.WriteString(fence)
+	return true
+}
+
+/* emphasis written with the character it had, n times */
+func md_emph(ob *bytes.Buffer, text []byte, opaque interface{}, n int, c byte) bool {
+	options, _ := opaque.(*md_renderopt)
+	if len(text) == 0 {
+		return false
+	}
+	if options.source.delim != 0 {
+		c = options.source.delim
+	}
+	delim := bytes.Repeat([]byte{c}, n)
+	ob.Write(delim)
+	ob.Write(text)
+	ob.Write(delim)
+	return true
+}
+
+func md_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("md_emphasis"))
+	return md_emph(ob, text, opaque, 1, '*')
+}
+
+func md_double_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("md_double_emphasis"))
+	return md_emph(ob, text, opaque, 2, '*')
+}
+
+func md_triple_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("md_triple_emphasis"))
+	return md_emph(ob, text, opaque, 3, '*')
+}
+
+func md_strikethrough(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("md_strikethrough"))
+	return md_emph(ob, text, opaque, 2, '~')
+}
+
+/* writes a destination for an inline link: the unescaped ) and quotes
+ * would end it, and angle brackets around it would be removed */
+func md_destination(ob *bytes.Buffer, link []byte) {
+	size := len(link)
+	wrap := size > 0 && (link[0] == '<' || link[size-1] == '>')
+	if wrap {
+		ob.WriteByte('<')
+	}
+	for i := 0; i < size; i++ {
+		switch c := link[i]; c {
+		case '\\':
+			ob.WriteByte(c)
+			if i+1 < size {
+				i++
+				ob.WriteByte(link[i])
+			}
+		case ')', '"', '\'':
+			ob.WriteByte('\\')
+			ob.WriteByte(c)
+		default:
+			ob.WriteByte(c)
+		}
+	}
+	if wrap {
+		ob.WriteByte('>')
+	}
+}
+
+/* writes a CommonMark destination from its source: between angle
+ * brackets when it has spaces, with its parentheses escaped otherwise */
+func md_destination_cm(ob *bytes.Buffer, link []byte) {
+	size := len(link)
+	pointy := len(link) == 0 || bytes.IndexAny(link, " \t<>") >= 0
+	if pointy {
+		ob.WriteByte('<')
+	}
+	for i := 0; i < size; i++ {
+		switch c := link[i]; c {
+		case '\\':
+			ob.WriteByte(c)
+			if i+1 < size {
+				i++
+				ob.WriteByte(link[i])
+			}
+		case '<', '>':
+			ob.WriteByte('\\')
+			ob.WriteByte(c)
+		case '(', ')':
+			if !pointy {
+				ob.WriteByte('\\')
+			}
+			ob.WriteByte(c)
+		default:
+			ob.WriteByte(c)
+		}
+	}
+	if pointy {
+		ob.WriteByte('>')
+	}
+}
+
+/* writes unescaped text so that CommonMark reads it back the same: the
+ * backslashes and the quote get escaped */
+func md_cm_escape(ob *bytes.Buffer, text []byte, quote byte) {
+	for i, c := range text {
+		if c == quote || (c == '\\' && (i+1 == len(text) || ispunct(text[i+1]))) {
+			ob.WriteByte('\\')
+		}
+		ob.WriteByte(c)
+	}
+}
+
+/* writes an unescaped CommonMark destination, between angle brackets when
+ * it has spaces or parentheses */
+func md_cm_link(ob *bytes.Buffer, link []byte) {
+	pointy := len(link) == 0 || bytes.IndexAny(link, " \t()<>") >= 0
+	if pointy {
+		ob.WriteByte('<')
+	}
+	for i, c := range link {
+		if c == '<' || c == '>' || (c == '\\' && (i+1 == len(link) || ispunct(link[i+1]))) {
+			ob.WriteByte('\\')
+		}
+		ob.WriteByte(c)
+	}
+	if pointy {
+		ob.WriteByte('>')
+	}
+}
+
+/* writes "[id]" for a reference, "(link "title")" otherwise */
+func md_link_target(ob *bytes.Buffer, options *md_renderopt, link []byte) {
+	src := &options.source
+	if src.ref != nil {
+		key := string(bytes.ToLower(src.ref))
+		if options.ext&MKDEXT_COMMONMARK != 0 {
+			key = cm_ref_key(src.ref)
+		}
+		if lr := src.refs[key]; lr != nil {
+			options.refs_used[key] = true
+
+			/* a title with a parenthesis can't be written inline, and
+			 * a definition needs a link */
+			inline := options.flags&MARKDOWN_INLINE_REFS != 0 || len(lr.link) == 0
+			if !inline || (len(lr.link) > 0 && bytes.IndexByte(lr.title, ')') >= 0) {
+				if !str_in(options.refs, key) {
+					options.refs = append(options.refs, key)
+				}
+				ob.WriteByte('[')
+				ob.Write(src.ref)
+				ob.WriteByte(']')
+				return
+			}
+		}
+	}
+
+	dest, title := src.link, src.title
+	if src.ref == nil && dest == nil {
+		dest = link
+	}
+	/* the link and title of a CommonMark reference are unescaped */
+	cm := options.ext&MKDEXT_COMMONMARK != 0
+	ob.WriteByte('(')
+	switch {
+	case cm && src.ref != nil:
+		md_cm_link(ob, dest)
+	case cm:
+		md_destination_cm(ob, dest)
+	default:
+		md_destination(ob, dest)
+	}
+	if len(title) > 0 {
+		q, end := src.delim, src.delim
+		if src.ref != nil || q == 0 {
+			q, end = '"', '"'
+		} else if q == '(' {
+			end = ')'
+		}
+		if len(dest) > 0 || cm {
+			ob.WriteByte(' ')
+		}
+		ob.WriteByte(q)
+		if cm && src.ref != nil {
+			md_cm_escape(ob, title, q)
+		} else {
+			ob.Write(title)
+		}
+		ob.WriteByte(end)
+	}
+	ob.WriteByte(')')
+}
+
+func str_in(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func md_image(ob *bytes.Buffer, link []byte, title []byte, alt []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("md_image"))
+	options, _ := opaque.(*md_renderopt)
+	if len(link) == 0 {
+		return false
+	}
+	ob.WriteString("![")
+	ob.Write(alt)
+	ob.WriteByte(']')
+	md_link_target(ob, options, link)
+	if attrs != nil {
+		md_attrs(ob, attrs)
+	}
+	return true
+}
+
+func md_linebreak(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("md_linebreak"))
+	if len(text) == 0 {
+		text = []byte("  \n")
+	}
+	ob.Write(text)
+	return true
+}
+
+func md_link(ob *bytes.Buffer, link []byte, title []byte, content []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("md_link"))
+	options, _ := opaque.(*md_renderopt)
+
+	/* autolinked urls, mentions and wiki links are written as they were */
+	if options.source.text != nil {
+		ob.Write(options.source.text)
+		return true
+	}
+
+	ob.WriteByte('[')
+	ob.Write(content)
+	ob.WriteByte(']')
+	md_link_target(ob, options, link)
+	if attrs != nil {
+		md_attrs(ob, attrs)
+	}
+	return true
+}
+
+func md_raw_html(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("md_raw_html"))
+	ob.Write(text)
+	return true
+}
+
+func md_emoji(ob *bytes.Buffer, name []byte, glyph []byte, image []byte, opaque interface{}) bool {
+	defer un(trace("md_emoji"))
+	ob.WriteByte(':')
+	ob.Write(name)
+	ob.WriteByte(':')
+	return true
+}
+
+func md_entity(ob *bytes.Buffer, entity []byte, opaque interface{}) {
+	defer un(trace("md_entity"))
+	ob.Write(entity)
+}
+
+func md_normal_text(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("md_normal_text"))
+	options, _ := opaque.(*md_renderopt)
+	if options.source.text != nil {
+		/* an escaped character keeps its backslash */
+		ob.Write(options.source.text)
+		return
+	}
+	md_text(ob, text)
+}
+
+/* writes one reference definition */
+func md_reference(ob *bytes.Buffer, options *md_renderopt, lr *LinkRef) {
+	cm := options.ext&MKDEXT_COMMONMARK != 0
+	ob.WriteByte('[')
+	ob.Write(lr.id)
+	ob.WriteString("]: ")
+	if cm {
+		md_cm_link(ob, lr.link)
+	} else {
+		ob.Write(lr.link)
+	}
+	if len(lr.title) > 0 {
+		ob.WriteString(" \"")
+		if cm {
+			md_cm_escape(ob, lr.title, '"')
+		} else {
+			ob.Write(lr.title)
+		}
+		ob.WriteByte('"')
+	}
+	ob.WriteByte('\n')
+}
+
+/* collects the reference definitions at the end: the ones the links
+ * refer to in order of use, then the unused ones */
+func md_finalize(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("md_finalize"))
+	options, _ := opaque.(*md_renderopt)
+	refs := options.source.refs
+
+	keys := options.refs
+	var unused []string
+	for key, lr := range refs {
+		if !options.refs_used[key] && len(lr.link) > 0 {
+			unused = append(unused, key)
+		}
+	}
+	sort.Strings(unused)
+	keys = append(keys, unused...)
+
+	text := bytes.TrimRight(md_blocks(ob.Bytes(), true), "\n")
+	var out bytes.Buffer
+	if len(text) > 0 {
+		out.Write(text)
+		out.WriteByte('\n')
+	}
+	if len(keys) > 0 {
+		text_block(&out)
+		for _, key := range keys {
+			md_reference(&out, options, refs[key])
+		}
+	}
+
+	ob.Reset()
+	ob.Write(out.Bytes())
+}
+
+func markdown_renderer(options *MarkdownOptions) *mkd_renderer {
+	renderer := &mkd_renderer{
+		md_blockcode,
+		md_blockquote,
+		md_raw_block,
+		md_header,
+		md_hrule,
+		md_list,
+		md_listitem,
+		md_paragraph,
+		md_table,
+		md_tablerow,
+		md_tablecell,
+		nil,
+		md_details,
+		md_directive,
+
+		md_autolink,
+		md_codespan,
+		md_double_emphasis,
+		md_emphasis,
+		md_image,
+		md_linebreak,
+		md_link,
+		md_raw_html,
+		md_triple_emphasis,
+		md_strikethrough,
+		md_emoji,
+
+		md_entity,
+		md_normal_text,
+
+		nil,
+		md_finalize,
+		nil,
+		nil}
+
+	opts := &md_renderopt{
+		flags:     options.Flags,
+		ext:       options.Extensions,
+		refs_used: make(map[string]bool),
+	}
+	renderer.opaque = opts
+	renderer.source = &opts.source
+	return renderer
+}
+
+func (opts *MarkdownOptions) renderer() (*mkd_renderer, *Config) {
+	return markdown_renderer(opts), nil
+}
+
+// MarkdownToMarkdown formats the markdown document: "-" bullets, atx
+// headers, fenced code and aligned pipe tables, the reference definitions
+// collected at the end. The formatted document renders to the same html,
+// and formatting it again changes nothing. A nil opts uses the defaults.
+func MarkdownToMarkdown(ib []byte, opts *MarkdownOptions) []byte {
+	if opts == nil {
+		opts = &MarkdownOptions{}
+	}
+
+	/* includes are left to the reader of the output, and directives
+	 * written back rather than handed to the Config */
+	var cfg Config
+	if opts.Config != nil {
+		cfg = *opts.Config
+	}
+	cfg.Directives = nil
+
+	return ups_markdown(markdown_renderer(opts), ib, opts.Extensions&^MKDEXT_INCLUDE, &cfg)
+}
@@ -3,6 +3,10 @@ package markup
 import (
 	"bytes"
 	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
 )
 
@@ -17,10 +21,35 @@ const (
 )
 
 type LinkRef struct {
+	id    []byte /* as written in the definition */
 	link  []byte
 	title []byte
 }
 
+/* markdown source of the span handed to the next callback */
+type mkd_source struct {
+	refs map[string]*LinkRef /* reference definitions of the document */
+
+	text  []byte /* source of an escape, code span, autolink or generated link */
+	link  []byte /* link destination before unscape_text */
+	title []byte /* link title */
+	ref   []byte /* id of a reference link */
+	delim byte   /* character of an emphasis, quote of a link title */
+}
+
+/* a single key=value pair of an attribute list */
+type mkd_attr struct {
+	key   []byte
+	value []byte
+}
+
+/* attribute list attached to a block or span: {#id .class key=value} */
+type mkd_attrs struct {
+	id      []byte
+	classes [][]byte
+	pairs   []mkd_attr
+}
+
 const (
 	MD_CHAR_NONE = iota
 	MD_CHAR_EMPHASIS
@@ -31,11 +60,16 @@ const (
 	MD_CHAR_ESCAPE
 	MD_CHAR_ENTITITY
 	MD_CHAR_AUTOLINK
+	MD_CHAR_EMOJI
+	MD_CHAR_MENTION
+	MD_CHAR_ISSUE
+	MD_CHAR_AUTOLINK_WWW
+	MD_CHAR_AUTOLINK_EMAIL
 )
 
 type TriggerFunc func(ob *bytes.Buffer, rndr *render, data []byte, offset int) int
 
-var markdown_char_ptrs []TriggerFunc = []TriggerFunc{nil, nil, nil, nil, nil, nil, nil, nil, nil}
+var markdown_char_ptrs []TriggerFunc = []TriggerFunc{nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil}
 
 func init_markdown_char_ptrs() {
 	markdown_char_ptrs[MD_CHAR_EMPHASIS] = char_emphasis
@@ -46,8 +80,63 @@ func init_markdown_char_ptrs() {
 	markdown_char_ptrs[MD_CHAR_ESCAPE] = char_escape
 	markdown_char_ptrs[MD_CHAR_ENTITITY] = char_entity
 	markdown_char_ptrs[MD_CHAR_AUTOLINK] = char_autolink
+	markdown_char_ptrs[MD_CHAR_EMOJI] = char_emoji
+	markdown_char_ptrs[MD_CHAR_MENTION] = char_mention
+	markdown_char_ptrs[MD_CHAR_ISSUE] = char_issue
+	markdown_char_ptrs[MD_CHAR_AUTOLINK_WWW] = char_autolink_www
+	markdown_char_ptrs[MD_CHAR_AUTOLINK_EMAIL] = char_autolink_email
 }
 
+// Config holds the settings that can't be expressed as option or
+// extension flags. A nil *Config behaves like the zero value.
+type Config struct {
+	// WikiResolver maps the page name of a [[Page Name]] link to its url
+	// and reports whether the page exists (MKDEXT_WIKI_LINKS). The anchor
+	// of a [[Page Name#Section]] link is added to the url, without being
+	// passed to it. By default pages link to their name with spaces turned
+	// into '_'.
+	WikiResolver func(page string) (url string, exists bool)
+
+	// Emoji adds shortcodes to, or overrides shortcodes of, the built-in
+	// emoji table (MKDEXT_EMOJI), those of GitHub that have a Unicode
+	// glyph, e.g. "shipit": "\U0001F43F".
+	Emoji map[string]string
+
+	// EmojiImages maps custom shortcodes to image urls; these are rendered
+	// as <img> and take precedence over the emoji tables.
+	EmojiImages map[string]string
+
+	// UserResolver maps an @user mention to the user's url
+	// (MKDEXT_MENTIONS). Mentions it doesn't resolve stay plain text.
+	UserResolver func(user string) (url string, ok bool)
+
+	// IssueResolver maps an issue reference to its url. repo is empty
+	// for #123 and "org/repo" for org/repo#123.
+	IssueResolver func(repo string, number int) (url string, ok bool)
+
+	// FS is where {{include "file.md"}} directives and include="file"
+	// code blocks read from (MKDEXT_INCLUDE). Paths are relative to the
+	// including file and can't leave the root of FS.
+	FS fs.FS
+
+	// MaxIncludeDepth limits the nesting of includes, 8 if zero.
+	MaxIncludeDepth int
+
+	// BlockTags adds (true) or removes (false) tag names, in lower case,
+	// from the html tags that start a raw html block.
+	BlockTags map[string]bool
+
+	// Directives renders ::: name blocks by name (MKDEXT_DIRECTIVES).
+	// Blocks without a handler, or whose handler returns false, are
+	// wrapped in <div class="name">.
+	Directives map[string]Directive
+}
+
+// Directive renders the block of a ::: name fence. title is the text after
+// the name, attrs the attribute list ({#id .class key="value"}, with the
+// classes joined under "class") and content the rendered body.
+type Directive func(name, title string, attrs map[string]string, content []byte) (html []byte, ok bool)
+
 type render struct {
 	make        *mkd_renderer
 	refs        map[string]*LinkRef
@@ -55,6 +144,26 @@ type render struct {
 	ext_flags   uint
 	nesting     int
 	max_nesting int
+	in_link     int
+	raw_link    int /* raw <a> tags left open in the current block */
+	includes    []string /* stack of included files, for cycle detection */
+	block_tags  map[string]bool
+	cfg         *Config
+	figure      *mkd_figure /* set while parsing a figure image */
+}
+
+/* title and alt text of the image of a figure, for the caption */
+type mkd_figure struct {
+	title []byte
+	alt   []byte
+}
+
+/* hands the source of the next span to the renderer, when it wants it */
+func set_source(rndr *render, src mkd_source) {
+	if rndr.make.source != nil {
+		src.refs = rndr.make.source.refs
+		*rndr.make.source = src
+	}
 }
 
 var funcNestLevel int = 0
@@ -108,7 +217,7 @@ func is_nl2(c byte) bool {
 
 func remove_from_end(b *bytes.Buffer, c byte) {
 	d := b.Bytes()
-	if len(d) > 0 && d[len(d)-1] == 'c' {
+	if len(d) > 0 && d[len(d)-1] == c {
 		b.Truncate(b.Len() - 1)
 	}
 }
@@ -134,7 +243,24 @@ func trim_right(b *bytes.Buffer, c byte) {
 	}
 }
 
-var block_tags [][]byte = [][]byte{[]byte("p"), []byte("dl"), []byte("h1"), []byte("h2"), []byte("h3"), []byte("h4"), []byte("h5"), []byte("h6"), []byte("ol"), []byte("ul"), []byte("del"), []byte("div"), []byte("ins"), []byte("pre"), []byte("form"), []byte("math"), []byte("table"), []byte("iframe"), []byte("script"), []byte("fieldset"), []byte("noscript"), []byte("blockquote")}
+/* tags that start an html block, see Config.BlockTags for changing the set;
+ * <hr> is handled on its own as it has no closing tag */
+var block_tags = map[string]bool{
+	"address": true, "article": true, "aside": true, "audio": true,
+	"blockquote": true, "canvas": true, "caption": true, "center": true,
+	"colgroup": true, "dd": true, "del": true, "details": true, "dialog": true,
+	"dir": true, "div": true, "dl": true, "dt": true, "fieldset": true,
+	"figcaption": true, "figure": true, "footer": true, "form": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hgroup": true, "iframe": true, "ins": true, "legend": true,
+	"li": true, "main": true, "math": true, "menu": true, "nav": true,
+	"noscript": true, "object": true, "ol": true, "optgroup": true,
+	"option": true, "output": true, "p": true, "picture": true, "pre": true,
+	"script": true, "search": true, "section": true, "summary": true,
+	"svg": true, "table": true, "tbody": true, "td": true, "template": true,
+	"tfoot": true, "th": true, "thead": true, "tr": true, "ul": true,
+	"video": true,
+}
 
 
 var INS_TAG []byte = []byte("ins")
@@ -144,11 +270,11 @@ var DEL_TAG []byte = []byte("del")
  * HELPER FUNCTIONS *
  ***************************/
 func is_safe_link(link []byte) bool {
-	valid_uris := [4]string{"http://", "https://", "ftp://", "mailto://"}
+	valid_uris := [4]string{"http://", "https://", "ftp://", "mailto:"}
 
 	for i := 0; i < 4; i++ {
 		uri := []byte(valid_uris[i])
-		if bytes.HasPrefix(link, uri) && isalnum(link[len(uri)]) {
+		if bytes.HasPrefix(link, uri) && len(link) > len(uri) && isalnum(link[len(uri)]) {
 			return true
 		}
 	}
@@ -176,26 +302,258 @@ func unscape_text(ob *bytes.Buffer, src []byte) {
 	}
 }
 
+/***************************
+ * ATTRIBUTE LISTS *
+ ***************************/
+
+/* returns the value of the attribute with the given key */
+func (a *mkd_attrs) get(key string) ([]byte, bool) {
+	if a == nil {
+		return nil, false
+	}
+	switch key {
+	case "id":
+		return a.id, a.id != nil
+	case "class":
+		if len(a.classes) == 0 {
+			return nil, false
+		}
+		return bytes.Join(a.classes, []byte(" ")), true
+	}
+	for _, p := range a.pairs {
+		if string(p.key) == key {
+			return p.value, true
+		}
+	}
+	return nil, false
+}
+
+/* the attributes as a map, for user callbacks */
+func (a *mkd_attrs) to_map() map[string]string {
+	m := make(map[string]string)
+	if a == nil {
+		return m
+	}
+	if a.id != nil {
+		m["id"] = string(a.id)
+	}
+	if len(a.classes) > 0 {
+		m["class"] = string(bytes.Join(a.classes, []byte(" ")))
+	}
+	for _, p := range a.pairs {
+		m[string(p.key)] = string(p.value)
+	}
+	return m
+}
+
+/* returns a copy of the list with the given class prepended */
+func (a *mkd_attrs) with_class(class []byte) *mkd_attrs {
+	var r mkd_attrs
+	if a != nil {
+		r = *a
+	}
+	r.classes = append([][]byte{class}, r.classes...)
+	return &r
+}
+
+func is_attr_name_char(c byte) bool {
+	return isalnum(c) || c == '-' || c == '_' || c == ':'
+}
+
+/* parses whitespace separated attribute items: #id .class key=value key="value" */
+/* bare keys without a value are only accepted if allow_bare is set */
+/* returns false on anything that is not a valid item */
+func parse_attr_items(data []byte, attrs *mkd_attrs, allow_bare bool) bool {
+	size := len(data)
+	i := 0
+	for i < size {
+		for i < size && (data[i] == ' ' || data[i] == '\t') {
+			i++
+		}
+		if i >= size {
+			break
+		}
+
+		/* #id and .class */
+		if data[i] == '#' || data[i] == '.' {
+			c := data[i]
+			i++
+			org := i
+			for i < size && is_attr_name_char(data[i]) {
+				i++
+			}
+			if i == org {
+				return false
+			}
+			if c == '#' {
+				attrs.id = data[org:i]
+			} else {
+				attrs.classes = append(attrs.classes, data[org:i])
+			}
+		} else {
+			/* key, optionally followed by =value */
+			org := i
+			for i < size && is_attr_name_char(data[i]) {
+				i++
+			}
+			if i == org {
+				return false
+			}
+			key := data[org:i]
+			value := []byte{}
+			if i < size && data[i] == '=' {
+				i++
+				if i < size && (data[i] == '"' || data[i] == '\'') {
+					q := data[i]
+					i++
+					org = i
+					for i < size && data[i] != q {
+						i++
+					}
+					if i >= size {
+						return false
+					}
+					value = data[org:i]
+					i++
+				} else {
+					org = i
+					for i < size && !isspace(data[i]) {
+						i++
+					}
+					value = data[org:i]
+				}
+			} else if !allow_bare {
+				return false
+			}
+			if bytes.Equal(key, []byte("id")) {
+				attrs.id = value
+			} else if bytes.Equal(key, []byte("class")) {
+				attrs.classes = append(attrs.classes, bytes.Fields(value)...)
+			} else {
+				attrs.pairs = append(attrs.pairs, mkd_attr{key, value})
+			}
+		}
+
+		/* items must be separated by whitespace */
+		if i < size && data[i] != ' ' && data[i] != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+/* parses an attribute list starting with '{' on a single line */
+/* returns its length including the braces, or 0 if it is not valid */
+func parse_attrs(data []byte, attrs *mkd_attrs) int {
+	size := len(data)
+	if size < 2 || data[0] != '{' {
+		return 0
+	}
+	i := 1
+	for i < size && data[i] != '}' && data[i] != '\n' {
+		if data[i] == '"' || data[i] == '\'' {
+			/* closing braces may appear in quoted values */
+			q := data[i]
+			i++
+			for i < size && data[i] != q && data[i] != '\n' {
+				i++
+			}
+			if i >= size || data[i] == '\n' {
+				return 0
+			}
+		}
+		i++
+	}
+	if i >= size || data[i] != '}' {
+		return 0
+	}
+
+	/* kramdown style {: ...} */
+	beg := 1
+	if data[beg] == ':' {
+		beg++
+	}
+
+	if !parse_attr_items(data[beg:i], attrs, false) {
+		return 0
+	}
+	if attrs.id == nil && len(attrs.classes) == 0 && len(attrs.pairs) == 0 {
+		return 0
+	}
+	return i + 1
+}
+
+/* looks for an attribute list at the end of data[beg:end] */
+/* returns the new end of the text and the attributes, if any */
+func trailing_attrs(data []byte, beg, end int) (int, *mkd_attrs) {
+	e := end
+	for e > beg && (data[e-1] == ' ' || data[e-1] == '\t') {
+		e--
+	}
+	if e == beg || data[e-1] != '}' {
+		return end, nil
+	}
+	b := bytes.LastIndex(data[beg:e], []byte("{"))
+	if b < 0 {
+		return end, nil
+	}
+	b += beg
+	var attrs mkd_attrs
+	if parse_attrs(data[b:e], &attrs) != e-b {
+		return end, nil
+	}
+	for b > beg && (data[b-1] == ' ' || data[b-1] == '\t') {
+		b--
+	}
+	return b, &attrs
+}
+
+/* a selection of lines like "3-5 7,9" */
+type line_ranges [][2]int
+
+/* parses a selection of lines, leaving out malformed and reversed (3-1) ranges */
+func parse_line_ranges(spec []byte) line_ranges {
+	var lines line_ranges
+	for _, r := range bytes.FieldsFunc(spec, func(c rune) bool { return c == ' ' || c == ',' }) {
+		from, to := r, r
+		if dash := bytes.IndexByte(r, '-'); dash > 0 {
+			from, to = r[:dash], r[dash+1:]
+		}
+		f, err1 := strconv.Atoi(string(from))
+		t, err2 := strconv.Atoi(string(to))
+		if err1 != nil || err2 != nil || f < 1 || t < f {
+			continue
+		}
+		lines = append(lines, [2]int{f, t})
+	}
+	return lines
+}
+
+func (lines line_ranges) has(n int) bool {
+	for _, r := range lines {
+		if n >= r[0] && n <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
 /* returns the current block tag */
-/* TODO: speed it up by auto-generated optimized 
-   comparison function that is a chain of ifs */
-func find_block_tag(data []byte) (ret []byte) {
+func find_block_tag(rndr *render, data []byte) (ret []byte) {
 	defer un(trace("find_block_tag"))
 	i := 0
 	size := len(data)
 
-	/* looking for the word end */
-	for i < size && isalnum(data[i]) {
+	/* looking for the word end, custom elements have dashes */
+	for i < size && (isalnum(data[i]) || (i > 0 && data[i] == '-')) {
 		i++
 	}
 	if i == 0 || i >= size {
 		return
 	}
 	s := bytes.ToLower(data[:i])
-	for _, tag := range block_tags {
-		if bytes.Equal(s, tag) {
-			return s
-		}
+	if rndr.block_tags[string(s)] {
+		return s
 	}
 	return
 }
@@ -262,14 +620,14 @@ func tag_length(data []byte, autolink *int) int {
 		i++
 	}
 
-	if i > 1 && data[i] == '@' {
+	if i > 1 && i < size && data[i] == '@' {
 		if j := is_mail_autolink(data[i:]); j != 0 {
 			*autolink = MKDA_EMAIL
 			return i + j
 		}
 	}
 
-	if i > 2 && data[i] == ':' {
+	if i > 2 && i < size && data[i] == ':' {
 		*autolink = MKDA_NORMAL
 		i++
 	}
@@ -310,6 +668,19 @@ func tag_length(data []byte, autolink *int) int {
 	return i + 1
 }
 
+/* the trigger of the active char at data[i]. A w only triggers when it
+ * starts "www." after a word boundary: most w of the text don't, and the
+ * check is cheaper than the call. */
+func char_action(rndr *render, data []byte, i int) byte {
+	action := rndr.active_char[data[i]]
+	if action == MD_CHAR_AUTOLINK_WWW {
+		if i+3 >= len(data) || data[i+1] != 'w' || data[i+2] != 'w' || data[i+3] != '.' || !autolink_boundary(data, i) {
+			return 0
+		}
+	}
+	return action
+}
+
 /* parses inline markdown elements */
 func parse_inline(ob *bytes.Buffer, rndr *render, data []byte) {
 	defer un(trace("parse_inline"))
@@ -321,13 +692,18 @@ func parse_inline(ob *bytes.Buffer, rndr *render, data []byte) {
 	rndr.nesting++
 	defer func() { rndr.nesting-- }()
 
+	if rndr.ext_flags&MKDEXT_COMMONMARK != 0 {
+		parse_inline_cm(ob, rndr, data)
+		return
+	}
+
 	var action byte = 0
 	i := 0
 	end := 0
 	for i < size {
 		/* copying inactive chars into the output */
 		for end < size {
-			action = rndr.active_char[data[end]]
+			action = char_action(rndr, data, end)
 			if action != 0 {
 				break
 			}
@@ -469,16 +845,18 @@ func parse_emph1(ob *bytes.Buffer, rndr *render, data []byte, c byte) int {
 			continue
 		}
 
-		if data[i] == c && !isspace(data[i-1]) {
+		if data[i] == c && !isspace_rune(rune_before(data, i)) {
 			if rndr.ext_flags&MKDEXT_NO_INTRA_EMPHASIS != 0 {
-				if !(i+1 == size || isspace(data[i+1]) || ispunct(data[i+1])) {
+				if next := rune_at(data, i+1); !isspace_rune(next) && !ispunct_rune(next) {
 					continue
 				}
 			}
 
 			var work bytes.Buffer
 			parse_inline(&work, rndr, data[:i])
+			set_source(rndr, mkd_source{delim: c})
 			r := rndr.make.emphasis(ob, work.Bytes(), rndr.make.opaque)
+			set_source(rndr, mkd_source{})
 			if r {
 				return i + 1
 			} else {
@@ -512,10 +890,12 @@ func parse_emph2(ob *bytes.Buffer, rndr *render, data []byte, c byte) int {
 		}
 		i += len
 
-		if i+1 < size && data[i] == c && data[i+1] == c && i > 0 && !isspace(data[i-1]) {
+		if i+1 < size && data[i] == c && data[i+1] == c && i > 0 && !isspace_rune(rune_before(data, i)) {
 			var work bytes.Buffer
 			parse_inline(&work, rndr, data[:i])
+			set_source(rndr, mkd_source{delim: c})
 			r := render_method(ob, work.Bytes(), rndr.make.opaque)
+			set_source(rndr, mkd_source{})
 			if r {
 				return i + 2
 			} else {
@@ -542,7 +922,7 @@ func parse_emph3(ob *bytes.Buffer, rndr *render, dataorig []byte, iorig int, c b
 		i += len
 
 		/* skip whitespace preceded symbols */
-		if data[i] != c || isspace(data[i-1]) {
+		if data[i] != c || isspace_rune(rune_before(data, i)) {
 			continue
 		}
 
@@ -550,7 +930,9 @@ func parse_emph3(ob *bytes.Buffer, rndr *render, dataorig []byte, iorig int, c b
 			/* triple symbol found */
 			var work bytes.Buffer
 			parse_inline(&work, rndr, data[:i])
+			set_source(rndr, mkd_source{delim: c})
 			r := rndr.make.triple_emphasis(ob, work.Bytes(), rndr.make.opaque)
+			set_source(rndr, mkd_source{})
 			if r {
 				return i + 3
 			} else {
@@ -579,6 +961,10 @@ func parse_emph3(ob *bytes.Buffer, rndr *render, dataorig []byte, iorig int, c b
 
 func char_emphasis(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
 	defer un(trace("char_emphasis"))
+	/* with MKDEXT_NO_INTRA_EMPHASIS the opening run can't be in a word */
+	if rndr.ext_flags&MKDEXT_NO_INTRA_EMPHASIS != 0 && isalnum_rune(rune_before(data, offset)) {
+		return 0
+	}
 	data = data[offset:]
 	c := data[0]
 	size := len(data)
@@ -587,7 +973,7 @@ func char_emphasis(ob *bytes.Buffer, rndr *render, data []byte, offset int) int
 	if size > 2 && data[1] != c {
 		/* whitespace cannot follow an opening emphasis;
 		 * strikethrough only takes two characters '~~' */
-		if c == '~' || isspace(data[1]) {
+		if c == '~' || isspace_rune(rune_at(data, 1)) {
 			return 0
 		}
 
@@ -599,7 +985,7 @@ func char_emphasis(ob *bytes.Buffer, rndr *render, data []byte, offset int) int
 	}
 
 	if size > 3 && data[1] == c && data[2] != c {
-		if isspace(data[2]) {
+		if isspace_rune(rune_at(data, 2)) {
 			return 0
 		}
 
@@ -611,7 +997,7 @@ func char_emphasis(ob *bytes.Buffer, rndr *render, data []byte, offset int) int
 	}
 
 	if size > 4 && data[1] == c && data[2] == c && data[3] != c {
-		if c == '~' || isspace(data[3]) {
+		if c == '~' || isspace_rune(rune_at(data, 3)) {
 			return 0
 		}
 		if ret = parse_emph3(ob, rndr, data, 3, c); ret == 0 {
@@ -633,14 +1019,19 @@ func char_linebreak(ob *bytes.Buffer, rndr *render, data []byte, offset int) int
 	newlen := len
 	obd := ob.Bytes()
 	/* removing the last space from ob and rendering */
-	for newlen := 0; newlen >= 0 && obd[newlen-1] == ' '; newlen-- {
-		// do nothing
+	for newlen > 0 && obd[newlen-1] == ' ' {
+		newlen--
 	}
 	if newlen != len {
 		ob.Truncate(newlen)
 	}
 
-	if rndr.make.linebreak(ob, rndr.make.opaque) {
+	/* the spaces and the newline, as written */
+	beg := offset
+	for beg > 0 && data[beg-1] == ' ' {
+		beg--
+	}
+	if rndr.make.linebreak(ob, data[beg:offset+1], rndr.make.opaque) {
 		return 1
 	}
 	return 0
@@ -648,7 +1039,6 @@ func char_linebreak(ob *bytes.Buffer, rndr *render, data []byte, offset int) int
 
 func char_codespan(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
 	defer un(trace("char_codespan"))
-
 	data = data[offset:]
 	size := len(data)
 	nb := 0
@@ -685,6 +1075,7 @@ func char_codespan(ob *bytes.Buffer, rndr *render, data []byte, offset int) int
 	}
 
 	/* real code span */
+	set_source(rndr, mkd_source{text: data[:end]})
 	if f_begin < f_end {
 		if !rndr.make.codespan(ob, data[f_begin:f_end], rndr.make.opaque) {
 			end = 0
@@ -694,6 +1085,7 @@ func char_codespan(ob *bytes.Buffer, rndr *render, data []byte, offset int) int
 			end = 0
 		}
 	}
+	set_source(rndr, mkd_source{})
 
 	return end
 }
@@ -706,13 +1098,25 @@ func char_escape(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
 	data = data[offset:]
 	size := len(data)
 
+	if size == 1 {
+		/* a lone backslash at the end is literal */
+		if nil != rndr.make.normal_text {
+			rndr.make.normal_text(ob, data, rndr.make.opaque)
+		} else {
+			ob.WriteByte('\\')
+		}
+		return 1
+	}
+
 	if size > 1 {
 		if -1 == bytes.IndexByte(escape_chars, data[1]) {
 			return 0
 		}
 
 		if nil != rndr.make.normal_text {
+			set_source(rndr, mkd_source{text: data[:2]})
 			rndr.make.normal_text(ob, data[1:2], rndr.make.opaque)
+			set_source(rndr, mkd_source{})
 		} else {
 			ob.WriteByte(data[1])
 		}
@@ -762,9 +1166,21 @@ func char_langle_tag(ob *bytes.Buffer, rndr *render, data []byte, offset int) in
 		if rndr.make.autolink != nil && altype != MKDA_NOT_AUTOLINK {
 			var u_link bytes.Buffer
 			unscape_text(&u_link, data[1:end-1])
+			set_source(rndr, mkd_source{text: data[:end]})
 			ret = rndr.make.autolink(ob, u_link.Bytes(), altype, rndr.make.opaque)
+			set_source(rndr, mkd_source{})
 		} else if rndr.make.raw_html_tag != nil {
 			ret = rndr.make.raw_html_tag(ob, data[:end], rndr.make.opaque)
+			if ret && (is_html_tag(data[:end], "a") || is_html_tag(data[:end], "A")) {
+				/* the text of a raw anchor is not linked again */
+				if data[1] == '/' {
+					if rndr.raw_link > 0 {
+						rndr.raw_link--
+					}
+				} else if data[end-2] != '/' {
+					rndr.raw_link++
+				}
+			}
 		}
 	}
 
@@ -776,121 +1192,393 @@ func char_langle_tag(ob *bytes.Buffer, rndr *render, data []byte, offset int) in
 
 func char_autolink(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
 	defer un(trace("char_autolink"))
+	if rndr.in_link > 0 || rndr.raw_link > 0 {
+		return 0
+	}
 
-    // quick check to rule out most false hits on ':'
-    if len(data) < offset + 3 || data[offset+1] != '/' || data[offset+2] != '/' {
-        return 0
-    }
-
-    // scan backward for a word boundary
-    rewind := 0
-    for offset - rewind > 0 && rewind <= 7 && !isspace(data[offset-rewind-1]) && !isspace(data[offset-rewind-1]) {
-        rewind++
-    }
-    if rewind > 6 { // longest supported protocol is "mailto" which has 6 letters
-        return 0
-    }
-
-	dataorig := data
-	data = data[offset:]
-	size := len(data)
-	if !is_safe_link(data) {
+	/* scan backward for the scheme, "mailto" being the longest one */
+	rewind := 0
+	for offset-rewind > 0 && rewind <= 6 && isalpha(data[offset-rewind-1]) {
+		rewind++
+	}
+	if rewind == 0 || rewind > 6 || !autolink_boundary(data, offset-rewind) {
 		return 0
 	}
 
+	link := data[offset-rewind:]
+	scheme := string(link[:rewind])
 	link_end := 0
-	for link_end < size && !isspace(data[link_end]) {
-		link_end++
+	if scheme == "mailto" || scheme == "xmpp" {
+		if n := autolink_email(link[rewind+1:], scheme == "xmpp"); n > 0 {
+			link_end = rewind + 1 + n
+		}
+	} else {
+		link_end = autolink_url(link)
+	}
+	if link_end == 0 {
+		return 0
 	}
 
-	/* Skip punctuation at the end of the link */
-	if (data[link_end-1] == '.' || data[link_end-1] == ',' || data[link_end-1] == ';') && data[link_end-2] != '\\' {
-		link_end--
+	var u_link bytes.Buffer
+	unscape_text(&u_link, link[:link_end])
+	set_source(rndr, mkd_source{text: link[:link_end]})
+	defer set_source(rndr, mkd_source{})
+	if !render_autolink(ob, rndr, link[:rewind], u_link.Bytes(), MKDA_NORMAL) {
+		return 0
 	}
+	return link_end - rewind
+}
 
-	/* See if the link finishes with a punctuation sign that can be closed. */
-	var copen byte
-	switch data[link_end-1] {
-	case '"':
-		copen = '"'
-	case '\'':
-		copen = '\''
-	case ')':
-		copen = '('
-	case ']':
-		copen = '['
-	case '}':
-		copen = '{'
+/* "www." links, rendered as http links */
+func char_autolink_www(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	defer un(trace("char_autolink_www"))
+	if rndr.in_link > 0 || rndr.raw_link > 0 || rndr.make.link == nil || !autolink_boundary(data, offset) {
+		return 0
 	}
 
-	if copen != 0 {
-		buf_start_idx := 0
-		buf_end_idx := offset - rewind + link_end - 2
+	link_end := autolink_www(data[offset:])
+	if link_end == 0 {
+		return 0
+	}
 
-		open_delim := 1
+	text := data[offset : offset+link_end]
+	var u_link, content bytes.Buffer
+	u_link.WriteString("http://")
+	href_escape(&u_link, text)
+	if rndr.make.normal_text != nil {
+		rndr.make.normal_text(&content, text, rndr.make.opaque)
+	} else {
+		content.Write(text)
+	}
+	set_source(rndr, mkd_source{text: text})
+	defer set_source(rndr, mkd_source{})
+	if !rndr.make.link(ob, u_link.Bytes(), nil, content.Bytes(), nil, rndr.make.opaque) {
+		return 0
+	}
+	return link_end
+}
 
-		/* Try to close the final punctuation sign in this same line;
-		 * if we managed to close it outside of the URL, that means that it's
-		 * not part of the URL. If it closes inside the URL, that means it
-		 * is part of the URL.
-		 *
-		 * Examples:
-		 *
-		 *	foo http://www.pokemon.com/Pikachu_(Electric) bar
-		 *		=> http://www.pokemon.com/Pikachu_(Electric)
-		 *
-		 *	foo (http://www.pokemon.com/Pikachu_(Electric)) bar
-		 *		=> http://www.pokemon.com/Pikachu_(Electric)
-		 *
-		 *	foo http://www.pokemon.com/Pikachu_(Electric)) bar
-		 *		=> http://www.pokemon.com/Pikachu_(Electric))
-		 *
-		 *	(foo http://www.pokemon.com/Pikachu_(Electric)) bar
-		 *		=> foo http://www.pokemon.com/Pikachu_(Electric)
-		 */
+/* '@': e-mail addresses, triggered in the middle of the address */
+func char_autolink_email(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	defer un(trace("char_autolink_email"))
+	if rndr.in_link > 0 || rndr.raw_link > 0 {
+		return 0
+	}
 
-		for buf_end_idx >= buf_start_idx && dataorig[buf_end_idx] != '\n' && open_delim == 0 {
-			if dataorig[buf_end_idx] == data[link_end-1] {
-				open_delim++
-			}
+	rewind := autolink_local(data, offset)
+	if rewind == 0 || isalnum_rune(rune_before(data, offset-rewind)) {
+		return 0
+	}
+	link_end := autolink_email(data[offset-rewind:], false)
+	if link_end == 0 {
+		return 0
+	}
 
-			if dataorig[buf_end_idx] == copen {
-				open_delim--
-			}
+	set_source(rndr, mkd_source{text: data[offset-rewind : offset-rewind+link_end]})
+	defer set_source(rndr, mkd_source{})
+	if !render_autolink(ob, rndr, data[offset-rewind:offset], data[offset-rewind:offset-rewind+link_end], MKDA_EMAIL) {
+		return 0
+	}
+	return link_end - rewind
+}
+
+/* renders an autolink whose first characters (before the trigger) were
+ * already written to ob */
+func render_autolink(ob *bytes.Buffer, rndr *render, written, link []byte, typ int) bool {
+	if rndr.make.autolink == nil || !bytes.HasSuffix(ob.Bytes(), written) {
+		return false
+	}
 
-			buf_end_idx--
+	/* we were triggered after the start, so we need to rewind the output */
+	ob.Truncate(ob.Len() - len(written))
+
+	if !rndr.make.autolink(ob, link, typ, rndr.make.opaque) {
+		ob.Write(written)
+		return false
+	}
+	return true
+}
+
+/* default wiki page resolver: MediaWiki style Page_Name urls */
+func wiki_page_url(page string) (string, bool) {
+	return url.PathEscape(strings.Replace(page, " ", "_", -1)), true
+}
+
+/* ':': parsing an emoji shortcode like :rocket:, unless it's an autolink */
+func char_emoji(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	defer un(trace("char_emoji"))
+
+	/* the ':' trigger is shared with scheme autolinks */
+	if rndr.ext_flags&MKDEXT_AUTOLINK != 0 {
+		if end := char_autolink(ob, rndr, data, offset); end != 0 {
+			return end
 		}
+	}
+
+	if rndr.make.emoji == nil {
+		return 0
+	}
+
+	/* not in the middle of a word, a time like 10:30:00 or an url */
+	if offset > 0 && (isalnum_rune(rune_before(data, offset)) || data[offset-1] == ':') {
+		return 0
+	}
+	word := offset
+	for word > 0 && !isspace(data[word-1]) {
+		word--
+	}
+	if bytes.Contains(data[word:offset], []byte("://")) || bytes.HasPrefix(data[word:offset], []byte("www.")) {
+		return 0
+	}
 
-		if open_delim == 0 {
-			link_end--
+	data = data[offset:]
+	size := len(data)
+	end := 1
+	for end < size && (isalnum(data[end]) || data[end] == '_' || data[end] == '+' || data[end] == '-') {
+		end++
+	}
+	if end == 1 || end >= size || data[end] != ':' {
+		return 0
+	}
+	if isalnum_rune(rune_at(data, end+1)) {
+		return 0
+	}
+
+	name := string(data[1:end])
+	var glyph, image []byte
+	if u, ok := rndr.cfg.EmojiImages[name]; ok {
+		image = []byte(u)
+	} else if g, ok := rndr.cfg.Emoji[name]; ok {
+		glyph = []byte(g)
+	} else if g, ok := emoji_table[name]; ok {
+		glyph = []byte(g)
+	} else {
+		return 0
+	}
+
+	if !rndr.make.emoji(ob, data[1:end], glyph, image, rndr.make.opaque) {
+		return 0
+	}
+	return end + 1
+}
+
+func is_mention_char(c byte) bool {
+	return isalnum(c) || c == '-' || c == '_'
+}
+
+/* writes the text of a mention or reference as a link */
+func render_mention(ob *bytes.Buffer, rndr *render, u string, text []byte, class string) bool {
+	var content bytes.Buffer
+	if rndr.make.normal_text != nil {
+		rndr.make.normal_text(&content, text, rndr.make.opaque)
+	} else {
+		content.Write(text)
+	}
+	attrs := &mkd_attrs{classes: [][]byte{[]byte(class)}}
+	set_source(rndr, mkd_source{text: text})
+	defer set_source(rndr, mkd_source{})
+	return rndr.make.link(ob, []byte(u), nil, content.Bytes(), attrs, rndr.make.opaque)
+}
+
+/* '@': parsing a user mention like @alice or @org/team */
+func char_mention(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	defer un(trace("char_mention"))
+
+	/* the '@' trigger is shared with e-mail autolinks */
+	if rndr.ext_flags&MKDEXT_AUTOLINK != 0 {
+		if end := char_autolink_email(ob, rndr, data, offset); end != 0 {
+			return end
 		}
 	}
 
-    // we were triggered on the ':', so we need to rewind the output a bit
-    if ob.Len() >= rewind {
-        ob.Truncate(len(ob.Bytes()) - rewind)
-    }
+	/* not inside links, e-mail addresses or words */
+	if rndr.in_link > 0 || rndr.raw_link > 0 || rndr.make.link == nil || rndr.cfg.UserResolver == nil {
+		return 0
+	}
+	if offset > 0 && (is_mention_char(data[offset-1]) || isalnum_rune(rune_before(data, offset)) ||
+		data[offset-1] == '.' || data[offset-1] == '/' || data[offset-1] == '@') {
+		return 0
+	}
 
-	if rndr.make.autolink != nil {
-		var u_link bytes.Buffer
-		unscape_text(&u_link, data[:link_end])
-		rndr.make.autolink(ob, u_link.Bytes(), MKDA_NORMAL, rndr.make.opaque)
+	data = data[offset:]
+	size := len(data)
+	end := 1
+	for end < size && is_mention_char(data[end]) {
+		end++
+	}
+	/* team mentions: @org/team */
+	if end > 1 && end+1 < size && data[end] == '/' && isalnum(data[end+1]) {
+		end++
+		for end < size && is_mention_char(data[end]) {
+			end++
+		}
+	}
+	for end > 1 && (data[end-1] == '-' || data[end-1] == '_') {
+		end--
+	}
+	if end == 1 || !isalnum(data[1]) {
+		return 0
+	}
+	/* user@example.com is an address, and the name must end the word */
+	if end < size && (data[end] == '@' || isalnum_rune(rune_at(data, end))) {
+		return 0
 	}
 
-	return link_end - rewind
+	u, ok := rndr.cfg.UserResolver(string(data[1:end]))
+	if !ok || !render_mention(ob, rndr, u, data[:end], "user-mention") {
+		return 0
+	}
+	return end
+}
+
+/* '#': parsing an issue reference like #123 or org/repo#123 */
+func char_issue(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
+	defer un(trace("char_issue"))
+
+	if rndr.in_link > 0 || rndr.raw_link > 0 || rndr.make.link == nil || rndr.cfg.IssueResolver == nil {
+		return 0
+	}
+
+	/* the number, which must end the word */
+	size := len(data)
+	end := offset + 1
+	for end < size && data[end] >= '0' && data[end] <= '9' {
+		end++
+	}
+	if end == offset+1 || (end < size && (is_mention_char(data[end]) || data[end] == '@')) {
+		return 0
+	}
+	number, err := strconv.Atoi(string(data[offset+1 : end]))
+	if err != nil {
+		return 0
+	}
+
+	/* an optional org/repo prefix, which has already been written out */
+	beg := offset
+	if beg > 0 && (is_mention_char(data[beg-1]) || data[beg-1] == '.') {
+		for beg > 0 && (is_mention_char(data[beg-1]) || data[beg-1] == '.') {
+			beg--
+		}
+		slash := beg - 1
+		if slash <= 0 || data[slash] != '/' {
+			return 0
+		}
+		beg = slash
+		for beg > 0 && (is_mention_char(data[beg-1]) || data[beg-1] == '.') {
+			beg--
+		}
+		if beg == slash || (beg > 0 && !isspace(data[beg-1]) && data[beg-1] != '(') {
+			return 0
+		}
+	} else if beg > 0 && (data[beg-1] == '&' || data[beg-1] == '/') {
+		return 0
+	}
+
+	if beg < offset && !bytes.HasSuffix(ob.Bytes(), data[beg:offset]) {
+		return 0
+	}
+
+	u, ok := rndr.cfg.IssueResolver(string(data[beg:offset]), number)
+	if !ok {
+		return 0
+	}
+
+	/* rewinding the already written repository name */
+	var link bytes.Buffer
+	if !render_mention(&link, rndr, u, data[beg:end], "issue-link") {
+		return 0
+	}
+	ob.Truncate(ob.Len() - (offset - beg))
+	ob.Write(link.Bytes())
+	return end - offset
+}
+
+/* '[[': parsing a wiki link [[Page Name]] or [[Page Name|label]] */
+func char_wikilink(ob *bytes.Buffer, rndr *render, data []byte) int {
+	defer un(trace("char_wikilink"))
+	if rndr.in_link > 0 {
+		return 0
+	}
+	size := len(data)
+
+	/* the link must be closed on the same line, without nested brackets */
+	end := 2
+	for end < size && data[end] != ']' && data[end] != '[' && data[end] != '\n' {
+		end++
+	}
+	if end+1 >= size || data[end] != ']' || data[end+1] != ']' {
+		return 0
+	}
+
+	page := data[2:end]
+	var label []byte
+	if bar := bytes.IndexByte(page, '|'); bar >= 0 {
+		label = bytes.TrimSpace(page[bar+1:])
+		page = page[:bar]
+	}
+	page = bytes.TrimSpace(page)
+	if len(page) == 0 {
+		return 0
+	}
+	if len(label) == 0 {
+		label = page
+	}
+
+	/* [[Page#section]] links to an anchor of the page, [[#section]] to
+	 * one of the current page */
+	var anchor []byte
+	if hash := bytes.IndexByte(page, '#'); hash >= 0 {
+		anchor = bytes.TrimSpace(page[hash+1:])
+		page = bytes.TrimSpace(page[:hash])
+	}
+
+	u, exists := "", true
+	if len(page) > 0 {
+		resolve := wiki_page_url
+		if rndr.cfg.WikiResolver != nil {
+			resolve = rndr.cfg.WikiResolver
+		}
+		u, exists = resolve(string(page))
+	}
+	if len(anchor) > 0 {
+		u += "#" + url.PathEscape(strings.Replace(string(anchor), " ", "_", -1))
+	}
+
+	var attrs *mkd_attrs
+	if !exists {
+		attrs = &mkd_attrs{classes: [][]byte{[]byte("missing")}}
+	}
+
+	var content bytes.Buffer
+	rndr.in_link++
+	parse_inline(&content, rndr, label)
+	rndr.in_link--
+	set_source(rndr, mkd_source{text: data[:end+2]})
+	defer set_source(rndr, mkd_source{})
+	if !rndr.make.link(ob, []byte(u), nil, content.Bytes(), attrs, rndr.make.opaque) {
+		return 0
+	}
+	return end + 2
 }
 
 /* '[': parsing a link or an image */
 func char_link(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
 	defer un(trace("char_link"))
 	is_img := offset > 0 && data[offset-1] == '!'
-	var title, link []byte
+	var title, link, ref []byte
+	var quote byte
 
 	/* checking whether the correct renderer exists */
 	if (is_img && rndr.make.image == nil) || (!is_img && rndr.make.link == nil) {
 		return 0
 	}
 
+	if !is_img && rndr.ext_flags&MKDEXT_WIKI_LINKS != 0 && offset+1 < len(data) && data[offset+1] == '[' {
+		if end := char_wikilink(ob, rndr, data[offset:]); end > 0 {
+			return end
+		}
+	}
+
 	data = data[offset:]
 	size := len(data)
 
@@ -1010,6 +1698,7 @@ func char_link(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
 
 		if title_e > title_b {
 			title = data[title_b:title_e]
+			quote = data[title_b-1]
 		}
 
 		i++
@@ -1058,6 +1747,7 @@ func char_link(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
 		// keeping link and title from link_ref
 		link = lr.link
 		title = lr.title
+		ref = id
 		i++
 	} else {
 		/* shortcut reference style link */
@@ -1089,18 +1779,31 @@ func char_link(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
 		// keep link and title from reference
 		link = lr.link
 		title = lr.title
+		ref = id
 
 		// rewinding the whitespace
 		i = txt_e + 1
 	}
 
+	/* optional attribute list right after the link */
+	var attrs *mkd_attrs
+	if rndr.ext_flags&MKDEXT_ATTRIBUTES != 0 && i < size && data[i] == '{' {
+		var a mkd_attrs
+		if n := parse_attrs(data[i:], &a); n > 0 {
+			attrs = &a
+			i += n
+		}
+	}
+
 	// building content: img alt is escaped, link content is parsed 
 	var content bytes.Buffer
 	if txt_e > 1 {
 		if is_img {
 			content.Write(data[1:txt_e])
 		} else {
+			rndr.in_link++
 			parse_inline(&content, rndr, data[1:txt_e])
+			rndr.in_link--
 		}
 	}
 
@@ -1113,11 +1816,17 @@ func char_link(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
 
 	/* calling the relevant rendering function */
 	ret := false
+	set_source(rndr, mkd_source{link: link, title: title, ref: ref, delim: quote})
+	defer set_source(rndr, mkd_source{})
 	if is_img {
 		remove_from_end(ob, '!')
-		ret = rndr.make.image(ob, u_link, title, content.Bytes(), rndr.make.opaque)
+		if rndr.figure != nil {
+			rndr.figure.title = title
+			rndr.figure.alt = content.Bytes()
+		}
+		ret = rndr.make.image(ob, u_link, title, content.Bytes(), attrs, rndr.make.opaque)
 	} else {
-		ret = rndr.make.link(ob, u_link, title, content.Bytes(), rndr.make.opaque)
+		ret = rndr.make.link(ob, u_link, title, content.Bytes(), attrs, rndr.make.opaque)
 	}
 
 	if ret {
@@ -1130,6 +1839,33 @@ func char_link(ob *bytes.Buffer, rndr *render, data []byte, offset int) int {
  * BLOCK-LEVEL PARSING FUNCTIONS *
  *********************************/
 
+/* renders a paragraph made of a single image as a figure, the image title
+ * (or its alt text) being the caption */
+func parse_figure(ob *bytes.Buffer, rndr *render, data []byte, attrs *mkd_attrs) bool {
+	defer un(trace("parse_figure"))
+	if len(data) < 5 || data[0] != '!' || data[1] != '[' {
+		return false
+	}
+
+	var fig mkd_figure
+	var image bytes.Buffer
+	rndr.figure = &fig
+	end := char_link(&image, rndr, data, 1)
+	rndr.figure = nil
+	if end == 0 || len(bytes.TrimSpace(data[1+end:])) > 0 {
+		return false
+	}
+
+	caption := fig.title
+	if len(caption) == 0 {
+		caption = fig.alt
+	}
+	var work bytes.Buffer
+	parse_inline(&work, rndr, caption)
+	rndr.make.figure(ob, image.Bytes(), work.Bytes(), attrs, rndr.make.opaque)
+	return true
+}
+
 /* returns the line length when it is empty, 0 otherwise */
 func is_empty(data []byte) int {
 	//defer un(trace("is_empty"))
@@ -1177,7 +1913,10 @@ func is_hrule(data []byte) bool {
 }
 
 /* check if a line is a code fence; return its size if it is */
-func is_codefence(data []byte, syntax *[]byte) int {
+/* the info string is split into the language and its attributes:
+ *	```go title="main.go" linenos hl_lines="3-5"
+ * attribute lists in braces are only accepted if ial is set */
+func is_codefence(data []byte, syntax *[]byte, attrs **mkd_attrs, ial bool) int {
 	//defer un(trace("is_codefence"))
 	size := len(data)
 	i := 0
@@ -1217,7 +1956,18 @@ func is_codefence(data []byte, syntax *[]byte) int {
 
 		*syntax = data[i:]
 
-		if i < size && data[i] == '{' {
+		var a mkd_attrs
+		if ial && i < size && data[i] == '{' {
+			if n := parse_attrs(data[i:], &a); n > 0 {
+				/* {.lang #id} form: the classes carry the language */
+				*attrs = &a
+				i += n
+			}
+		}
+
+		if *attrs != nil {
+			// nothing left of the syntax
+		} else if i < size && data[i] == '{' {
 			i++
 			*syntax = (*syntax)[1:]
 
@@ -1247,6 +1997,25 @@ func is_codefence(data []byte, syntax *[]byte) int {
 				syn++
 				i++
 			}
+
+			/* lang {#id .class} or lang key=value form */
+			j := i
+			for j < size && (data[j] == ' ' || data[j] == '\t') {
+				j++
+			}
+			line_end := j
+			for line_end < size && data[line_end] != '\n' {
+				line_end++
+			}
+			if ial && j < size && data[j] == '{' {
+				if n := parse_attrs(data[j:], &a); n > 0 {
+					*attrs = &a
+					i = j + n
+				}
+			} else if j < line_end && parse_attr_items(data[j:line_end], &a, true) {
+				*attrs = &a
+				i = line_end
+			}
 		}
 
 		*syntax = (*syntax)[:syn] // TODO: hopefully right
@@ -1447,8 +2216,12 @@ func parse_paragraph(ob *bytes.Buffer, rndr *render, data []byte) int {
 		if is_empty(data[i:]) > 0 {
 			break
 		}
-		if level = is_headerline(data[i:]); level != 0 {
-			break
+		/* an underline needs a line of text above it, the first line
+		 * of the paragraph is text */
+		if i > 0 {
+			if level = is_headerline(data[i:]); level != 0 {
+				break
+			}
 		}
 
 		if rndr.ext_flags&MKDEXT_LAX_HTML_BLOCKS != 0 {
@@ -1458,7 +2231,7 @@ func parse_paragraph(ob *bytes.Buffer, rndr *render, data []byte) int {
 			}
 		}
 
-		if is_atxheader(rndr, data[i:]) || is_hrule(data[i:]) {
+		if is_atxheader(rndr, data[i:]) || is_hrule(data[i:]) || is_container_start(rndr, data[i:]) {
 			end = i
 			break
 		}
@@ -1474,10 +2247,26 @@ func parse_paragraph(ob *bytes.Buffer, rndr *render, data []byte) int {
 	work := data
 
 	if 0 == level {
+		/* kramdown style {: #id .class} on the last line of the paragraph */
+		var attrs *mkd_attrs
+		if rndr.ext_flags&MKDEXT_ATTRIBUTES != 0 {
+			last := bytes.LastIndex(data[:work_size], []byte("\n")) + 1
+			if last > 0 && work_size-last > 2 && data[last] == '{' && data[last+1] == ':' {
+				if e, a := trailing_attrs(data, last, work_size); a != nil && e == last {
+					attrs = a
+					work_size = last - 1
+				}
+			}
+		}
+
+		if rndr.make.figure != nil && parse_figure(ob, rndr, data[:work_size], attrs) {
+			return end
+		}
+
 		var tmp bytes.Buffer
 		parse_inline(&tmp, rndr, data[:work_size])
 		if nil != rndr.make.paragraph {
-			rndr.make.paragraph(ob, tmp.Bytes(), rndr.make.opaque)
+			rndr.make.paragraph(ob, tmp.Bytes(), attrs, rndr.make.opaque)
 		}
 	} else {
 		if work_size > 0 {
@@ -1495,9 +2284,9 @@ func parse_paragraph(ob *bytes.Buffer, rndr *render, data []byte) int {
 
 			if work_size > 0 {
 				var tmp bytes.Buffer
-				parse_inline(&tmp, rndr, work[:size])
+				parse_inline(&tmp, rndr, work[:work_size])
 				if rndr.make.paragraph != nil {
-					rndr.make.paragraph(ob, tmp.Bytes(), rndr.make.opaque)
+					rndr.make.paragraph(ob, tmp.Bytes(), nil, rndr.make.opaque)
 				}
 				work = work[beg:i]
 			} else {
@@ -1505,10 +2294,18 @@ func parse_paragraph(ob *bytes.Buffer, rndr *render, data []byte) int {
 			}
 		}
 
+		var attrs *mkd_attrs
+		if rndr.ext_flags&MKDEXT_ATTRIBUTES != 0 {
+			var e int
+			if e, attrs = trailing_attrs(work, 0, len(work)); attrs != nil {
+				work = work[:e]
+			}
+		}
+
 		var header_work bytes.Buffer
 		parse_inline(&header_work, rndr, work)
 		if nil != rndr.make.header {
-			rndr.make.header(ob, header_work.Bytes(), level, rndr.make.opaque)
+			rndr.make.header(ob, header_work.Bytes(), level, attrs, rndr.make.opaque)
 		}
 	}
 	return end
@@ -1519,14 +2316,15 @@ func parse_fencedcode(ob *bytes.Buffer, rndr *render, data []byte) int {
 	defer un(trace("parse_fencedcode"))
 	size := len(data)
 	var lang []byte
-	beg := is_codefence(data, &lang)
+	var attrs *mkd_attrs
+	beg := is_codefence(data, &lang, &attrs, rndr.ext_flags&MKDEXT_ATTRIBUTES != 0)
 	if beg == 0 {
 		return 0
 	}
 	end := 0
 	var work bytes.Buffer
 	for beg < size {
-		fence_end := is_codefence(data[beg:], nil)
+		fence_end := is_codefence(data[beg:], nil, nil, false)
 		if fence_end != 0 {
 			beg += fence_end
 			break
@@ -1550,12 +2348,49 @@ func parse_fencedcode(ob *bytes.Buffer, rndr *render, data []byte) int {
 
 	ensure_ends_with_nl(&work)
 
+	include_code(rndr, attrs, &work)
+
 	if nil != rndr.make.blockcode {
-		rndr.make.blockcode(ob, work.Bytes(), lang, rndr.make.opaque)
+		rndr.make.blockcode(ob, work.Bytes(), lang, attrs, rndr.make.opaque)
 	}
 	return beg
 }
 
+/* ```go include="main.go" lines="10-30": replaces the code with the
+ * lines of the file */
+func include_code(rndr *render, attrs *mkd_attrs, work *bytes.Buffer) {
+	if rndr.ext_flags&MKDEXT_INCLUDE != 0 {
+		if name, ok := attrs.get("include"); ok {
+			if content, _, ok := read_include(rndr, string(name)); ok {
+				work.Reset()
+				/* a lines= without a valid range selects nothing */
+				spec, ranged := attrs.get("lines")
+				lines := parse_line_ranges(spec)
+				for n := 1; len(content) > 0; n++ {
+					e := bytes.IndexByte(content, '\n') + 1
+					if e == 0 {
+						e = len(content)
+					}
+					if !ranged || lines.has(n) {
+						work.Write(content[:e])
+					}
+					content = content[e:]
+				}
+				ensure_ends_with_nl(work)
+			}
+
+			/* the include keys are consumed by the parser */
+			pairs := attrs.pairs
+			attrs.pairs = nil
+			for _, p := range pairs {
+				if !bytes.Equal(p.key, []byte("include")) && !bytes.Equal(p.key, []byte("lines")) {
+					attrs.pairs = append(attrs.pairs, p)
+				}
+			}
+		}
+	}
+}
+
 func parse_blockcode(ob *bytes.Buffer, rndr *render, data []byte) int {
 	defer un(trace("parse_blockcode"))
 	size := len(data)
@@ -1592,7 +2427,7 @@ func parse_blockcode(ob *bytes.Buffer, rndr *render, data []byte) int {
 
 	if rndr.make.blockcode != nil {
 		var emptySlice []byte
-		rndr.make.blockcode(ob, work.Bytes(), emptySlice, rndr.make.opaque)
+		rndr.make.blockcode(ob, work.Bytes(), emptySlice, nil, rndr.make.opaque)
 	}
 	return beg
 }
@@ -1744,7 +2579,7 @@ func parse_list(ob *bytes.Buffer, rndr *render, data []byte, flags int) int {
 	}
 
 	if nil != rndr.make.list {
-		rndr.make.list(ob, work.Bytes(), flags, rndr.make.opaque)
+		rndr.make.list(ob, work.Bytes(), flags, 1, rndr.make.opaque)
 	}
 	return i
 }
@@ -1770,6 +2605,12 @@ func parse_atxheader(ob *bytes.Buffer, rndr *render, data []byte) int {
 	}
 	skip := end
 
+	/* attribute list, before or after the closing hashes */
+	var attrs *mkd_attrs
+	if rndr.ext_flags&MKDEXT_ATTRIBUTES != 0 {
+		end, attrs = trailing_attrs(data, i, end)
+	}
+
 	for end > 0 && data[end-1] == '#' {
 		end--
 	}
@@ -1778,11 +2619,15 @@ func parse_atxheader(ob *bytes.Buffer, rndr *render, data []byte) int {
 		end--
 	}
 
+	if attrs == nil && rndr.ext_flags&MKDEXT_ATTRIBUTES != 0 {
+		end, attrs = trailing_attrs(data, i, end)
+	}
+
 	if end > i {
 		var work bytes.Buffer
 		parse_inline(&work, rndr, data[i:end])
 		if nil != rndr.make.header {
-			rndr.make.header(ob, work.Bytes(), level, rndr.make.opaque)
+			rndr.make.header(ob, work.Bytes(), level, attrs, rndr.make.opaque)
 		}
 	}
 
@@ -1799,7 +2644,7 @@ func htmlblock_end(tag []byte, rndr *render, data []byte) int {
 	/* assuming data[0] == '<' && data[1] == '/' already tested */
 
 	/* checking if tag is a match */
-	if tag_size+3 >= size || !bytes.HasPrefix(data[2:], tag) || data[tag_size+2] != '>' {
+	if tag_size+3 >= size || !bytes.EqualFold(data[2:2+tag_size], tag) || data[tag_size+2] != '>' {
 		return 0
 	}
 
@@ -1839,7 +2684,7 @@ func parse_htmlblock(ob *bytes.Buffer, rndr *render, data []byte, do_render bool
 	if size < 2 || data[0] != '<' {
 		return 0
 	}
-	curtag := find_block_tag(data[1:])
+	curtag := find_block_tag(rndr, data[1:])
 
 	/* handling of special cases */
 	if 0 == len(curtag) {
@@ -1867,8 +2712,10 @@ func parse_htmlblock(ob *bytes.Buffer, rndr *render, data []byte, do_render bool
 			}
 		}
 
-		/* HR, which is the only self-closing block tag considered */
-		if size > 4 && (data[1] == 'h' || data[1] == 'H') && (data[2] == 'r' || data[2] == 'R') {
+		/* HR, which is the only self-closing block tag considered: */
+		/* <hr>, <hr/>, <hr /> or with attributes */
+		if size > 4 && (data[1] == 'h' || data[1] == 'H') && (data[2] == 'r' || data[2] == 'R') &&
+			(isspace(data[3]) || data[3] == '/' || data[3] == '>') {
 			i = 3
 			for i < size && data[i] != '>' {
 				i += 1
@@ -1892,6 +2739,13 @@ func parse_htmlblock(ob *bytes.Buffer, rndr *render, data []byte, do_render bool
 		return 0
 	}
 
+	/* markdown="1" content, matched by nesting */
+	if rndr.ext_flags&MKDEXT_MARKDOWN_IN_HTML != 0 {
+		if i := parse_markdown_html(ob, rndr, data, curtag, do_render); i > 0 {
+			return i
+		}
+	}
+
 	/* looking for an unindented matching closing tag */
 	/*	followed by a blank line */
 	i = 1
@@ -1926,6 +2780,10 @@ func parse_htmlblock(ob *bytes.Buffer, rndr *render, data []byte, do_render bool
 	}
 
 	/* the end of the block has been found */
+	if do_render && rndr.ext_flags&MKDEXT_LAX_HTML_BLOCKS != 0 && bytes.Equal(curtag, DETAILS_TAG) {
+		render_details_html(ob, rndr, data[:i])
+		return i
+	}
 	if do_render && nil != rndr.make.blockhtml {
 		work_size := i
 		rndr.make.blockhtml(ob, data[:work_size], rndr.make.opaque) // TODO: just use i directly
@@ -2103,7 +2961,7 @@ func parse_table(ob *bytes.Buffer, rndr *render, data []byte) int {
 				break
 			}
 
-			parse_table_row(&body_work, rndr, data[row_start:], col_data)
+			parse_table_row(&body_work, rndr, data[row_start:i], col_data)
 			i++
 		}
 
@@ -2115,6 +2973,86 @@ func parse_table(ob *bytes.Buffer, rndr *render, data []byte) int {
 	return i
 }
 
+/* resolves an included path against the including file and reads it */
+func read_include(rndr *render, name string) ([]byte, string, bool) {
+	if rndr.cfg.FS == nil || name == "" {
+		return nil, "", false
+	}
+
+	max := rndr.cfg.MaxIncludeDepth
+	if max == 0 {
+		max = 8
+	}
+	if len(rndr.includes) >= max {
+		return nil, "", false
+	}
+
+	/* relative to the including file, never outside of the root */
+	dir := "."
+	if n := len(rndr.includes); n > 0 {
+		dir = path.Dir(rndr.includes[n-1])
+	}
+	if strings.HasPrefix(name, "/") {
+		return nil, "", false
+	}
+	p := path.Join(dir, name)
+	if !fs.ValidPath(p) {
+		return nil, "", false
+	}
+
+	for _, inc := range rndr.includes {
+		if inc == p {
+			return nil, "", false /* cycle */
+		}
+	}
+
+	content, err := fs.ReadFile(rndr.cfg.FS, p)
+	if err != nil {
+		return nil, "", false
+	}
+	return content, p, true
+}
+
+/* parsing of an include directive: {{include "path/to/file.md"}} */
+func parse_include(ob *bytes.Buffer, rndr *render, data []byte) int {
+	defer un(trace("parse_include"))
+	size := len(data)
+	end := 0
+	for end < size && data[end] != '\n' {
+		end++
+	}
+	line := bytes.TrimSpace(data[:end])
+	if !bytes.HasPrefix(line, []byte("{{")) || !bytes.HasSuffix(line, []byte("}}")) {
+		return 0
+	}
+	line = bytes.TrimSpace(line[2 : len(line)-2])
+	if !bytes.HasPrefix(line, []byte("include")) {
+		return 0
+	}
+	arg := bytes.TrimSpace(line[len("include"):])
+	if len(arg) < 2 || arg[0] != '"' || arg[len(arg)-1] != '"' {
+		return 0
+	}
+
+	content, p, ok := read_include(rndr, string(arg[1:len(arg)-1]))
+	if !ok {
+		return 0
+	}
+
+	/* the included file goes through both passes, like a document */
+	rndr.includes = append(rndr.includes, p)
+	text := first_pass(rndr, content)
+	if len(text) > 0 {
+		parse_block(ob, rndr, text)
+	}
+	rndr.includes = rndr.includes[:len(rndr.includes)-1]
+
+	if end < size {
+		end++
+	}
+	return end
+}
+
 func parse_block(ob *bytes.Buffer, rndr *render, data []byte) {
 	defer un(trace("parse_block"))
 
@@ -2124,9 +3062,15 @@ func parse_block(ob *bytes.Buffer, rndr *render, data []byte) {
 	rndr.nesting++
 	defer func() { rndr.nesting-- }()
 
+	if rndr.ext_flags&MKDEXT_COMMONMARK != 0 {
+		parse_block_cm(ob, rndr, data)
+		return
+	}
+
 	size := len(data)
 	beg := 0
 	for beg < size {
+		rndr.raw_link = 0
 		txt_data := data[beg:]
 		if is_atxheader(rndr, txt_data) {
 			beg += parse_atxheader(ob, rndr, txt_data)
@@ -2164,6 +3108,18 @@ func parse_block(ob *bytes.Buffer, rndr *render, data []byte) {
 				continue
 			}
 		}
+		if rndr.ext_flags&MKDEXT_INCLUDE != 0 && data[beg] == '{' {
+			if i := parse_include(ob, rndr, txt_data); i != 0 {
+				beg += i
+				continue
+			}
+		}
+		if rndr.ext_flags&(MKDEXT_DETAILS|MKDEXT_DIRECTIVES) != 0 && (data[beg] == '?' || data[beg] == ':' || data[beg] == ' ') {
+			if i := parse_container(ob, rndr, txt_data); i != 0 {
+				beg += i
+				continue
+			}
+		}
 		if prefix_quote(txt_data) > 0 {
 			beg += parse_blockquote(ob, rndr, txt_data)
 			continue
@@ -2314,6 +3270,7 @@ func is_ref(rndr *render, data []byte) int {
 	if rndr != nil {
 		id := string(bytes.ToLower(data[id_offset:id_end]))
 		rndr.refs[id] = &LinkRef{
+			id:    data[id_offset:id_end],
 			link:  data[link_offset:link_end],
 			title: data[title_offset:title_end],
 		}
@@ -2350,7 +3307,7 @@ func expand_tabs(ob *bytes.Buffer, line []byte) {
 	}
 }
 
-func ups_markdown_init(r *render, extensions uint) {
+func ups_markdown_init(r *render, extensions uint, cfg *Config) {
 	defer un(trace("ups_markdown_init"))
 	if nil != r.make.emphasis || nil != r.make.double_emphasis || nil != r.make.triple_emphasis {
 		r.active_char['*'] = MD_CHAR_EMPHASIS
@@ -2377,28 +3334,56 @@ func ups_markdown_init(r *render, extensions uint) {
 	r.active_char['&'] = MD_CHAR_ENTITITY
 
 	if extensions&MKDEXT_AUTOLINK != 0 {
-		// http://, https://, ftp://, mailto://
+		// http://, https://, ftp://, mailto:, xmpp:
 		r.active_char[':'] = MD_CHAR_AUTOLINK
+		r.active_char['w'] = MD_CHAR_AUTOLINK_WWW
+		r.active_char['@'] = MD_CHAR_AUTOLINK_EMAIL
+	}
+
+	if extensions&MKDEXT_MENTIONS != 0 {
+		r.active_char['@'] = MD_CHAR_MENTION
+		r.active_char['#'] = MD_CHAR_ISSUE
+	}
+
+	if extensions&MKDEXT_EMOJI != 0 && r.make.emoji != nil {
+		// :shortcode:, falls back to char_autolink when enabled
+		r.active_char[':'] = MD_CHAR_EMOJI
 	}
 	r.refs = make(map[string]*LinkRef)
 
 	r.ext_flags = extensions
 	r.max_nesting = 16
-}
 
-func MarkdownToHtml(ib []byte, options, extensions uint) []byte {
-	defer un(trace("MarkdownToHtml"))
-	init_markdown_char_ptrs()
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	r.cfg = cfg
 
-	var rndr render
-	rndr.make = upshtml_renderer(options)
-	ups_markdown_init(&rndr, extensions)
+	r.block_tags = block_tags
+	if len(cfg.BlockTags) > 0 {
+		r.block_tags = make(map[string]bool, len(block_tags)+len(cfg.BlockTags))
+		for tag := range block_tags {
+			r.block_tags[tag] = true
+		}
+		for tag, on := range cfg.BlockTags {
+			if on {
+				r.block_tags[tag] = true
+			} else {
+				delete(r.block_tags, tag)
+			}
+		}
+	}
+}
 
+/* looks for references, copying everything else with tabs expanded */
+func first_pass(rndr *render, ib []byte) []byte {
+	if rndr.ext_flags&MKDEXT_COMMONMARK != 0 {
+		return first_pass_cm(ib)
+	}
 	var text bytes.Buffer
-	/* first pass: looking for references, copying everything else */
 	beg, end := 0, 0
 	for beg < len(ib) {
-		if end = is_ref(&rndr, ib[beg:]); end > 0 {
+		if end = is_ref(rndr, ib[beg:]); end > 0 {
 			beg += end
 		} else { /* skipping to the next line */
 			end = beg
@@ -2423,16 +3408,88 @@ func MarkdownToHtml(ib []byte, options, extensions uint) []byte {
 		}
 	}
 
+	/* adding a final newline if not already present */
+	ensure_ends_with_nl(&text)
+	return text.Bytes()
+}
+
+func MarkdownToHtml(ib []byte, options, extensions uint) []byte {
+	return MarkdownToHtmlConfig(ib, options, extensions, nil)
+}
+
+// MarkdownToHtmlConfig is MarkdownToHtml with the additional settings in cfg.
+func MarkdownToHtmlConfig(ib []byte, options, extensions uint, cfg *Config) []byte {
+	return MarkdownToHtmlOptions(ib, &HtmlOptions{Flags: options, Extensions: extensions, Config: cfg})
+}
+
+// MarkdownToHtmlOptions is MarkdownToHtml with the settings of opts, those
+// of the links included. A nil opts renders without extensions.
+func MarkdownToHtmlOptions(ib []byte, opts *HtmlOptions) []byte {
+	defer un(trace("MarkdownToHtml"))
+	if opts == nil {
+		opts = &HtmlOptions{}
+	}
+	renderer := html_renderer(opts)
+	if page := renderer.opaque.(*html_renderopt).page; page != nil {
+		ib = html_page_front_matter(ib, page)
+	}
+	return ups_markdown(renderer, ib, opts.Extensions, opts.Config)
+}
+
+/* reads the "key: value" fields of a front matter, a block between ---
+ * lines at the top of the document, returning them (keys in lower case)
+ * and the rest of the document; no fields when there is none */
+func front_matter(ib []byte) (map[string][]byte, []byte) {
+	if !bytes.HasPrefix(ib, []byte("---\n")) && !bytes.HasPrefix(ib, []byte("---\r\n")) {
+		return nil, ib
+	}
+	rest := ib[bytes.IndexByte(ib, '\n')+1:]
+	fields := make(map[string][]byte)
+	for len(rest) > 0 {
+		line := rest
+		next := []byte(nil)
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line, next = rest[:i], rest[i+1:]
+		}
+		line = bytes.TrimRight(line, "\r")
+		rest = next
+		if bytes.Equal(line, []byte("---")) || bytes.Equal(line, []byte("...")) {
+			return fields, rest
+		}
+		if i := bytes.IndexByte(line, ':'); i > 0 {
+			value := bytes.Trim(line[i+1:], " \t")
+			if n := len(value); n > 1 && (value[0] == '"' || value[0] == '\'') && value[n-1] == value[0] {
+				value = value[1 : n-1]
+			}
+			fields[string(bytes.ToLower(bytes.TrimSpace(line[:i])))] = value
+		}
+	}
+	/* not closed, not a front matter */
+	return nil, ib
+}
+
+/* parses the document, rendering it with the callbacks of renderer */
+func ups_markdown(renderer *mkd_renderer, ib []byte, extensions uint, cfg *Config) []byte {
+	init_markdown_char_ptrs()
+
+	var rndr render
+	rndr.make = renderer
+	ups_markdown_init(&rndr, extensions, cfg)
+
+	/* first pass: looking for references, copying everything else */
+	text := first_pass(&rndr, ib)
+	if rndr.make.source != nil {
+		rndr.make.source.refs = rndr.refs
+	}
+
 	/* second pass: actual rendering */
 	var ob bytes.Buffer
 	if rndr.make.doc_header != nil {
 		rndr.make.doc_header(&ob, rndr.make.opaque)
 	}
 
-	if text.Len() > 0 {
-		/* adding a final newline if not already present */
-		ensure_ends_with_nl(&text)
-		parse_block(&ob, &rndr, text.Bytes())
+	if len(text) > 0 {
+		parse_block(&ob, &rndr, text)
 	}
 
 	if rndr.make.doc_footer != nil {
@@ -2442,6 +3499,36 @@ func MarkdownToHtml(ib []byte, options, extensions uint) []byte {
 	return ob.Bytes()
 }
 
+// WikiLinks returns the page names of all [[wiki links]] in the document,
+// in order of appearance, e.g. for building backlinks.
+func WikiLinks(ib []byte, extensions uint) []string {
+	var pages []string
+	cfg := &Config{WikiResolver: func(page string) (string, bool) {
+		pages = append(pages, page)
+		return wiki_page_url(page)
+	}}
+	MarkdownToHtmlConfig(ib, 0, extensions|MKDEXT_WIKI_LINKS, cfg)
+	return pages
+}
+
+// Mentions returns the @user mentions and the #123 and org/repo#123 issue
+// references in the normal text of the document, in order of appearance,
+// e.g. for sending notifications.
+func Mentions(ib []byte, extensions uint) (users, issues []string) {
+	cfg := &Config{
+		UserResolver: func(user string) (string, bool) {
+			users = append(users, user)
+			return "", false
+		},
+		IssueResolver: func(repo string, number int) (string, bool) {
+			issues = append(issues, repo+"#"+strconv.Itoa(number))
+			return "", false
+		},
+	}
+	MarkdownToHtmlConfig(ib, 0, extensions|MKDEXT_MENTIONS, cfg)
+	return users, issues
+}
+
 func UnitTest() {
 	find_emph_char([]byte("ca"), '*')
 }
@@ -0,0 +1,78 @@
+//go:build ignore
+// +build ignore
+
+/*
+ * Generates emoji.go from the gemoji database of GitHub:
+ *
+ *   curl -O https://raw.githubusercontent.com/github/gemoji/master/db/emoji.json
+ *   go run mkemoji.go emoji.json > emoji.go
+ *
+ * Every alias of an emoji becomes a shortcode. GitHub's custom images
+ * (:octocat:, :shipit:) have no Unicode glyph and are left out; they can
+ * be added with Config.EmojiImages.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+type gemoji struct {
+	Emoji   string   `json:"emoji"`
+	Aliases []string `json:"aliases"`
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: go run mkemoji.go db/emoji.json > emoji.go\n")
+		os.Exit(2)
+	}
+	src, err := ioutil.ReadFile(os.Args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	var db []gemoji
+	if err := json.Unmarshal(src, &db); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+
+	table := make(map[string]string)
+	for _, e := range db {
+		for _, alias := range e.Aliases {
+			if _, dup := table[alias]; !dup && e.Emoji != "" {
+				table[alias] = e.Emoji
+			}
+		}
+	}
+	names := make([]string, 0, len(table))
+	for name := range table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out bytes.Buffer
+	out.WriteString("// Code generated by mkemoji.go from the gemoji database; DO NOT EDIT.\n\n")
+	out.WriteString("package markup\n\n")
+	fmt.Fprintf(&out, "/* the %d GitHub emoji shortcodes (:name:) with a Unicode glyph */\n", len(names))
+	out.WriteString("var emoji_table = map[string]string{\n")
+	for _, name := range names {
+		fmt.Fprintf(&out, "\t%q: %q,\n", name, table[name])
+	}
+	out.WriteString("}\n")
+
+	code, err := format.Source(out.Bytes())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(code)
+}
@@ -0,0 +1,171 @@
+package markup
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+/*
+ * Complete html pages (HTML_COMPLETE_PAGE). The html renderer records the
+ * headers as it goes; doc_footer then executes the page template with the
+ * rendered document, its title and, with HTML_TOC, the table of contents
+ * made by toc_header, and replaces the output by the page.
+ */
+
+// HtmlPage is the data the template of a complete page is executed with.
+type HtmlPage struct {
+	// Lang and Title are those of HtmlOptions, the front matter or the
+	// first level 1 header, Title being empty if there is none.
+	Lang  string
+	Title string
+
+	// Stylesheet and CSS are those of HtmlOptions.
+	Stylesheet string
+	CSS        template.CSS
+
+	// Toc is the table of contents, a list of links to the headers,
+	// with HTML_TOC.
+	Toc template.HTML
+
+	// Body is the rendered document.
+	Body template.HTML
+
+	// Meta holds the fields of the front matter.
+	Meta map[string]string
+}
+
+/* the page chrome when HtmlOptions has no template */
+var html_page_template = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+{{with .Stylesheet}}<link rel="stylesheet" href="{{.}}">
+{{end}}{{with .CSS}}<style>
+{{.}}
+</style>
+{{end}}</head>
+<body>
+{{with .Toc}}<nav class="toc">
+{{.}}</nav>
+{{end}}<main>
+{{.Body}}</main>
+</body>
+</html>
+`))
+
+/* the tags of the rendered text of a header, for the title and the toc */
+var html_tags = regexp.MustCompile(`<[^>]*>`)
+
+type html_page_entry struct {
+	text  []byte
+	level int
+	attrs *mkd_attrs
+}
+
+type html_page struct {
+	meta    map[string]string
+	headers []html_page_entry
+	err     error
+}
+
+/* takes the front matter off the top of the document, for the title and
+ * the lang of the page */
+func html_page_front_matter(ib []byte, page *html_page) []byte {
+	fields, rest := front_matter(ib)
+	if fields == nil {
+		return ib
+	}
+	page.meta = make(map[string]string)
+	for key, value := range fields {
+		page.meta[key] = string(value)
+	}
+	return rest
+}
+
+/* records a header rendered by rndr_header */
+func html_page_header(page *html_page, text []byte, level int, attrs *mkd_attrs) {
+	text = html_tags.ReplaceAll(text, nil)
+	page.headers = append(page.headers, html_page_entry{text, level, attrs})
+}
+
+/* replaces the rendered document by the page */
+func rndr_page(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("rndr_page"))
+	options, _ := opaque.(*html_renderopt)
+	page := options.page
+	opts := options.opts
+	if opts == nil {
+		opts = &HtmlOptions{}
+	}
+
+	data := HtmlPage{
+		Lang:       opts.Lang,
+		Title:      opts.Title,
+		Stylesheet: opts.Stylesheet,
+		CSS:        template.CSS(opts.CSS),
+		Body:       template.HTML(ob.String()),
+		Meta:       page.meta,
+	}
+	if data.Lang == "" {
+		data.Lang = page.meta["lang"]
+	}
+	if data.Lang == "" {
+		data.Lang = "en"
+	}
+	if data.Title == "" {
+		data.Title = page.meta["title"]
+	}
+	for _, h := range page.headers {
+		if data.Title == "" && h.level == 1 {
+			data.Title = strings.TrimSpace(html.UnescapeString(string(h.text)))
+		}
+	}
+
+	if options.flags&HTML_TOC != 0 && len(page.headers) > 0 {
+		var toc bytes.Buffer
+		options.toc_data.header_count = 0
+		options.toc_data.current_level = 0
+		for _, h := range page.headers {
+			toc_header(&toc, h.text, h.level, h.attrs, opaque)
+		}
+		toc_finalize(&toc, opaque)
+		data.Toc = template.HTML(toc.String())
+	}
+
+	tmpl := opts.Template
+	if tmpl == nil {
+		tmpl = html_page_template
+	}
+	var out bytes.Buffer
+	if page.err = tmpl.Execute(&out, data); page.err != nil {
+		/* the document alone */
+		return
+	}
+	ob.Reset()
+	ob.Write(out.Bytes())
+}
+
+// MarkdownToHtmlPage renders the markdown document as a complete html5
+// page, with the settings of opts and HTML_COMPLETE_PAGE. A front matter,
+// "key: value" lines between "---" lines at the top of the document,
+// gives the page its title and lang, and the Meta of the template. The
+// error is that of the template; the document is returned alone then.
+// A nil opts renders the default page without extensions.
+func MarkdownToHtmlPage(ib []byte, opts *HtmlOptions) ([]byte, error) {
+	defer un(trace("MarkdownToHtmlPage"))
+	if opts == nil {
+		opts = &HtmlOptions{}
+	}
+	with := *opts
+	with.Flags |= HTML_COMPLETE_PAGE
+	renderer := html_renderer(&with)
+	page := renderer.opaque.(*html_renderopt).page
+	ib = html_page_front_matter(ib, page)
+	out := ups_markdown(renderer, ib, opts.Extensions, opts.Config)
+	return out, page.err
+}
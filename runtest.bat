@@ -1,6 +1,6 @@
 @mkdir bin
 
-8g -o bin\markup.8 html.go markup.go
+8g -o bin\markup.8 ansi.go autolink.go commonmark.go container.go docbook.go emoji.go highlight.go html.go json.go latex.go man.go markdown.go markup.go page.go sanitize.go text.go unicode.go
 @if ERRORLEVEL 1 EXIT /B 1
 
 8g -o bin\upskirt_ref_test.8 -I bin upskirt_ref_test.go 
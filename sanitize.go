@@ -0,0 +1,531 @@
+package markup
+
+import (
+	"bytes"
+	"html"
+	"strings"
+)
+
+/*
+ * Sanitizing of the raw html (HTML_SANITIZE or HtmlOptions.Policy).
+ * rndr_raw_html and rndr_raw_block parse the tags of the raw html and write
+ * again those the policy allows, with their allowed attributes; comments,
+ * doctypes and processing instructions go away, and so do scripts and
+ * styles with their content. A raw block is balanced on its own: the
+ * elements it leaves open are closed at its end and its stray end tags
+ * dropped. The inline tags are spread over the text of their block, so
+ * doc_footer balances the whole document once it is rendered; an inline
+ * script or style is left there as a bare tag, for the balancing to drop
+ * it with its content.
+ */
+
+// HtmlPolicy is an allowlist of the raw html the sanitizer keeps: the
+// elements, their attributes and the schemes of the urls. The event
+// handlers (on*) and style are always dropped.
+type HtmlPolicy struct {
+	// Elements maps the allowed elements, in lower case, to the
+	// attributes they allow beside Attributes.
+	Elements map[string][]string
+
+	// Attributes are the attributes every allowed element allows.
+	Attributes []string
+
+	// URLSchemes are the schemes of the urls allowed in href, src and
+	// the other url attributes, such as "https". The relative urls are
+	// always allowed; an attribute with another scheme is dropped.
+	URLSchemes []string
+}
+
+// UGCPolicy is a strict policy for user generated content: text markup,
+// lists, tables, quotes, links and images, with http, https and mailto
+// urls, and no ids, classes, forms, frames or media. It is made anew at
+// each call and may be changed. The markdown links are not raw html, use
+// HTML_SAFELINK for those.
+func UGCPolicy() *HtmlPolicy {
+	elements := map[string][]string{
+		"a":          {"href"},
+		"img":        {"src", "alt", "width", "height"},
+		"blockquote": {"cite"},
+		"q":          {"cite"},
+		"del":        {"cite", "datetime"},
+		"ins":        {"cite", "datetime"},
+		"ol":         {"start", "reversed"},
+		"li":         {"value"},
+		"th":         {"align", "colspan", "rowspan"},
+		"td":         {"align", "colspan", "rowspan"},
+		"details":    {"open"},
+		"time":       {"datetime"},
+	}
+	for _, name := range strings.Fields(`p br hr h1 h2 h3 h4 h5 h6 pre code
+		kbd samp var em strong b i u s strike sub sup small mark abbr cite
+		dfn span div ul dl dt dd table thead tbody tfoot tr caption
+		summary figure figcaption`) {
+		elements[name] = nil
+	}
+	return &HtmlPolicy{
+		Elements:   elements,
+		Attributes: []string{"title", "lang", "dir"},
+		URLSchemes: []string{"http", "https", "mailto"},
+	}
+}
+
+/* the elements without content nor end tag */
+var html_void = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+/* the elements dropped with their content */
+var html_drop_content = map[string]bool{
+	"script": true, "style": true, "template": true, "textarea": true,
+	"title": true, "xmp": true, "iframe": true, "noembed": true,
+	"noframes": true, "noscript": true, "object": true, "svg": true,
+	"math": true,
+}
+
+/* the start tags closing an open p */
+var html_closes_p = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"center": true, "details": true, "dialog": true, "dir": true,
+	"div": true, "dl": true, "fieldset": true, "figcaption": true,
+	"figure": true, "footer": true, "form": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true,
+	"hgroup": true, "hr": true, "listing": true, "main": true,
+	"menu": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"section": true, "summary": true, "table": true, "ul": true,
+}
+
+/* the elements a p inside stays open in */
+var html_p_scope = map[string]bool{
+	"applet": true, "button": true, "caption": true, "html": true,
+	"marquee": true, "object": true, "table": true, "td": true,
+	"template": true, "th": true,
+}
+
+/* the attributes holding a url */
+var html_url_attrs = map[string]bool{
+	"href": true, "src": true, "cite": true, "action": true,
+	"formaction": true, "poster": true, "background": true,
+	"longdesc": true, "usemap": true, "data": true, "xlink:href": true,
+}
+
+type html_attr struct {
+	key   string /* in lower case */
+	value string /* the entities decoded */
+	bare  bool   /* no value */
+}
+
+type html_tag struct {
+	name  string /* in lower case */
+	end   bool
+	empty bool /* ends with "/>" */
+	attrs []html_attr
+}
+
+/* parses the tag at the start of data; the size is 0 if there is none */
+func parse_html_tag(data []byte) (tag html_tag, size int) {
+	if len(data) < 2 || data[0] != '<' {
+		return tag, 0
+	}
+	i := 1
+	if data[i] == '/' {
+		tag.end = true
+		i++
+	}
+	org := i
+	if i >= len(data) || !isalpha(data[i]) {
+		return tag, 0
+	}
+	for i < len(data) && (isalnum(data[i]) || data[i] == '-') {
+		i++
+	}
+	tag.name = strings.ToLower(string(data[org:i]))
+	if i < len(data) && !isspace(data[i]) && data[i] != '/' && data[i] != '>' {
+		return tag, 0
+	}
+
+	for {
+		for i < len(data) && isspace(data[i]) {
+			i++
+		}
+		if i >= len(data) {
+			return tag, 0
+		}
+		switch data[i] {
+		case '>':
+			return tag, i + 1
+		case '/':
+			if i+1 < len(data) && data[i+1] == '>' {
+				tag.empty = true
+				return tag, i + 2
+			}
+			i++
+			continue
+		}
+
+		org = i
+		for i < len(data) && !isspace(data[i]) && data[i] != '/' && data[i] != '>' && (i == org || data[i] != '=') {
+			i++
+		}
+		attr := html_attr{key: strings.ToLower(string(data[org:i])), bare: true}
+		j := i
+		for j < len(data) && isspace(data[j]) {
+			j++
+		}
+		if j < len(data) && data[j] == '=' {
+			j++
+			for j < len(data) && isspace(data[j]) {
+				j++
+			}
+			if j >= len(data) {
+				return tag, 0
+			}
+			if q := data[j]; q == '"' || q == '\'' {
+				end := bytes.IndexByte(data[j+1:], q)
+				if end < 0 {
+					return tag, 0
+				}
+				attr.value = string(data[j+1 : j+1+end])
+				j += end + 2
+			} else {
+				org = j
+				for j < len(data) && !isspace(data[j]) && data[j] != '>' {
+					j++
+				}
+				attr.value = string(data[org:j])
+			}
+			attr.value = html.UnescapeString(attr.value)
+			attr.bare = false
+			i = j
+		}
+		tag.attrs = append(tag.attrs, attr)
+	}
+}
+
+/* the size of the comment, doctype, cdata or processing instruction at
+ * the start of data, 0 if there is none */
+func html_markup_size(data []byte) int {
+	var end string
+	switch {
+	case bytes.HasPrefix(data, []byte("<!--")):
+		end = "-->"
+	case bytes.HasPrefix(data, []byte("<![CDATA[")):
+		end = "]]>"
+	case bytes.HasPrefix(data, []byte("<!")), bytes.HasPrefix(data, []byte("<?")):
+		end = ">"
+	default:
+		return 0
+	}
+	if i := bytes.Index(data[2:], []byte(end)); i >= 0 {
+		return i + 2 + len(end)
+	}
+	return len(data)
+}
+
+/* the size of the content of an element dropped with it, up to the end
+ * of its end tag; 0 without one, only the tag goes then */
+func html_content_size(data []byte, name string) int {
+	for i := 0; i < len(data); i++ {
+		if data[i] != '<' {
+			continue
+		}
+		if tag, size := parse_html_tag(data[i:]); size > 0 && tag.end && tag.name == name {
+			return i + size
+		}
+	}
+	return 0
+}
+
+func (policy *HtmlPolicy) allows(name string) bool {
+	_, ok := policy.Elements[name]
+	return ok
+}
+
+func (policy *HtmlPolicy) allows_attr(name, key string) bool {
+	if strings.HasPrefix(key, "on") || key == "style" {
+		return false
+	}
+	for _, k := range policy.Attributes {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	for _, k := range policy.Elements[name] {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+/* a relative url or one of the allowed schemes; the blanks and control
+ * characters the browsers skip are not taken into account */
+func (policy *HtmlPolicy) allows_url(value string) bool {
+	link := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value)
+	i := strings.IndexAny(link, ":/?#")
+	if i <= 0 || link[i] != ':' || !isalpha(link[0]) {
+		return true
+	}
+	for j := 1; j < i; j++ {
+		if c := link[j]; !isalnum(c) && c != '+' && c != '-' && c != '.' {
+			return true
+		}
+	}
+	for _, scheme := range policy.URLSchemes {
+		if strings.EqualFold(scheme, link[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+/* writes a start tag with the attributes the policy allows; the links get
+ * the rel, target and class of the external links */
+func sanitize_tag(ob *bytes.Buffer, tag *html_tag, options *html_renderopt) {
+	policy := options.policy
+	ob.WriteByte('<')
+	ob.WriteString(tag.name)
+	seen := make(map[string]bool)
+	var link mkd_attrs
+	var href []byte
+	for _, attr := range tag.attrs {
+		if seen[attr.key] || !policy.allows_attr(tag.name, attr.key) {
+			continue
+		}
+		seen[attr.key] = true
+		if html_url_attrs[attr.key] && !policy.allows_url(attr.value) {
+			continue
+		}
+		if tag.name == "a" {
+			switch attr.key {
+			case "href":
+				href = []byte(attr.value)
+			case "class":
+				for _, class := range strings.Fields(attr.value) {
+					link.classes = append(link.classes, []byte(class))
+				}
+				continue
+			case "rel", "target":
+				link.pairs = append(link.pairs, mkd_attr{[]byte(attr.key), []byte(attr.value)})
+				continue
+			}
+		}
+		ob.WriteByte(' ')
+		ob.WriteString(attr.key)
+		if !attr.bare {
+			ob.WriteString("=\"")
+			attr_escape(ob, []byte(attr.value))
+			ob.WriteByte('"')
+		}
+	}
+	if tag.name == "a" {
+		attrs := &link
+		if href != nil {
+			attrs = link_attrs(href, attrs, options)
+		}
+		if len(attrs.classes) > 0 {
+			ob.WriteString(" class=\"")
+			attr_escape(ob, bytes.Join(attrs.classes, []byte(" ")))
+			ob.WriteByte('"')
+		}
+		for _, p := range attrs.pairs {
+			ob.WriteByte(' ')
+			ob.Write(p.key)
+			ob.WriteString("=\"")
+			attr_escape(ob, p.value)
+			ob.WriteByte('"')
+		}
+	}
+	if tag.empty && options.flags&HTML_USE_XHTML != 0 {
+		ob.WriteString(" />")
+	} else {
+		ob.WriteByte('>')
+	}
+}
+
+/* writes the raw html the policy allows; with balance, the inline elements
+ * left open are closed at the end and their stray end tags dropped. The
+ * blocks stay to html_balance, their tags may come in raw blocks of their
+ * own around markdown. */
+func sanitize_html(ob *bytes.Buffer, data []byte, options *html_renderopt, balance bool) {
+	defer un(trace("sanitize_html"))
+	var open []string
+	i := 0
+	for i < len(data) {
+		org := i
+		for i < len(data) && data[i] != '<' {
+			i++
+		}
+		ob.Write(bytes.Replace(data[org:i], []byte(">"), esc_gt, -1))
+		if i >= len(data) {
+			break
+		}
+
+		if size := html_markup_size(data[i:]); size > 0 {
+			i += size
+			continue
+		}
+		tag, size := parse_html_tag(data[i:])
+		if size == 0 {
+			ob.Write(esc_lt)
+			i++
+			continue
+		}
+		i += size
+		switch {
+		case html_drop_content[tag.name] && !balance:
+			/* an inline tag comes alone, html_balance drops the
+			 * content after it */
+			if !tag.empty {
+				ob.WriteByte('<')
+				if tag.end {
+					ob.WriteByte('/')
+				}
+				ob.WriteString(tag.name)
+				ob.WriteByte('>')
+			}
+		case html_drop_content[tag.name]:
+			if !tag.end && !tag.empty {
+				i += html_content_size(data[i:], tag.name)
+			}
+		case !options.policy.allows(tag.name):
+		case tag.end:
+			if balance {
+				k := len(open) - 1
+				for k >= 0 && open[k] != tag.name {
+					k--
+				}
+				if k < 0 && !html_closes_p[tag.name] {
+					continue
+				}
+				if k >= 0 {
+					close_tags(ob, open[k+1:])
+					open = open[:k]
+				}
+			}
+			ob.WriteString("</")
+			ob.WriteString(tag.name)
+			ob.WriteByte('>')
+		default:
+			if balance {
+				open = close_p(ob, open, tag.name)
+			}
+			sanitize_tag(ob, &tag, options)
+			if balance && !tag.empty && !html_void[tag.name] {
+				open = append(open, tag.name)
+			}
+		}
+	}
+	k := len(open)
+	for k > 0 && !html_closes_p[open[k-1]] {
+		k--
+	}
+	close_tags(ob, open[k:])
+}
+
+/* closes the open elements, the innermost first */
+func close_tags(ob *bytes.Buffer, open []string) {
+	for k := len(open) - 1; k >= 0; k-- {
+		ob.WriteString("</")
+		ob.WriteString(open[k])
+		ob.WriteByte('>')
+	}
+}
+
+/* closes the p a start tag ends, with the elements open inside it, the
+ * way the html parsers do; returns the elements still open */
+func close_p(ob *bytes.Buffer, open []string, name string) []string {
+	if !html_closes_p[name] {
+		return open
+	}
+	for k := len(open) - 1; k >= 0 && !html_p_scope[open[k]]; k-- {
+		if open[k] == "p" {
+			close_tags(ob, open[k:])
+			return open[:k]
+		}
+	}
+	return open
+}
+
+/* balances the tags of the rendered document: an end tag closes the
+ * elements left open inside its own, the stray ones are dropped, a start
+ * tag closes the p it ends and the elements still open at the end are
+ * closed. The scripts and styles of the inline html go away with their
+ * content, or alone when it has no end tag. */
+func html_balance(ob *bytes.Buffer) {
+	defer un(trace("html_balance"))
+	data := ob.Bytes()
+	var out bytes.Buffer
+	var open []string
+	i := 0
+	for i < len(data) {
+		org := i
+		for i < len(data) && data[i] != '<' {
+			i++
+		}
+		out.Write(data[org:i])
+		if i >= len(data) {
+			break
+		}
+
+		tag, size := parse_html_tag(data[i:])
+		if size == 0 {
+			out.WriteByte('<')
+			i++
+			continue
+		}
+		raw := data[i : i+size]
+		i += size
+		if html_drop_content[tag.name] {
+			if !tag.end {
+				/* the end tag is looked for in the element the tag
+				 * is in, the paragraph of an inline one */
+				span := data[i:]
+				if k := len(open); k > 0 {
+					if e := bytes.Index(span, []byte("</"+open[k-1]+">")); e >= 0 {
+						span = span[:e]
+					}
+				}
+				i += html_content_size(span, tag.name)
+			}
+			continue
+		}
+		if !tag.end {
+			open = close_p(&out, open, tag.name)
+		}
+		switch {
+		case tag.end:
+			k := len(open) - 1
+			for k >= 0 && open[k] != tag.name {
+				k--
+			}
+			if k < 0 {
+				continue
+			}
+			close_tags(&out, open[k+1:])
+			open = open[:k]
+		case !tag.empty && !html_void[tag.name]:
+			open = append(open, tag.name)
+		}
+		out.Write(raw)
+	}
+	close_tags(&out, open)
+	ob.Reset()
+	ob.Write(out.Bytes())
+}
+
+/* balances the sanitized document before the page is made of it */
+func rndr_sanitized_footer(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("rndr_sanitized_footer"))
+	options, _ := opaque.(*html_renderopt)
+	html_balance(ob)
+	if options.page != nil {
+		rndr_page(ob, opaque)
+	}
+}
@@ -0,0 +1,581 @@
+package markup
+
+import (
+	"bytes"
+	"html"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Plain text renderer, for search indexes, text/plain mail parts and
+ * previews. The markup is dropped; lists, quotes, tables and code keep
+ * their layout.
+ *
+ * The callbacks get their content already rendered and don't know how
+ * deep they are nested, so the text is wrapped at the end: the lines of
+ * running text are marked with text_wrap, the containers prefix the lines
+ * they get (bullets, "> ") and doc_footer wraps every marked line at the
+ * width left after its prefix.
+ */
+
+/* plain text options */
+const (
+	TEXT_LINK_URLS      = 1 << 0 /* the url after the link text: "text (url)" */
+	TEXT_LINK_FOOTNOTES = 1 << 1 /* numbered links, "text [1]", listed at the end */
+)
+
+/* markers of the intermediate output, removed from the input text */
+const (
+	text_wrap  = '\x01' /* starts a line of running text */
+	text_break = '\x02' /* hard line break in running text */
+	text_item  = '\x03' /* starts a list item */
+	text_row   = '\x1e' /* ends a table row */
+	text_cell  = '\x1f' /* starts a table cell, followed by its alignment */
+)
+
+/* width of the horizontal rules when the text isn't wrapped */
+const text_hrule_width = 72
+
+// TextOptions are the settings of MarkdownToText.
+type TextOptions struct {
+	// Flags is a combination of the TEXT_* flags.
+	Flags uint
+
+	// Width is the column at which running text is wrapped,
+	// 0 leaves every paragraph on a single line.
+	Width int
+
+	// Extensions are the MKDEXT_* flags of the parser.
+	Extensions uint
+
+	// Config holds the additional parser settings, it may be nil.
+	Config *Config
+}
+
+type text_renderopt struct {
+	flags    uint
+	width    int
+	links    []string
+	link_ids map[string]int
+}
+
+/* copies text, dropping the markers and joining the lines */
+func text_escape(ob *bytes.Buffer, text []byte) {
+	for _, c := range text {
+		switch c {
+		case text_wrap, text_item, text_row, text_cell:
+		case '\n', text_break:
+			ob.WriteByte(' ')
+		default:
+			ob.WriteByte(c)
+		}
+	}
+}
+
+/* display width of text, in columns */
+func text_width(text []byte) int {
+	w := 0
+	for _, r := range string(text) {
+		w += rune_width(r)
+	}
+	return w
+}
+
+/* blocks are separated by a blank line */
+func text_block(ob *bytes.Buffer) {
+	if ob.Len() > 0 {
+		ensure_ends_with_nl(ob)
+		ob.WriteByte('\n')
+	}
+}
+
+/* writes running text, one wrapped line per hard line break */
+func text_running(ob *bytes.Buffer, text []byte) {
+	for _, line := range bytes.Split(text, []byte{text_break}) {
+		ob.WriteByte(text_wrap)
+		ob.Write(bytes.Trim(line, " "))
+		ob.WriteByte('\n')
+	}
+}
+
+/* prefixes the lines of text, first on the first line and rest on the
+ * others; blank lines keep the prefix without its trailing spaces */
+func text_indent(ob *bytes.Buffer, text []byte, first, rest string) {
+	text = bytes.TrimRight(text, "\n")
+	for i, line := range bytes.Split(text, []byte("\n")) {
+		prefix := rest
+		if i == 0 {
+			prefix = first
+		}
+		if len(line) == 0 {
+			ob.WriteString(strings.TrimRight(prefix, " "))
+		} else {
+			ob.WriteString(prefix)
+			ob.Write(line)
+		}
+		ob.WriteByte('\n')
+	}
+}
+
+/* appends the url of a link to its text, according to the options */
+func text_link_url(ob *bytes.Buffer, options *text_renderopt, link []byte) {
+	if len(link) == 0 {
+		return
+	}
+	switch {
+	case options.flags&TEXT_LINK_FOOTNOTES != 0:
+		id, ok := options.link_ids[string(link)]
+		if !ok {
+			options.links = append(options.links, string(link))
+			id = len(options.links)
+			options.link_ids[string(link)] = id
+		}
+		ob.WriteString(" [")
+		ob.WriteString(strconv.Itoa(id))
+		ob.WriteByte(']')
+
+	case options.flags&TEXT_LINK_URLS != 0:
+		ob.WriteString(" (")
+		text_escape(ob, link)
+		ob.WriteByte(')')
+	}
+}
+
+func text_blockcode(ob *bytes.Buffer, text []byte, lang []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("text_blockcode"))
+	text_block(ob)
+	text = bytes.TrimRight(text, "\n")
+	for _, line := range bytes.Split(text, []byte("\n")) {
+		if len(line) > 0 {
+			ob.WriteString("    ")
+			text_escape(ob, line)
+		}
+		ob.WriteByte('\n')
+	}
+}
+
+func text_blockquote(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("text_blockquote"))
+	text_block(ob)
+	text_indent(ob, bytes.TrimLeft(text, "\n"), "> ", "> ")
+}
+
+/* raw html is dropped, with its content */
+func text_raw_block(ob *bytes.Buffer, text []byte, opaque interface{}) {
+}
+
+func text_header(ob *bytes.Buffer, text []byte, level int, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("text_header"))
+	text_block(ob)
+	var line bytes.Buffer
+	text_escape(&line, bytes.Trim(text, " "))
+	ob.Write(line.Bytes())
+	ob.WriteByte('\n')
+
+	/* setext underlines for the first two levels */
+	if level <= 2 {
+		c := "="
+		if level == 2 {
+			c = "-"
+		}
+		ob.WriteString(strings.Repeat(c, text_width(line.Bytes())))
+		ob.WriteByte('\n')
+	}
+}
+
+func text_hrule(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("text_hrule"))
+	options, _ := opaque.(*text_renderopt)
+	text_block(ob)
+	width := options.width
+	if width <= 0 {
+		width = text_hrule_width
+	}
+	ob.WriteString(strings.Repeat("-", width))
+	ob.WriteByte('\n')
+}
+
+/* numbers the items and indents their content under the bullet */
+func text_list(ob *bytes.Buffer, text []byte, flags, start int, opaque interface{}) {
+	defer un(trace("text_list"))
+	text_block(ob)
+	items := bytes.Split(text, []byte{text_item})
+	for i, item := range items[1:] {
+		bullet := "- "
+		if flags&MKD_LIST_ORDERED != 0 {
+			bullet = strconv.Itoa(start+i) + ". "
+		}
+		/* the items made of blocks start with a blank line */
+		if len(item) > 0 && item[0] == '\n' {
+			if i > 0 {
+				ob.WriteByte('\n')
+			}
+			item = item[1:]
+		}
+		text_indent(ob, item, bullet, strings.Repeat(" ", len(bullet)))
+	}
+}
+
+func text_listitem(ob *bytes.Buffer, text []byte, flags int, opaque interface{}) {
+	defer un(trace("text_listitem"))
+	ob.WriteByte(text_item)
+	if flags&MKD_LI_BLOCK != 0 {
+		ob.WriteByte('\n')
+		ob.Write(bytes.Trim(text, "\n"))
+		ob.WriteByte('\n')
+		return
+	}
+
+	/* inline content, then maybe a sublist on the following lines */
+	head, rest := text, []byte(nil)
+	if i := bytes.IndexByte(text, '\n'); i >= 0 {
+		head, rest = text[:i], bytes.TrimLeft(text[i:], "\n")
+	}
+	text_running(ob, head)
+	ob.Write(rest)
+}
+
+func text_paragraph(ob *bytes.Buffer, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("text_paragraph"))
+	text = bytes.Trim(text, " ")
+	if len(text) == 0 {
+		return
+	}
+	text_block(ob)
+	text_running(ob, text)
+}
+
+/* lays the cells out in columns, the header underlined */
+func text_table(ob *bytes.Buffer, header []byte, body []byte, opaque interface{}) {
+	defer un(trace("text_table"))
+	text_block(ob)
+
+	rows, aligns := text_table_rows(header, body)
+	widths := make([]int, len(aligns))
+	for _, row := range rows {
+		for i, cell := range row {
+			if w := text_width(cell); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+
+	var line bytes.Buffer
+	for r, row := range rows {
+		line.Reset()
+		for i, cell := range row {
+			if i > 0 {
+				line.WriteString("  ")
+			}
+			pad := widths[i] - text_width(cell)
+			left := 0
+			switch aligns[i] {
+			case MKD_TABLE_ALIGN_R:
+				left = pad
+			case MKD_TABLE_ALIGN_CENTER:
+				left = pad / 2
+			}
+			line.WriteString(strings.Repeat(" ", left))
+			line.Write(cell)
+			line.WriteString(strings.Repeat(" ", pad-left))
+		}
+		ob.Write(bytes.TrimRight(line.Bytes(), " "))
+		ob.WriteByte('\n')
+
+		if r == 0 {
+			for i, w := range widths {
+				if i > 0 {
+					ob.WriteString("  ")
+				}
+				ob.WriteString(strings.Repeat("-", w))
+			}
+			ob.WriteByte('\n')
+		}
+	}
+}
+
+/* splits the marked rows of a table into cells, the header row first,
+ * and returns the alignment of each column */
+func text_table_rows(header []byte, body []byte) ([][][]byte, []int) {
+	var rows [][][]byte
+	var aligns []int
+	for _, part := range [][]byte{header, body} {
+		for _, row := range bytes.Split(part, []byte{text_row}) {
+			cells := bytes.Split(row, []byte{text_cell})
+			if len(cells) < 2 {
+				continue
+			}
+			cells = cells[1:]
+			for i, cell := range cells {
+				if i >= len(aligns) {
+					aligns = append(aligns, int(cell[0]-'0'))
+				}
+				cells[i] = cell[1:]
+			}
+			rows = append(rows, cells)
+		}
+	}
+	return rows, aligns
+}
+
+func text_tablerow(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("text_tablerow"))
+	ob.Write(text)
+	ob.WriteByte(text_row)
+}
+
+func text_tablecell(ob *bytes.Buffer, text []byte, align int, opaque interface{}) {
+	defer un(trace("text_tablecell"))
+	ob.WriteByte(text_cell)
+	ob.WriteByte(byte('0' + align))
+	text_escape(ob, bytes.Trim(text, " "))
+}
+
+func text_details(ob *bytes.Buffer, summary []byte, text []byte, open bool, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("text_details"))
+	text_block(ob)
+	text_running(ob, bytes.Trim(summary, " "))
+	if text = bytes.Trim(text, "\n"); len(text) > 0 {
+		ob.WriteByte('\n')
+		ob.Write(text)
+		ob.WriteByte('\n')
+	}
+}
+
+func text_directive(ob *bytes.Buffer, name []byte, title []byte, text []byte, attrs *mkd_attrs, opaque interface{}) {
+	defer un(trace("text_directive"))
+	text_block(ob)
+	if title = bytes.Trim(title, " "); len(title) > 0 {
+		text_running(ob, title)
+		ob.WriteByte('\n')
+	}
+	ob.Write(bytes.Trim(text, "\n"))
+	ob.WriteByte('\n')
+}
+
+func text_autolink(ob *bytes.Buffer, link []byte, typ int, opaque interface{}) bool {
+	defer un(trace("text_autolink"))
+	if len(link) == 0 {
+		return false
+	}
+	text_escape(ob, bytes.TrimPrefix(link, []byte("mailto:")))
+	return true
+}
+
+func text_codespan(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("text_codespan"))
+	text_escape(ob, text)
+	return true
+}
+
+/* emphasis of any kind keeps its text only */
+func text_emphasis(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("text_emphasis"))
+	if len(text) == 0 {
+		return false
+	}
+	ob.Write(text)
+	return true
+}
+
+func text_image(ob *bytes.Buffer, link []byte, title []byte, alt []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("text_image"))
+	options, _ := opaque.(*text_renderopt)
+	text_escape(ob, alt)
+	text_link_url(ob, options, link)
+	return true
+}
+
+func text_linebreak(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	defer un(trace("text_linebreak"))
+	ob.WriteByte(text_break)
+	return true
+}
+
+func text_link(ob *bytes.Buffer, link []byte, title []byte, content []byte, attrs *mkd_attrs, opaque interface{}) bool {
+	defer un(trace("text_link"))
+	options, _ := opaque.(*text_renderopt)
+	ob.Write(content)
+
+	if !text_is_url(content, link) {
+		text_link_url(ob, options, link)
+	}
+	return true
+}
+
+/* no need to repeat an url that is the text of its link, like the
+ * www. autolinks */
+func text_is_url(text []byte, link []byte) bool {
+	for _, scheme := range []string{"", "mailto:", "http://", "https://"} {
+		if bytes.HasPrefix(link, []byte(scheme)) && bytes.Equal(text, link[len(scheme):]) {
+			return true
+		}
+	}
+	return false
+}
+
+/* inline html is dropped */
+func text_raw_html(ob *bytes.Buffer, text []byte, opaque interface{}) bool {
+	return true
+}
+
+func text_emoji(ob *bytes.Buffer, name []byte, glyph []byte, image []byte, opaque interface{}) bool {
+	defer un(trace("text_emoji"))
+	if len(glyph) > 0 {
+		text_escape(ob, glyph)
+	} else {
+		ob.WriteByte(':')
+		text_escape(ob, name)
+		ob.WriteByte(':')
+	}
+	return true
+}
+
+func text_entity(ob *bytes.Buffer, entity []byte, opaque interface{}) {
+	defer un(trace("text_entity"))
+	text_escape(ob, []byte(html.UnescapeString(string(entity))))
+}
+
+func text_normal_text(ob *bytes.Buffer, text []byte, opaque interface{}) {
+	defer un(trace("text_normal_text"))
+	text_escape(ob, text)
+}
+
+/* replaces the continuation of a prefix by spaces, keeping the quotes */
+func text_continuation(prefix []byte) []byte {
+	var rest bytes.Buffer
+	for _, r := range string(prefix) {
+		if r == '>' {
+			rest.WriteByte('>')
+		} else {
+			rest.WriteByte(' ')
+		}
+	}
+	return rest.Bytes()
+}
+
+/* writes a marked line of running text, wrapped at width */
+func text_wrap_line(ob *bytes.Buffer, prefix []byte, text []byte, width int) {
+	ob.Write(prefix)
+	col := text_width(prefix)
+	first := true
+	for _, word := range bytes.Split(text, []byte(" ")) {
+		if len(word) == 0 {
+			continue
+		}
+		w := text_width(word)
+		if !first && width > 0 && col+1+w > width {
+			ob.WriteByte('\n')
+			rest := text_continuation(prefix)
+			ob.Write(rest)
+			col = text_width(rest)
+			first = true
+		}
+		if !first {
+			ob.WriteByte(' ')
+			col++
+		}
+		ob.Write(word)
+		col += w
+		first = false
+	}
+	if first {
+		/* nothing but the prefix */
+		ob.Truncate(ob.Len() - len(prefix))
+		ob.Write(bytes.TrimRight(prefix, " "))
+	}
+	ob.WriteByte('\n')
+}
+
+/* wraps the running text and lists the footnote links */
+func text_finalize(ob *bytes.Buffer, opaque interface{}) {
+	defer un(trace("text_finalize"))
+	options, _ := opaque.(*text_renderopt)
+
+	var out bytes.Buffer
+	for _, line := range bytes.Split(ob.Bytes(), []byte("\n")) {
+		if i := bytes.IndexByte(line, text_wrap); i >= 0 {
+			text_wrap_line(&out, line[:i], line[i+1:], options.width)
+		} else {
+			out.Write(line)
+			out.WriteByte('\n')
+		}
+	}
+
+	text := bytes.TrimRight(out.Bytes(), "\n")
+	if len(options.links) > 0 {
+		var notes bytes.Buffer
+		for i, link := range options.links {
+			notes.WriteString("\n[" + strconv.Itoa(i+1) + "] ")
+			text_escape(&notes, []byte(link))
+		}
+		text = append(text, '\n')
+		text = append(text, notes.Bytes()...)
+	}
+
+	ob.Reset()
+	if len(text) > 0 {
+		ob.Write(text)
+		ob.WriteByte('\n')
+	}
+}
+
+func text_renderer(options *TextOptions) *mkd_renderer {
+	renderer := &mkd_renderer{
+		text_blockcode,
+		text_blockquote,
+		text_raw_block,
+		text_header,
+		text_hrule,
+		text_list,
+		text_listitem,
+		text_paragraph,
+		text_table,
+		text_tablerow,
+		text_tablecell,
+		nil,
+		text_details,
+		text_directive,
+
+		text_autolink,
+		text_codespan,
+		text_emphasis,
+		text_emphasis,
+		text_image,
+		text_linebreak,
+		text_link,
+		text_raw_html,
+		text_emphasis,
+		text_emphasis,
+		text_emoji,
+
+		text_entity,
+		text_normal_text,
+
+		nil,
+		text_finalize,
+		nil,
+		nil}
+
+	renderer.opaque = &text_renderopt{
+		flags:    options.Flags,
+		width:    options.Width,
+		link_ids: make(map[string]int),
+	}
+	return renderer
+}
+
+func (opts *TextOptions) renderer() (*mkd_renderer, *Config) {
+	return text_renderer(opts), opts.Config
+}
+
+// MarkdownToText renders the markdown document as plain text.
+// A nil opts wraps nothing and drops the link urls.
+func MarkdownToText(ib []byte, opts *TextOptions) []byte {
+	defer un(trace("MarkdownToText"))
+	if opts == nil {
+		opts = &TextOptions{}
+	}
+	return ups_markdown(text_renderer(opts), ib, opts.Extensions, opts.Config)
+}
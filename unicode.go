@@ -0,0 +1,123 @@
+package markup
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+ * Character classes of the text around the markup. isspace, ispunct and
+ * isalnum only know ASCII; the versions below decode the rune at or
+ * before a position, so that accented, Cyrillic or CJK letters are part
+ * of words and non-breaking or ideographic spaces are space. ASCII bytes
+ * are answered without decoding.
+ */
+
+/* rune starting at data[i]; past the end of the text it is a line end */
+func rune_at(data []byte, i int) rune {
+	if i >= len(data) {
+		return '\n'
+	}
+	if c := data[i]; c < utf8.RuneSelf {
+		return rune(c)
+	}
+	r, _ := utf8.DecodeRune(data[i:])
+	return r
+}
+
+/* rune ending just before data[i]; before the text it is a line end */
+func rune_before(data []byte, i int) rune {
+	if i <= 0 {
+		return '\n'
+	}
+	if c := data[i-1]; c < utf8.RuneSelf {
+		return rune(c)
+	}
+	r, _ := utf8.DecodeLastRune(data[:i])
+	return r
+}
+
+/* whitespace, including U+00A0 and the other Zs spaces */
+func isspace_rune(r rune) bool {
+	if r < utf8.RuneSelf {
+		return isspace(byte(r))
+	}
+	return unicode.IsSpace(r)
+}
+
+/* punctuation or symbol, as CommonMark defines punctuation */
+func ispunct_rune(r rune) bool {
+	if r < utf8.RuneSelf {
+		return ispunct(byte(r))
+	}
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+/* a character of a word: letter, digit or combining mark */
+func isalnum_rune(r rune) bool {
+	if r < utf8.RuneSelf {
+		return isalnum(byte(r))
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+/* length of the letter or digit starting at data[i], 0 if there is none */
+func alnum_len(data []byte, i int) int {
+	if i >= len(data) {
+		return 0
+	}
+	if c := data[i]; c < utf8.RuneSelf {
+		if isalnum(c) {
+			return 1
+		}
+		return 0
+	}
+	r, n := utf8.DecodeRune(data[i:])
+	if r == utf8.RuneError || !isalnum_rune(r) {
+		return 0
+	}
+	return n
+}
+
+/* the wide and fullwidth East Asian characters, emoji included */
+var east_asian_wide = [][2]rune{
+	{0x1100, 0x115f}, {0x231a, 0x231b}, {0x2329, 0x232a}, {0x23e9, 0x23ec},
+	{0x23f0, 0x23f0}, {0x23f3, 0x23f3}, {0x25fd, 0x25fe}, {0x2614, 0x2615},
+	{0x2648, 0x2653}, {0x267f, 0x267f}, {0x2693, 0x2693}, {0x26a1, 0x26a1},
+	{0x26aa, 0x26ab}, {0x26bd, 0x26be}, {0x26c4, 0x26c5}, {0x26ce, 0x26ce},
+	{0x26d4, 0x26d4}, {0x26ea, 0x26ea}, {0x26f2, 0x26f3}, {0x26f5, 0x26f5},
+	{0x26fa, 0x26fa}, {0x26fd, 0x26fd}, {0x2705, 0x2705}, {0x270a, 0x270b},
+	{0x2728, 0x2728}, {0x274c, 0x274c}, {0x274e, 0x274e}, {0x2753, 0x2755},
+	{0x2757, 0x2757}, {0x2795, 0x2797}, {0x27b0, 0x27b0}, {0x27bf, 0x27bf},
+	{0x2b1b, 0x2b1c}, {0x2b50, 0x2b50}, {0x2b55, 0x2b55}, {0x2e80, 0x303e},
+	{0x3041, 0x33ff}, {0x3400, 0x4dbf}, {0x4e00, 0x9fff}, {0xa000, 0xa4cf},
+	{0xa960, 0xa97f}, {0xac00, 0xd7a3}, {0xf900, 0xfaff}, {0xfe10, 0xfe19},
+	{0xfe30, 0xfe6f}, {0xff00, 0xff60}, {0xffe0, 0xffe6}, {0x1f004, 0x1f004},
+	{0x1f0cf, 0x1f0cf}, {0x1f18e, 0x1f18e}, {0x1f191, 0x1f19a}, {0x1f200, 0x1f251},
+	{0x1f300, 0x1f64f}, {0x1f680, 0x1f6ff}, {0x1f900, 0x1f9ff}, {0x1fa70, 0x1faff},
+	{0x20000, 0x2fffd}, {0x30000, 0x3fffd},
+}
+
+/* columns the rune takes in a terminal: two for the wide East Asian
+ * characters, none for combining marks and format characters */
+func rune_width(r rune) int {
+	if r < 0x300 {
+		return 1
+	}
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+	lo, hi := 0, len(east_asian_wide)
+	for lo < hi {
+		m := (lo + hi) / 2
+		switch {
+		case r < east_asian_wide[m][0]:
+			hi = m
+		case r > east_asian_wide[m][1]:
+			lo = m + 1
+		default:
+			return 2
+		}
+	}
+	return 1
+}
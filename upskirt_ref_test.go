@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"html/template"
+	"io"
 	"markup"
 	"path/filepath"
 	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"testing/fstest"
 )
 
 const (
@@ -93,9 +102,9 @@ func testCrashFiles() {
 	}
 }
 
-func testFiles() {
-	files := []string{"Amps and angle encoding", "Auto links", "Backslash escapes", "Blockquotes with code blocks", "Code Blocks", "Code Spans", "Hard-wrapped paragraphs with list-like lines", "Horizontal rules", "Inline HTML (Advanced)", "Inline HTML (Simple)", "Inline HTML comments", "Links, inline style", "Links, reference style", "Links, shortcut references", "Literal quotes in titles", "Markdown Documentation - Basics", "Markdown Documentation - Syntax", "Nested blockquotes", "Ordered and unordered lists", "Strong and em together", "Tabs", "Tidyness"}
+var files = []string{"Amps and angle encoding", "Auto links", "Backslash escapes", "Blockquotes with code blocks", "Code Blocks", "Code Spans", "Hard-wrapped paragraphs with list-like lines", "Horizontal rules", "Inline HTML (Advanced)", "Inline HTML (Simple)", "Inline HTML comments", "Links, inline style", "Links, reference style", "Links, shortcut references", "Literal quotes in titles", "Markdown Documentation - Basics", "Markdown Documentation - Syntax", "Nested blockquotes", "Ordered and unordered lists", "Strong and em together", "Tabs", "Tidyness"}
 
+func testFiles() {
 	failed := make([]string, 0, len(files))
 	succeded := make([]string, 0, len(files))
 	for _, basename := range files {
@@ -116,6 +125,580 @@ func testFiles() {
 	fmt.Printf("Failed %d out of %d tests\n", len(failed), totalTested)
 }
 
+/* an example in the format of the CommonMark spec.json */
+type cmExample struct {
+	Markdown string `json:"markdown"`
+	Html     string `json:"html"`
+	Example  int    `json:"example"`
+	Section  string `json:"section"`
+}
+
+var (
+	reBlockSpace = regexp.MustCompile(`\s*(</?(?:p|h[1-6]|ul|ol|li|blockquote|pre|hr|div|table|thead|tbody|tr|th|td)\b[^>]*>)\s*`)
+	reSpaces     = regexp.MustCompile(`\s+`)
+	reSelfClose  = regexp.MustCompile(`\s*/>`)
+	rePre        = regexp.MustCompile(`(?s)<pre>.*?</pre>`)
+)
+
+/* normalizes the html the way the spec tests do: whitespace outside of
+ * <pre> is collapsed and dropped around block tags, void tags lose the
+ * xhtml slash */
+func normalizeHtml(s string) string {
+	s = reSelfClose.ReplaceAllString(clean(s), ">")
+	pre := rePre.FindAllString(s, -1)
+	parts := rePre.Split(s, -1)
+	for i := range parts {
+		parts[i] = reSpaces.ReplaceAllString(parts[i], " ")
+		parts[i] = reBlockSpace.ReplaceAllString(parts[i], "$1")
+	}
+	out := parts[0]
+	for i, p := range pre {
+		out += p + parts[i+1]
+	}
+	return strings.TrimSpace(out)
+}
+
+/* the sets of examples and the settings they are rendered with */
+var exampleSets = []struct {
+	basename   string
+	options    uint
+	extensions uint
+	cfg        *markup.Config
+}{
+	{"commonmark", 0, markup.MKDEXT_COMMONMARK, nil},
+	{"attributes", markup.HTML_TOC, markup.MKDEXT_ATTRIBUTES | markup.MKDEXT_FENCED_CODE, nil},
+	{"code_info", 0, markup.MKDEXT_FENCED_CODE | markup.MKDEXT_ATTRIBUTES, nil},
+	{"wikilinks", 0, markup.MKDEXT_WIKI_LINKS, wikiConfig},
+	{"mentions", 0, markup.MKDEXT_MENTIONS | markup.MKDEXT_AUTOLINK, mentionsConfig},
+	{"emoji", 0, markup.MKDEXT_EMOJI | markup.MKDEXT_AUTOLINK | markup.MKDEXT_NO_INTRA_EMPHASIS, emojiConfig},
+	{"autolinks", 0, markup.MKDEXT_AUTOLINK, nil},
+	{"figures", markup.HTML_FIGURES, 0, nil},
+	{"details", 0, markup.MKDEXT_DETAILS | markup.MKDEXT_FENCED_CODE | markup.MKDEXT_LAX_HTML_BLOCKS | markup.MKDEXT_ATTRIBUTES, nil},
+	{"directives", 0, markup.MKDEXT_DIRECTIVES | markup.MKDEXT_FENCED_CODE, directivesConfig},
+	{"markdown_in_html", 0, markup.MKDEXT_MARKDOWN_IN_HTML, nil},
+	{"block_tags", 0, 0, &markup.Config{BlockTags: map[string]bool{"my-widget": true, "video": false}}},
+	{"unicode", 0, markup.MKDEXT_NO_INTRA_EMPHASIS | markup.MKDEXT_AUTOLINK | markup.MKDEXT_STRIKETHROUGH | markup.MKDEXT_EMOJI | markup.MKDEXT_MENTIONS, usersConfig},
+	{"unicode_commonmark", 0, markup.MKDEXT_COMMONMARK, nil},
+	{"formatter", 0, markup.MKDEXT_AUTOLINK, nil},
+}
+
+func readExamples(basename string) []cmExample {
+	fn := filepath.Join(testFilesDir, basename+".json")
+	src, err := ioutil.ReadFile(fn)
+	if err != nil {
+		fmt.Printf("Couldn't open '%s', error: %v\n", fn, err)
+		return nil
+	}
+	var examples []cmExample
+	if err := json.Unmarshal(src, &examples); err != nil {
+		fmt.Printf("Couldn't parse '%s', error: %v\n", fn, err)
+		return nil
+	}
+	return examples
+}
+
+/* runs the examples of testfiles/<basename>.json with the given options */
+func testExamples(basename string, options, extensions uint, cfg *markup.Config) {
+	examples := readExamples(basename)
+	nfailed := 0
+	for _, ex := range examples {
+		html := markup.MarkdownToHtmlConfig([]byte(ex.Markdown), options, extensions, cfg)
+		if normalizeHtml(string(html)) != normalizeHtml(ex.Html) {
+			fmt.Printf("Fail: %s example %d (%s)\n", basename, ex.Example, ex.Section)
+			pprint(ex.Markdown)
+			fmt.Printf("exp:\n")
+			pprint(ex.Html)
+			fmt.Printf("got:\n")
+			pprint(string(html))
+			fmt.Printf("\n")
+			nfailed++
+		}
+	}
+	fmt.Printf("Failed %d out of %d %s examples\n", nfailed, len(examples), basename)
+}
+
+/* renders every testfiles/<dir>/*.md and compares the output with the
+ * golden file of the same name and extension ext */
+func testGolden(dir, ext string, render func([]byte) []byte) {
+	files, _ := filepath.Glob(filepath.Join(testFilesDir, dir, "*.md"))
+	nfailed := 0
+	for _, fn := range files {
+		src, err := ioutil.ReadFile(fn)
+		if err != nil {
+			fmt.Printf("Couldn't open '%s', error: %v\n", fn, err)
+			continue
+		}
+		golden := strings.TrimSuffix(fn, ".md") + ext
+		ref, err := ioutil.ReadFile(golden)
+		if err != nil {
+			fmt.Printf("Couldn't open '%s', error: %v\n", golden, err)
+			nfailed++
+			continue
+		}
+		out := clean(string(render(src)))
+		if out != clean(string(ref)) {
+			fmt.Printf("Fail: '%s'\n", golden)
+			fmt.Printf("exp:\n")
+			pprint(clean(string(ref)))
+			fmt.Printf("got:\n")
+			pprint(out)
+			fmt.Printf("\n")
+			nfailed++
+		}
+	}
+	fmt.Printf("Failed %d out of %d %s files\n", nfailed, len(files), dir)
+}
+
+/* runs the man pages of testfiles/man through groff, which mustn't warn,
+ * and compares the formatted text with the .utf8 fixture next to each
+ * page, made by "groff -t -man -Tutf8 -P-cbou -rLL=300n page.man". The
+ * words are compared, the fill and the glyphs of - and ' vary with the
+ * groff version and the distribution. */
+func testGroff(dir string) {
+	files, _ := filepath.Glob(filepath.Join(testFilesDir, dir, "*.md"))
+	groff, err := exec.LookPath("groff")
+	if err != nil {
+		fmt.Printf("Skipped %s groff output, groff not found\n", dir)
+	}
+	render := manRenderer()
+	nfailed := 0
+	for _, fn := range files {
+		fixture := strings.TrimSuffix(fn, ".md") + ".utf8"
+		ref, err := ioutil.ReadFile(fixture)
+		if err != nil {
+			fmt.Printf("Couldn't open '%s', error: %v\n", fixture, err)
+			nfailed++
+			continue
+		}
+		if groff == "" {
+			continue
+		}
+		src, err := ioutil.ReadFile(fn)
+		if err != nil {
+			fmt.Printf("Couldn't open '%s', error: %v\n", fn, err)
+			continue
+		}
+		var out, warnings bytes.Buffer
+		cmd := exec.Command(groff, "-t", "-man", "-Tutf8", "-P-cbou", "-rLL=300n", "-ww")
+		cmd.Stdin = bytes.NewReader(render(src))
+		cmd.Stdout = &out
+		cmd.Stderr = &warnings
+		if err := cmd.Run(); err != nil || warnings.Len() > 0 {
+			fmt.Printf("Fail: groff on '%s': %v\n", fn, err)
+			pprint(warnings.String())
+			nfailed++
+			continue
+		}
+		if groffWords(out.String()) != groffWords(string(ref)) {
+			fmt.Printf("Fail: '%s'\n", fixture)
+			fmt.Printf("exp:\n")
+			pprint(groffWords(string(ref)))
+			fmt.Printf("got:\n")
+			pprint(groffWords(out.String()))
+			fmt.Printf("\n")
+			nfailed++
+		}
+	}
+	fmt.Printf("Failed %d out of %d %s groff outputs\n", nfailed, len(files), dir)
+}
+
+/* the words of a formatted man page, with the hyphens, minus signs and
+ * quotes in ascii and the rules of the tables as one word */
+func groffWords(s string) string {
+	s = strings.NewReplacer("\u2010", "-", "\u2212", "-", "\u2019", "'", "\u2018", "`").Replace(s)
+	words := strings.Fields(s)
+	for i, w := range words {
+		if len(w) >= 3 && strings.Trim(w, "\u2500-_=+|\u253c\u2502") == "" {
+			words[i] = "---"
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+/* formats every document and checks that the html doesn't change and
+ * that formatting the output again gives the same output */
+func testRoundTrip(name string, docs map[string][]byte, options, extensions uint, cfg *markup.Config) {
+	nfailed := 0
+	for doc, src := range docs {
+		for _, flags := range []uint{0, markup.MARKDOWN_INLINE_REFS} {
+			if !testFormat(name, doc, src, flags, options, extensions, cfg) {
+				nfailed++
+				break
+			}
+		}
+	}
+	fmt.Printf("Failed %d out of %d %s round trips\n", nfailed, len(docs), name)
+}
+
+/* exports the documents as JSON, loads it back and renders the tree, which
+ * must give the html and the text of the document */
+func testJsonRoundTrip(name string, docs map[string][]byte, options, extensions uint, cfg *markup.Config) {
+	var flags uint
+	if options&markup.HTML_FIGURES != 0 {
+		flags = markup.JSON_FIGURES
+	}
+	nfailed := 0
+	for doc, src := range docs {
+		js := markup.MarkdownToJson(src, &markup.JsonOptions{Flags: flags, Extensions: extensions, Config: cfg})
+		tree, err := markup.JsonToNode(js)
+		if err != nil {
+			fmt.Printf("Fail: %s %s doesn't load: %v\n", name, doc, err)
+			nfailed++
+			continue
+		}
+		html := string(markup.MarkdownToHtmlConfig(src, options, extensions, cfg))
+		text := string(markup.MarkdownToText(src, &markup.TextOptions{Extensions: extensions, Config: cfg}))
+		for _, check := range []struct{ exp, got string }{
+			{html, string(tree.Render(&markup.HtmlOptions{Flags: options, Extensions: extensions, Config: cfg}))},
+			{text, string(tree.Render(&markup.TextOptions{Config: cfg}))},
+		} {
+			if check.got != check.exp {
+				fmt.Printf("Fail: %s %s renders differently from JSON\n", name, doc)
+				pprint(string(src))
+				fmt.Printf("json:\n")
+				pprint(string(js))
+				fmt.Printf("exp:\n")
+				pprint(check.exp)
+				fmt.Printf("got:\n")
+				pprint(check.got)
+				fmt.Printf("\n")
+				nfailed++
+				break
+			}
+		}
+	}
+	fmt.Printf("Failed %d out of %d %s JSON round trips\n", nfailed, len(docs), name)
+}
+
+/* checks that the DocBook of the documents is well-formed XML, with a
+ * single root element */
+func testDocbookXml(name string, docs map[string][]byte, extensions uint, cfg *markup.Config) {
+	nfailed := 0
+	for doc, src := range docs {
+		out := markup.MarkdownToDocbook(src, &markup.DocbookOptions{Extensions: extensions, Config: cfg})
+		if err := checkXml(out); err != nil {
+			fmt.Printf("Fail: %s %s isn't well-formed DocBook: %v\n", name, doc, err)
+			pprint(string(src))
+			fmt.Printf("docbook:\n")
+			pprint(string(out))
+			fmt.Printf("\n")
+			nfailed++
+		}
+	}
+	fmt.Printf("Failed %d out of %d %s DocBook documents\n", nfailed, len(docs), name)
+}
+
+func checkXml(data []byte) error {
+	dec := xml.NewDecoder(strings.NewReader(string(data)))
+	depth, roots := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF && depth == 0 && roots == 1 {
+			return nil
+		} else if err == io.EOF {
+			return fmt.Errorf("%d root elements, %d left open", roots, depth)
+		} else if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(strings.TrimSpace(string(t))) > 0 {
+				return fmt.Errorf("text outside of the root element")
+			}
+		}
+	}
+}
+
+/* formats one document with the given flags */
+func testFormat(name, doc string, src []byte, flags, options, extensions uint, cfg *markup.Config) bool {
+	opts := &markup.MarkdownOptions{Flags: flags, Extensions: extensions, Config: cfg}
+	md := markup.MarkdownToMarkdown(src, opts)
+	again := markup.MarkdownToMarkdown(md, opts)
+	html := string(markup.MarkdownToHtmlConfig(src, options, extensions, cfg))
+	mdhtml := string(markup.MarkdownToHtmlConfig(md, options, extensions, cfg))
+	if html != mdhtml {
+		fmt.Printf("Fail: %s %s changes the html\n", name, doc)
+		pprint(string(src))
+		fmt.Printf("formatted:\n")
+		pprint(string(md))
+		fmt.Printf("exp:\n")
+		pprint(html)
+		fmt.Printf("got:\n")
+		pprint(mdhtml)
+		fmt.Printf("\n")
+		return false
+	} else if string(again) != string(md) {
+		fmt.Printf("Fail: %s %s formats differently twice\n", name, doc)
+		pprint(string(md))
+		fmt.Printf("again:\n")
+		pprint(string(again))
+		fmt.Printf("\n")
+		return false
+	}
+	return true
+}
+
+/* the documents of the tests, by name */
+func refDocs() map[string][]byte {
+	docs := make(map[string][]byte)
+	for _, basename := range files {
+		if src, err := ioutil.ReadFile(filepath.Join(testFilesDir, basename+".text")); err == nil {
+			docs[basename] = src
+		}
+	}
+	return docs
+}
+
+func goldenDocs(dir string) map[string][]byte {
+	docs := make(map[string][]byte)
+	fns, _ := filepath.Glob(filepath.Join(testFilesDir, dir, "*.md"))
+	for _, fn := range fns {
+		if src, err := ioutil.ReadFile(fn); err == nil {
+			docs[fn] = src
+		}
+	}
+	return docs
+}
+
+func exampleDocs(basename string) map[string][]byte {
+	docs := make(map[string][]byte)
+	for i, ex := range readExamples(basename) {
+		docs[fmt.Sprintf("example %d", i+1)] = []byte(ex.Markdown)
+	}
+	return docs
+}
+
+const textExtensions = markup.MKDEXT_TABLES | markup.MKDEXT_FENCED_CODE | markup.MKDEXT_AUTOLINK | markup.MKDEXT_STRIKETHROUGH | markup.MKDEXT_LAX_HTML_BLOCKS | markup.MKDEXT_MARKDOWN_IN_HTML
+
+/* plain text with the tables, fenced code, autolink, lax html block and
+ * markdown in html extensions */
+func textRenderer(flags uint, width int) func([]byte) []byte {
+	return func(src []byte) []byte {
+		return markup.MarkdownToText(src, &markup.TextOptions{
+			Flags:      flags,
+			Width:      width,
+			Extensions: textExtensions,
+		})
+	}
+}
+
+/* LaTeX with the extensions of the plain text tests */
+func latexRenderer(flags uint) func([]byte) []byte {
+	return func(src []byte) []byte {
+		return markup.MarkdownToLatex(src, &markup.LatexOptions{Flags: flags, Extensions: textExtensions})
+	}
+}
+
+func ansiRenderer(flags uint, width int) func([]byte) []byte {
+	return func(src []byte) []byte {
+		return markup.MarkdownToAnsi(src, &markup.AnsiOptions{
+			Flags:      flags,
+			Width:      width,
+			Extensions: textExtensions,
+		})
+	}
+}
+
+func manRenderer() func([]byte) []byte {
+	return func(src []byte) []byte {
+		return markup.MarkdownToMan(src, &markup.ManOptions{Extensions: textExtensions})
+	}
+}
+
+func jsonRenderer() func([]byte) []byte {
+	return func(src []byte) []byte {
+		return markup.MarkdownToJson(src, &markup.JsonOptions{Flags: markup.JSON_INDENT, Extensions: textExtensions})
+	}
+}
+
+func docbookRenderer(flags uint) func([]byte) []byte {
+	return func(src []byte) []byte {
+		return markup.MarkdownToDocbook(src, &markup.DocbookOptions{Flags: flags, Extensions: textExtensions})
+	}
+}
+
+/* complete pages, with a table of contents */
+func pageRenderer(tmpl *template.Template, css string) func([]byte) []byte {
+	return func(src []byte) []byte {
+		page, err := markup.MarkdownToHtmlPage(src, &markup.HtmlOptions{
+			Flags:      markup.HTML_TOC,
+			Extensions: textExtensions | markup.MKDEXT_ATTRIBUTES,
+			Stylesheet: "style.css",
+			CSS:        css,
+			Template:   tmpl,
+		})
+		if err != nil {
+			return []byte(err.Error())
+		}
+		return page
+	}
+}
+
+/* external links, in new tabs, with an icon */
+func linksRenderer() func([]byte) []byte {
+	return func(src []byte) []byte {
+		return markup.MarkdownToHtmlOptions(src, &markup.HtmlOptions{
+			Extensions:     markup.MKDEXT_AUTOLINK | markup.MKDEXT_ATTRIBUTES,
+			InternalHosts:  []string{"example.com", ".example.com"},
+			ExternalRel:    "nofollow noopener ugc",
+			ExternalNewTab: true,
+			ExternalClass:  "external",
+		})
+	}
+}
+
+/* fenced code highlighted with the built-in lexers and shoutLexer */
+func highlightRenderer(flags uint) func([]byte) []byte {
+	markup.RegisterLexer(shoutLexer, "shout")
+	return func(src []byte) []byte {
+		return markup.MarkdownToHtml(src, flags, markup.MKDEXT_FENCED_CODE)
+	}
+}
+
+/* a registered lexer: every word is a keyword */
+func shoutLexer(code []byte) []markup.Token {
+	var tokens []markup.Token
+	for len(code) > 0 {
+		i := bytes.IndexAny(code, " \n")
+		if i < 0 {
+			i = len(code)
+		}
+		if i > 0 {
+			tokens = append(tokens, markup.Token{Class: "k", Text: code[:i]})
+		} else {
+			tokens = append(tokens, markup.Token{Text: code[:1]})
+			i = 1
+		}
+		code = code[i:]
+	}
+	return tokens
+}
+
+/* the files that testfiles/include includes */
+var includeFS = fstest.MapFS{
+	"snippets/install.md": {Data: []byte("## Install\n\n```sh\ngo get example.com/app\n```\n")},
+	"snippets/nested.md":  {Data: []byte("Nested:\n\n{{include \"usage.md\"}}\n")},
+	"snippets/usage.md":   {Data: []byte("Run `app -h`, see [the manual][man].\n\n[man]: https://example.com/man\n")},
+	"snippets/up.md":      {Data: []byte("{{include \"../secret.md\"}}\n")},
+	"snippets/escape.md":  {Data: []byte("Escape:\n\n{{include \"../../secret.md\"}}\n")},
+	"secret.md":           {Data: []byte("The secret of the root.\n")},
+	"cycle/a.md":          {Data: []byte("A\n\n{{include \"b.md\"}}\n")},
+	"cycle/b.md":          {Data: []byte("B\n\n{{include \"a.md\"}}\n")},
+	"cycle/self.md":       {Data: []byte("Self\n\n{{include \"self.md\"}}\n")},
+	"deep/1.md":           {Data: []byte("One\n\n{{include \"2.md\"}}\n")},
+	"deep/2.md":           {Data: []byte("Two\n\n{{include \"3.md\"}}\n")},
+	"deep/3.md":           {Data: []byte("Three\n\n{{include \"4.md\"}}\n")},
+	"deep/4.md":           {Data: []byte("Four\n")},
+	"main.go":             {Data: []byte("package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"hi\")\n}\n")},
+}
+
+/* includes read from includeFS */
+func includeRenderer() func([]byte) []byte {
+	cfg := &markup.Config{FS: includeFS, MaxIncludeDepth: 3}
+	return func(src []byte) []byte {
+		return markup.MarkdownToHtmlOptions(src, &markup.HtmlOptions{
+			Extensions: markup.MKDEXT_INCLUDE | markup.MKDEXT_FENCED_CODE,
+			Config:     cfg,
+		})
+	}
+}
+
+/* raw html of user generated content, with the external links marked */
+func sanitizeRenderer(extensions uint) func([]byte) []byte {
+	return func(src []byte) []byte {
+		return markup.MarkdownToHtmlOptions(src, &markup.HtmlOptions{
+			Extensions:    markup.MKDEXT_AUTOLINK | extensions,
+			InternalHosts: []string{"example.com"},
+			ExternalRel:   "nofollow ugc",
+			Policy:        markup.UGCPolicy(),
+		})
+	}
+}
+
+/* the page chrome of testfiles/html_page_template */
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head><title>{{.Title}} - {{or .Meta.site "Docs"}}</title>
+<style>{{.CSS}}</style></head>
+<body>
+<aside>{{.Toc}}</aside>
+<article>{{.Body}}</article>
+</body>
+</html>
+`))
+
+/* handlers for testfiles/directives.json */
+var directivesConfig = &markup.Config{Directives: map[string]markup.Directive{
+	"tabs": func(name, title string, attrs map[string]string, content []byte) ([]byte, bool) {
+		return []byte("<section class=\"tabs\" data-title=\"" + title + "\" data-id=\"" + attrs["id"] + "\">\n" + string(content) + "</section>\n"), true
+	},
+	"skip": func(name, title string, attrs map[string]string, content []byte) ([]byte, bool) {
+		return nil, false
+	},
+}}
+
+/* resolver for testfiles/wikilinks.json, "Missing Page" does not exist */
+var wikiConfig = &markup.Config{WikiResolver: func(page string) (string, bool) {
+	return "/wiki/" + strings.ToLower(strings.Replace(page, " ", "-", -1)), page != "Missing Page"
+}}
+
+/* the default page urls and the page list of markup.WikiLinks */
+func testWikiLinks() {
+	nfailed := 0
+	check := func(what, got, exp string) {
+		if got != exp {
+			fmt.Printf("Fail: %s\nexp:\n", what)
+			pprint(exp)
+			fmt.Printf("got:\n")
+			pprint(got)
+			fmt.Printf("\n")
+			nfailed++
+		}
+	}
+	html := markup.MarkdownToHtml([]byte("[[Page Name]] [[Page Name#Install Notes]] [[#Top]]\n"), 0, markup.MKDEXT_WIKI_LINKS)
+	check("default wiki urls", string(html), `<p><a href="Page_Name">Page Name</a> <a href="Page_Name#Install_Notes">Page Name#Install Notes</a> <a href="#Top">#Top</a></p>`+"\n")
+
+	var src []byte
+	for _, ex := range readExamples("wikilinks") {
+		src = append(src, ex.Markdown...)
+		src = append(src, '\n')
+	}
+	pages := strings.Join(markup.WikiLinks(src, 0), "|")
+	check("WikiLinks", pages, "Page Name|Missing Page|Spaced|Page Name|Page Name|Page Name|Page Name|Missing Page|Page Name")
+	fmt.Printf("Failed %d out of 2 wiki link checks\n", nfailed)
+}
+
+/* custom emoji of testfiles/emoji.json */
+var emojiConfig = &markup.Config{
+	Emoji:       map[string]string{"shipit": "\U0001F43F", "rocket": "R"},
+	EmojiImages: map[string]string{"octocat": "/img/octocat.png"},
+}
+
+/* resolvers for testfiles/mentions.json: @nobody and #0 are unknown */
+var mentionsConfig = &markup.Config{
+	UserResolver: func(user string) (string, bool) {
+		return "/u/" + user, user != "nobody"
+	},
+	IssueResolver: func(repo string, number int) (string, bool) {
+		if repo == "" {
+			repo = "self/repo"
+		}
+		return "/" + repo + "/issues/" + strconv.Itoa(number), number != 0
+	},
+}
+
+/* resolver for the mentions of testfiles/unicode.json */
+var usersConfig = &markup.Config{UserResolver: func(user string) (string, bool) {
+	return "/" + user, true
+}}
+
 func testStrings() {
 	strings_to_test := []string{"l: <http://f.com/>.", "a [b][].\n  [b]: /url/ \"T \"qu\" ins\"", "5 > 6", "a***foo***", "b___bar___", "* 1\n* 2", "*ca", "*\ta", "foo", "_Hello World_!"}
 	for _, s := range strings_to_test {
@@ -126,6 +709,47 @@ func testStrings() {
 func main() {
 	//testCrashFiles()
 	testFiles()
+	for _, set := range exampleSets {
+		testExamples(set.basename, set.options, set.extensions, set.cfg)
+	}
+	testWikiLinks()
+	testGolden("text", ".txt", textRenderer(markup.TEXT_LINK_URLS, 60))
+	testGolden("text_footnotes", ".txt", textRenderer(markup.TEXT_LINK_FOOTNOTES, 50))
+	testGolden("latex", ".tex", latexRenderer(0))
+	testGolden("latex_standalone", ".tex", latexRenderer(markup.LATEX_STANDALONE))
+	testGolden("man", ".man", manRenderer())
+	testGroff("man")
+	testGolden("ansi", ".ansi", ansiRenderer(0, 60))
+	testGolden("ansi_plain", ".txt", ansiRenderer(markup.ANSI_NO_COLOR, 50))
+	testGolden("json", ".json", jsonRenderer())
+	testGolden("docbook", ".xml", docbookRenderer(0))
+	testGolden("html_page", ".html", pageRenderer(nil, ""))
+	testGolden("html_links", ".html", linksRenderer())
+	testGolden("html_sanitize", ".html", sanitizeRenderer(0))
+	testGolden("html_sanitize_blocks", ".html", sanitizeRenderer(markup.MKDEXT_LAX_HTML_BLOCKS|markup.MKDEXT_MARKDOWN_IN_HTML))
+	testGolden("include", ".html", includeRenderer())
+	testGolden("html_highlight", ".html", highlightRenderer(markup.HTML_HIGHLIGHT))
+	testGolden("html_highlight_inline", ".html", highlightRenderer(markup.HTML_HIGHLIGHT_INLINE))
+	testGolden("html_page_template", ".html", pageRenderer(pageTemplate, "main { max-width: 40em; }"))
+	testGolden("docbook_chapter", ".xml", docbookRenderer(markup.DOCBOOK_CHAPTER|markup.DOCBOOK_FIGURES))
+
+	testRoundTrip("upskirt", refDocs(), 0, 0, nil)
+	testRoundTrip("text", goldenDocs("text"), 0, textExtensions, nil)
+	for _, set := range exampleSets {
+		testRoundTrip(set.basename, exampleDocs(set.basename), set.options, set.extensions, set.cfg)
+	}
+
+	testJsonRoundTrip("upskirt", refDocs(), 0, 0, nil)
+	testJsonRoundTrip("text", goldenDocs("text"), 0, textExtensions, nil)
+	for _, set := range exampleSets {
+		testJsonRoundTrip(set.basename, exampleDocs(set.basename), set.options, set.extensions, set.cfg)
+	}
+
+	testDocbookXml("upskirt", refDocs(), 0, nil)
+	testDocbookXml("text", goldenDocs("text"), textExtensions, nil)
+	for _, set := range exampleSets {
+		testDocbookXml(set.basename, exampleDocs(set.basename), set.extensions, set.cfg)
+	}
 	//markup.UnitTest()
 	//testStrings()
 }